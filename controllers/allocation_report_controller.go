@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+	"github.com/SkynetNext/hostport-operator/webhooks"
+)
+
+// AllocationReportName is the ConfigMap in each namespace listing the host
+// ports of its pods, e.g. app-0: "game=7010,voice-udp=7011"
+const AllocationReportName = "hostport-allocations"
+
+// AllocationReportReconciler keeps a ConfigMap per namespace summarizing the
+// hostPorts allocated to its pods, for teams without access to the metrics.
+// Requests are keyed by namespace name.
+type AllocationReportReconciler struct {
+	client.Client
+	// ResyncPeriod is how often each namespace's report is refreshed
+	ResyncPeriod time.Duration
+}
+
+func (r *AllocationReportReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	namespace := req.Name
+	var podList corev1.PodList
+	if err := r.List(ctx, &podList, client.InNamespace(namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	data := make(map[string]string)
+	for _, p := range podList.Items {
+		if allocator.IsTerminal(&p) || allocator.IsReleased(&p) {
+			continue
+		}
+		if ports := reportedPorts(&p); ports != "" {
+			data[p.Name] = ports
+		}
+	}
+
+	cm := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: AllocationReportName}, cm)
+	switch {
+	case apierrors.IsNotFound(err):
+		// Namespaces without hostPorts don't get a report
+		if len(data) == 0 {
+			return ctrl.Result{RequeueAfter: r.ResyncPeriod}, nil
+		}
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      AllocationReportName,
+				Namespace: namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "hostport-operator"},
+			},
+			Data: data,
+		}
+		if err := r.Create(ctx, cm); err != nil {
+			return ctrl.Result{}, err
+		}
+	case err != nil:
+		return ctrl.Result{}, err
+	case !maps.Equal(cm.Data, data):
+		patch := client.MergeFrom(cm.DeepCopy())
+		cm.Data = data
+		if err := r.Patch(ctx, cm, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: r.ResyncPeriod}, nil
+}
+
+// reportedPorts lists the pod's allocated annotations as "name=port" pairs
+// in name order, or "" if it has none
+func reportedPorts(pod *corev1.Pod) string {
+	var entries []string
+	for key, val := range pod.Annotations {
+		if name, ok := strings.CutPrefix(key, webhooks.AnnotationAllocatedPrefix); ok {
+			entries = append(entries, name+"="+val)
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (r *AllocationReportReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("allocation-report").
+		// Any pod change refreshes the report of its namespace
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(func(_ context.Context, obj client.Object) []reconcile.Request {
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+		})).
+		Complete(r)
+}
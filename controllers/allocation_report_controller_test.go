@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/webhooks"
+)
+
+func TestAllocationReportReconciler_Reconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	allocated := func(name, namespace string, ports map[string]string) *corev1.Pod {
+		annotations := make(map[string]string)
+		for portName, port := range ports {
+			annotations[webhooks.AnnotationAllocatedPrefix+portName] = port
+		}
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations}}
+	}
+	app0 := allocated("app-0", "games", map[string]string{"game": "7010", "voice-udp": "7011"})
+	app1 := allocated("app-1", "games", map[string]string{"game": "7020"})
+	done := allocated("job-0", "games", map[string]string{"game": "7030"})
+	done.Status.Phase = corev1.PodSucceeded
+	other := allocated("web-0", "web", map[string]string{"http": "8080"})
+	plain := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "plain"}}
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(app0, app1, done, other, plain).Build()
+	r := &AllocationReportReconciler{Client: fakeClient}
+	ctx := context.Background()
+
+	reconcile := func(namespace string) {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: namespace}}); err != nil {
+			t.Fatalf("Reconcile(%s) error = %v", namespace, err)
+		}
+	}
+	report := func(namespace string) map[string]string {
+		t.Helper()
+		cm := &corev1.ConfigMap{}
+		if err := fakeClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: AllocationReportName}, cm); err != nil {
+			t.Fatalf("Get(%s/%s) error = %v", namespace, AllocationReportName, err)
+		}
+		return cm.Data
+	}
+
+	reconcile("games")
+	want := map[string]string{"app-0": "game=7010,voice-udp=7011", "app-1": "game=7020"}
+	if got := report("games"); !maps.Equal(got, want) {
+		t.Errorf("report(games) = %v, want %v", got, want)
+	}
+
+	// The report follows the namespace's pods
+	if err := fakeClient.Delete(ctx, app1); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	reconcile("games")
+	want = map[string]string{"app-0": "game=7010,voice-udp=7011"}
+	if got := report("games"); !maps.Equal(got, want) {
+		t.Errorf("report(games) after deleting app-1 = %v, want %v", got, want)
+	}
+
+	// A namespace without hostPorts gets no report
+	reconcile("plain")
+	err := fakeClient.Get(ctx, types.NamespacedName{Namespace: "plain", Name: AllocationReportName}, &corev1.ConfigMap{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Get(plain/%s) error = %v, want NotFound", AllocationReportName, err)
+	}
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+// AnnotationCapacity holds the per-protocol host port usage of a node, e.g.
+// {"TCP":{"used":3,"free":998}}
+const AnnotationCapacity = "hostport.io/capacity"
+
+// ProtocolCapacity is the usage of one protocol on a node
+type ProtocolCapacity struct {
+	Used int `json:"used"`
+	Free int `json:"free"`
+}
+
+// NodeCapacityReconciler publishes each node's host port usage as a node
+// annotation, so it can be queried with kubectl. Usage is counted from the
+// hostPorts of the node's pods as listed from the cache, not from the
+// allocator: the controller runs on the leader only, whose allocator sees
+// just the admissions it served itself.
+type NodeCapacityReconciler struct {
+	client.Client
+	// Range is the port range free ports are counted in
+	Range allocator.PortRange
+	// ResyncPeriod is how often each node's annotation is refreshed
+	ResyncPeriod time.Duration
+}
+
+func (r *NodeCapacityReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	node := &corev1.Node{}
+	if err := r.Get(ctx, req.NamespacedName, node); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	var podList corev1.PodList
+	if err := r.List(ctx, &podList); err != nil {
+		return ctrl.Result{}, err
+	}
+	capacity := r.nodeCapacity(node.Name, podList.Items)
+	raw, err := json.Marshal(capacity)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if node.Annotations[AnnotationCapacity] != string(raw) {
+		patch := client.MergeFrom(node.DeepCopy())
+		if node.Annotations == nil {
+			node.Annotations = make(map[string]string)
+		}
+		node.Annotations[AnnotationCapacity] = string(raw)
+		if err := r.Patch(ctx, node, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: r.ResyncPeriod}, nil
+}
+
+// nodeCapacity summarizes used and free ports per protocol for a node. Only
+// ports within Range are counted, so used and free add up to its size; IPv6
+// bindings are left out, as are terminal and released pods.
+func (r *NodeCapacityReconciler) nodeCapacity(nodeName string, pods []corev1.Pod) map[corev1.Protocol]ProtocolCapacity {
+	used := make(map[corev1.Protocol]map[int32]bool)
+	for i := range pods {
+		p := &pods[i]
+		if p.Spec.NodeName != nodeName || allocator.IsTerminal(p) || allocator.IsReleased(p) {
+			continue
+		}
+		for _, c := range p.Spec.Containers {
+			for _, port := range c.Ports {
+				if port.HostPort < r.Range.Min || port.HostPort > r.Range.Max {
+					continue
+				}
+				if ip := net.ParseIP(port.HostIP); ip != nil && ip.To4() == nil {
+					continue
+				}
+				proto := port.Protocol
+				if proto == "" {
+					proto = corev1.ProtocolTCP
+				}
+				if used[proto] == nil {
+					used[proto] = make(map[int32]bool)
+				}
+				used[proto][port.HostPort] = true
+			}
+		}
+	}
+
+	size := int(r.Range.Max - r.Range.Min + 1)
+	capacity := map[corev1.Protocol]ProtocolCapacity{
+		corev1.ProtocolTCP: {Free: size},
+		corev1.ProtocolUDP: {Free: size},
+	}
+	for proto, ports := range used {
+		capacity[proto] = ProtocolCapacity{Used: len(ports), Free: size - len(ports)}
+	}
+	return capacity
+}
+
+func (r *NodeCapacityReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("node-capacity").
+		// Status heartbeats change neither, and would otherwise reconcile
+		// every node every few seconds; ResyncPeriod picks up pod changes
+		For(&corev1.Node{}, builder.WithPredicates(predicate.Or(
+			predicate.GenerationChangedPredicate{},
+			predicate.AnnotationChangedPredicate{},
+		))).
+		Complete(r)
+}
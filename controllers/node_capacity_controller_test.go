@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func TestNodeCapacityReconciler_Reconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node-1",
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 7000, HostPort: 7000, Protocol: corev1.ProtocolTCP},
+						{Name: "voice", ContainerPort: 7001, HostPort: 7001, Protocol: corev1.ProtocolTCP},
+						{Name: "rtp", ContainerPort: 7000, HostPort: 7000, Protocol: corev1.ProtocolUDP},
+						// Neither outside the range nor IPv6 bindings count
+						{Name: "admin", ContainerPort: 9000, HostPort: 9000, Protocol: corev1.ProtocolTCP},
+						{Name: "game-v6", ContainerPort: 7002, HostPort: 7002, HostIP: "::", Protocol: corev1.ProtocolTCP},
+					},
+				},
+			},
+		},
+	}
+
+	// Neither a finished pod nor one on another node counts
+	done := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7002, HostPort: 7002}}}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+	}
+	elsewhere := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-2", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-2",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7003, HostPort: 7003}}}},
+		},
+	}
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(node, pod, done, elsewhere).Build()
+	ctx := context.Background()
+
+	r := &NodeCapacityReconciler{
+		Client: fakeClient,
+		Range:  allocator.PortRange{Min: 7000, Max: 7099},
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "node-1"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	updated := &corev1.Node{}
+	if err := fakeClient.Get(ctx, req.NamespacedName, updated); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	var got map[corev1.Protocol]ProtocolCapacity
+	if err := json.Unmarshal([]byte(updated.Annotations[AnnotationCapacity]), &got); err != nil {
+		t.Fatalf("failed to decode %s: %v", AnnotationCapacity, err)
+	}
+
+	want := map[corev1.Protocol]ProtocolCapacity{
+		corev1.ProtocolTCP: {Used: 2, Free: 98},
+		corev1.ProtocolUDP: {Used: 1, Free: 99},
+	}
+	for proto, w := range want {
+		if got[proto] != w {
+			t.Errorf("capacity[%s] = %+v, want %+v", proto, got[proto], w)
+		}
+	}
+	for proto, c := range got {
+		if c.Used+c.Free != 100 {
+			t.Errorf("capacity[%s] = %+v, want used + free = 100, the range size", proto, c)
+		}
+	}
+	if _, ok := got[allocator.IPv6Protocol(corev1.ProtocolTCP)]; ok {
+		t.Errorf("capacity = %+v, want no IPv6 pseudo-protocol entry", got)
+	}
+}
@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+// NodeReconciler drops the allocator's cached ports of deleted nodes
+type NodeReconciler struct {
+	client.Client
+	Allocator *allocator.Allocator
+}
+
+func (r *NodeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	node := &corev1.Node{}
+	if err := r.Get(ctx, req.NamespacedName, node); !apierrors.IsNotFound(err) {
+		// The node still exists, or the lookup failed and is retried
+		return ctrl.Result{}, err
+	}
+
+	r.Allocator.ForgetNode(req.Name)
+	log.FromContext(ctx).V(1).Info("Dropped cached host ports of deleted node")
+	return ctrl.Result{}, nil
+}
+
+func (r *NodeReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("node").
+		For(&corev1.Node{}).
+		// Each replica keeps its own cache, so every replica reconciles
+		WithOptions(controller.Options{NeedLeaderElection: ptr.To(false)}).
+		Complete(r)
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func TestNodeReconciler_ForgetsDeletedNode(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	}
+	podOn := func(name, nodeName string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.PodSpec{
+				NodeName: nodeName,
+				Containers: []corev1.Container{
+					{
+						Ports: []corev1.ContainerPort{
+							{Name: "game", ContainerPort: 7000, HostPort: 7000},
+							{Name: "rtp", ContainerPort: 7000, HostPort: 7000, Protocol: corev1.ProtocolUDP},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(nodes[0], nodes[1], podOn("app-0", "node-1"), podOn("app-1", "node-2")).
+		Build()
+	alloc := allocator.NewAllocator(fakeClient)
+
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	if err := fakeClient.Delete(ctx, nodes[0]); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	r := &NodeReconciler{Client: fakeClient, Allocator: alloc}
+	for _, name := range []string{"node-1", "node-2"} {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: name}}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("Reconcile(%s) error = %v", name, err)
+		}
+	}
+
+	snapshot := alloc.Snapshot()
+	for key := range snapshot {
+		if strings.HasPrefix(key, "node-1/") {
+			t.Errorf("cache key %s still present after node-1 was deleted", key)
+		}
+	}
+	if got := snapshot["node-2/TCP"]; len(got) != 1 || got[0] != 7000 {
+		t.Errorf("node-2/TCP ports = %v, want [7000]", got)
+	}
+	if got := snapshot["node-2/UDP"]; len(got) != 1 || got[0] != 7000 {
+		t.Errorf("node-2/UDP ports = %v, want [7000]", got)
+	}
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+	"github.com/SkynetNext/hostport-operator/webhooks"
+)
+
+// PodAdoptionReconciler brings pods that set hostPorts themselves, e.g. ones
+// created before the operator was installed, under its management: their
+// ports are imported into the allocator cache and recorded as
+// hostport.io/allocated-* annotations, like ports the webhook allocated.
+type PodAdoptionReconciler struct {
+	client.Client
+	Allocator *allocator.Allocator
+	// Selector picks the pods to adopt
+	Selector labels.Selector
+}
+
+func (r *PodAdoptionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	pod := &corev1.Pod{}
+	if err := r.Get(ctx, req.NamespacedName, pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	// Pods the webhook handles are managed already; unscheduled pods are
+	// reconciled again once bound
+	if !r.Selector.Matches(labels.Set(pod.Labels)) || pod.Annotations[webhooks.AnnotationEnabled] == "true" ||
+		pod.Spec.NodeName == "" || allocator.IsTerminal(pod) || allocator.IsReleased(pod) {
+		return ctrl.Result{}, nil
+	}
+
+	annotations := adoptedAnnotations(pod)
+	if len(annotations) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	// Every replica imports into its own cache; the annotations are written once
+	r.Allocator.AdoptPod(pod)
+	if hasAllocatedAnnotation(pod) {
+		return ctrl.Result{}, nil
+	}
+
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	for key, val := range annotations {
+		pod.Annotations[key] = val
+	}
+	if err := r.Patch(ctx, pod, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+	log.FromContext(ctx).Info("Adopted host ports of existing pod", "ports", len(annotations))
+	return ctrl.Result{}, nil
+}
+
+// adoptedAnnotations returns the allocated annotations of the pod's spec
+// hostPorts, named as the webhook names them
+func adoptedAnnotations(pod *corev1.Pod) map[string]string {
+	annotations := make(map[string]string)
+	for _, c := range pod.Spec.Containers {
+		for _, port := range c.Ports {
+			if port.HostPort == 0 {
+				continue
+			}
+			name := port.Name
+			if name == "" {
+				name = strconv.Itoa(int(port.ContainerPort))
+			}
+			key := webhooks.AnnotationAllocatedPrefix + allocator.AllocationKey(name, port.Protocol)
+			annotations[key] = strconv.Itoa(int(port.HostPort))
+		}
+	}
+	return annotations
+}
+
+// hasAllocatedAnnotation reports whether the pod has any allocated annotation
+func hasAllocatedAnnotation(pod *corev1.Pod) bool {
+	for key := range pod.Annotations {
+		if strings.HasPrefix(key, webhooks.AnnotationAllocatedPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PodAdoptionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pod-adoption").
+		For(&corev1.Pod{}).
+		// Each replica keeps its own cache, so every replica reconciles
+		WithOptions(controller.Options{NeedLeaderElection: ptr.To(false)}).
+		Complete(r)
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func TestPodAdoptionReconciler_ImportsHostPorts(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	legacyPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "legacy-0",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "legacy"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 7777, HostPort: 7010},
+						{Name: "game", ContainerPort: 7777, HostPort: 7010, Protocol: corev1.ProtocolUDP},
+					},
+				},
+			},
+		},
+	}
+	otherPod := legacyPod.DeepCopy()
+	otherPod.Name = "other-0"
+	otherPod.Labels = map[string]string{"app": "other"}
+	otherPod.Spec.Containers[0].Ports = []corev1.ContainerPort{{Name: "game", ContainerPort: 7777, HostPort: 7020}}
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(legacyPod, otherPod).Build()
+	alloc := allocator.NewAllocator(fakeClient)
+	r := &PodAdoptionReconciler{Client: fakeClient, Allocator: alloc, Selector: labels.SelectorFromSet(labels.Set{"app": "legacy"})}
+
+	ctx := context.Background()
+	for _, name := range []string{"legacy-0", "other-0"} {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("Reconcile(%s) error = %v", name, err)
+		}
+	}
+
+	snapshot := alloc.Snapshot()
+	if got := snapshot["node-1/TCP"]; len(got) != 1 || got[0] != 7010 {
+		t.Errorf("node-1/TCP ports = %v, want [7010]", got)
+	}
+	if got := snapshot["node-1/UDP"]; len(got) != 1 || got[0] != 7010 {
+		t.Errorf("node-1/UDP ports = %v, want [7010]", got)
+	}
+
+	adopted := &corev1.Pod{}
+	if err := fakeClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "legacy-0"}, adopted); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	for key, want := range map[string]string{"hostport.io/allocated-game": "7010", "hostport.io/allocated-game-udp": "7010"} {
+		if got := adopted.Annotations[key]; got != want {
+			t.Errorf("annotation %s = %q, want %q", key, got, want)
+		}
+	}
+
+	other := &corev1.Pod{}
+	if err := fakeClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: "other-0"}, other); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(other.Annotations) != 0 {
+		t.Errorf("unselected pod annotations = %v, want none", other.Annotations)
+	}
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+// PodPhaseReconciler releases the host ports of pods that reached a terminal
+// phase, such as completed Job pods, or were annotated with
+// allocator.AnnotationRelease, instead of waiting for their deletion.
+type PodPhaseReconciler struct {
+	client.Client
+	Allocator *allocator.Allocator
+}
+
+func (r *PodPhaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	pod := &corev1.Pod{}
+	if err := r.Get(ctx, req.NamespacedName, pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	if allocator.IsReleased(pod) {
+		r.Allocator.ReleasePod(pod)
+		logger.V(1).Info("Released host ports on request", "annotation", allocator.AnnotationRelease)
+		return ctrl.Result{}, nil
+	}
+
+	if !allocator.IsTerminal(pod) {
+		return ctrl.Result{}, nil
+	}
+
+	r.Allocator.ReleasePod(pod)
+	logger.V(1).Info("Released host ports of terminated pod", "phase", pod.Status.Phase)
+	return ctrl.Result{}, nil
+}
+
+func (r *PodPhaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pod-phase").
+		For(&corev1.Pod{}).
+		// Each replica keeps its own cache, so every replica reconciles
+		WithOptions(controller.Options{NeedLeaderElection: ptr.To(false)}).
+		Complete(r)
+}
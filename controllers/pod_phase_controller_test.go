@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func TestPodPhaseReconciler_ReleasesSucceededPod(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	jobPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "job-abc",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName:      "node-1",
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "work", ContainerPort: 7000, HostPort: 7000},
+					},
+				},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+		},
+	}
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(jobPod).Build()
+	alloc := allocator.NewAllocator(fakeClient)
+
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 1 {
+		t.Fatalf("node-1/TCP ports after warmup = %v, want [7000]", got)
+	}
+
+	// The Job completes
+	jobPod.Status.Phase = corev1.PodSucceeded
+	if err := fakeClient.Status().Update(ctx, jobPod); err != nil {
+		t.Fatalf("Status().Update() error = %v", err)
+	}
+
+	r := &PodPhaseReconciler{Client: fakeClient, Allocator: alloc}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "job-abc"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 0 {
+		t.Errorf("node-1/TCP ports after reconcile = %v, want none", got)
+	}
+
+	// The next node sync doesn't hold the released port again
+	next := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	}
+	requests := []allocator.PortRequest{{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyDynamic}}
+	result, err := alloc.Allocate(ctx, next, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7000 {
+		t.Errorf("Allocate() after reconcile = %d, want the released 7000", result[0].HostPort)
+	}
+}
+
+func TestPodPhaseReconciler_KeepsRunningPod(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	runningPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 7000, HostPort: 7000},
+					},
+				},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+		},
+	}
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(runningPod).Build()
+	alloc := allocator.NewAllocator(fakeClient)
+
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+
+	r := &PodPhaseReconciler{Client: fakeClient, Allocator: alloc}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app-0"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 1 {
+		t.Errorf("node-1/TCP ports after reconcile = %v, want [7000] kept", got)
+	}
+}
+
+func TestPodPhaseReconciler_ReleasesAnnotatedPod(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 7000, HostPort: 7000},
+					},
+				},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+		},
+	}
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(pod).Build()
+	alloc := allocator.NewAllocator(fakeClient)
+
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+
+	// A handoff script gives the ports up while the pod keeps running
+	pod.Annotations = map[string]string{allocator.AnnotationRelease: "true"}
+	if err := fakeClient.Update(ctx, pod); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	r := &PodPhaseReconciler{Client: fakeClient, Allocator: alloc}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app-0"}}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 0 {
+		t.Errorf("node-1/TCP ports after reconcile = %v, want none", got)
+	}
+
+	// The next allocation on the node may take the freed port
+	next := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	}
+	requests := []allocator.PortRequest{{Name: "game", ContainerPort: 7777, Policy: allocator.PolicyDynamic}}
+	result, err := alloc.Allocate(ctx, next, requests, 7000, 7000, 0, 1)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7000 {
+		t.Errorf("Allocate() HostPort = %d, want the released 7000", result[0].HostPort)
+	}
+}
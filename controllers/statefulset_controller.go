@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+// StatefulSetReconciler frees the ports of every member pod of a deleted
+// StatefulSet at once, so its whole Index band is reusable without waiting
+// for each pod to terminate. Members are marked with
+// allocator.AnnotationRelease so node syncs don't hold their ports again.
+type StatefulSetReconciler struct {
+	client.Client
+	Allocator *allocator.Allocator
+}
+
+func (r *StatefulSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	sts := &appsv1.StatefulSet{}
+	err := r.Get(ctx, req.NamespacedName, sts)
+	switch {
+	case apierrors.IsNotFound(err):
+		// Deleted; members left behind are being garbage collected
+	case err != nil:
+		return ctrl.Result{}, err
+	case sts.DeletionTimestamp == nil || controllerutil.ContainsFinalizer(sts, metav1.FinalizerOrphanDependents):
+		// Still there, or its pods are orphaned and keep running
+		return ctrl.Result{}, nil
+	}
+
+	var podList corev1.PodList
+	if err := r.List(ctx, &podList, client.InNamespace(req.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+	var members []*corev1.Pod
+	for i := range podList.Items {
+		owner := metav1.GetControllerOf(&podList.Items[i])
+		if owner == nil || owner.Kind != "StatefulSet" || owner.Name != req.Name || (err == nil && owner.UID != sts.UID) {
+			continue
+		}
+		members = append(members, &podList.Items[i])
+	}
+	if len(members) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	r.Allocator.ReleasePods(members...)
+	for _, pod := range members {
+		if allocator.IsReleased(pod) {
+			continue
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[allocator.AnnotationRelease] = "true"
+		if err := r.Patch(ctx, pod, patch); err != nil && !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+	}
+	log.FromContext(ctx).Info("Released host ports of deleted StatefulSet", "pods", len(members))
+	return ctrl.Result{}, nil
+}
+
+func (r *StatefulSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("statefulset").
+		For(&appsv1.StatefulSet{}).
+		// Each replica keeps its own cache, so every replica reconciles
+		WithOptions(controller.Options{NeedLeaderElection: ptr.To(false)}).
+		Complete(r)
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func TestStatefulSetReconciler_ReleasesDeletedMembers(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	appsv1.AddToScheme(scheme)
+
+	// game-0..2 hold the Index band 7000, 7010, 7020; the StatefulSet is already gone
+	pod := func(name, owner string, hostPort int32) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.PodSpec{
+				NodeName:   "node-1",
+				Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: hostPort, HostPort: hostPort}}}},
+			},
+		}
+		if owner != "" {
+			p.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "StatefulSet", Name: owner, UID: types.UID(owner), Controller: ptr.To(true),
+			}}
+		}
+		return p
+	}
+	var objs []runtime.Object
+	for i := 0; i < 3; i++ {
+		objs = append(objs, pod(fmt.Sprintf("game-%d", i), "game", int32(7000+10*i)))
+	}
+	objs = append(objs, pod("lobby-0", "lobby", 7030), pod("standalone", "", 7040))
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build()
+	alloc := allocator.NewAllocator(fakeClient)
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+
+	r := &StatefulSetReconciler{Client: fakeClient, Allocator: alloc}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "game"}}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	want := []int32{7030, 7040}
+	if got := alloc.Snapshot()["node-1/TCP"]; !slices.Equal(got, want) {
+		t.Errorf("node-1/TCP ports = %v, want %v: the whole band freed, other pods kept", got, want)
+	}
+
+	// Members are marked so the next sync of the node doesn't hold them again
+	for i := 0; i < 3; i++ {
+		member := &corev1.Pod{}
+		if err := fakeClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: fmt.Sprintf("game-%d", i)}, member); err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if !allocator.IsReleased(member) {
+			t.Errorf("game-%d annotations = %v, want %s set", i, member.Annotations, allocator.AnnotationRelease)
+		}
+	}
+	next := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "next-0", Namespace: "default"}, Spec: corev1.PodSpec{NodeName: "node-1"}}
+	requests := []allocator.PortRequest{{Name: "game", HostPort: 7000, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyStatic}}
+	if _, err := alloc.Allocate(ctx, next, requests, 7000, 7099, 0, 10); err != nil {
+		t.Errorf("Allocate(7000) after the node sync error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+// StaleAllocationSweeper periodically releases cached ports whose pod no longer
+// exists, e.g. after a force delete that skipped normal cleanup.
+type StaleAllocationSweeper struct {
+	Allocator *allocator.Allocator
+	// Interval between sweeps
+	Interval time.Duration
+	// TTL is how long an orphaned cache entry is kept before it is released
+	TTL time.Duration
+}
+
+// Reconcile runs a single sweep
+func (s *StaleAllocationSweeper) Reconcile(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("sweeper")
+	released, err := s.Allocator.ReleaseOrphans(ctx, s.TTL)
+	if err != nil {
+		return err
+	}
+	if released > 0 {
+		logger.Info("Released orphaned port allocations", "count", released)
+	}
+	return nil
+}
+
+// Start implements manager.Runnable
+func (s *StaleAllocationSweeper) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("sweeper")
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := s.Reconcile(ctx); err != nil {
+			logger.Error(err, "Stale allocation sweep failed")
+		}
+	}, s.Interval)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Each replica
+// keeps its own cache, so each replica sweeps it.
+func (s *StaleAllocationSweeper) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *StaleAllocationSweeper) SetupWithManager(mgr ctrl.Manager) error {
+	return mgr.Add(s)
+}
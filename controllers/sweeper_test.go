@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func TestStaleAllocationSweeper_Reconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	// A live pod whose port must survive the sweep
+	livePod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "live",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "game",
+							ContainerPort: 8080,
+							HostPort:      7000,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(livePod).Build()
+	alloc := allocator.NewAllocator(fakeClient)
+
+	// Allocate for a pod that never gets persisted, leaving an orphaned cache entry
+	orphan := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "orphan-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+	requests := []allocator.PortRequest{
+		{
+			Name:          "game",
+			ContainerPort: 8080,
+			Policy:        allocator.PolicyDynamic,
+		},
+	}
+
+	ctx := context.Background()
+	result, err := alloc.Allocate(ctx, orphan, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7001 {
+		t.Fatalf("Allocate() HostPort = %d, want 7001", result[0].HostPort)
+	}
+
+	sweeper := &StaleAllocationSweeper{Allocator: alloc, TTL: 0}
+	if err := sweeper.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	got := alloc.Snapshot()["node-1/TCP"]
+	if len(got) != 1 || got[0] != 7000 {
+		t.Errorf("node-1/TCP ports after sweep = %v, want [7000]", got)
+	}
+}
+
+func TestStaleAllocationSweeper_KeepsEntriesWithinTTL(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	alloc := allocator.NewAllocator(fakeClient)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inflight-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+	requests := []allocator.PortRequest{
+		{
+			Name:          "game",
+			ContainerPort: 8080,
+			Policy:        allocator.PolicyDynamic,
+		},
+	}
+
+	ctx := context.Background()
+	if _, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10); err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+
+	// An in-flight admission whose pod isn't persisted yet is kept until the TTL passes
+	sweeper := &StaleAllocationSweeper{Allocator: alloc, TTL: time.Hour}
+	if err := sweeper.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 1 {
+		t.Errorf("node-1/TCP ports after sweep = %v, want the in-flight port kept", got)
+	}
+}
@@ -2,15 +2,29 @@ package allocator
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 
+	"github.com/SkynetNext/hostport-operator/internal/bus"
 	"github.com/SkynetNext/hostport-operator/internal/metrics"
 )
 
@@ -22,215 +36,2288 @@ const (
 	PolicyStatic      PortPolicy = "Static"      // Use hostPort specified in spec
 	PolicyPassthrough PortPolicy = "Passthrough" // hostPort == containerPort
 	PolicyIndex       PortPolicy = "Index"       // hostPort = minPort + (index * stride) + port_index
+	PolicyDaemonSet   PortPolicy = "DaemonSet"   // Same port on every node, hashed from the DaemonSet
 )
 
+// AnnotationNodeEphemeralRange on a Node mirrors its net.ipv4.ip_local_port_range
+// sysctl, e.g. "32768 60999", overriding DefaultEphemeralRange for that node.
+const AnnotationNodeEphemeralRange = "hostport.io/ip-local-port-range"
+
+// AnnotationAllocationMeta records the parameters a pod's ports were allocated
+// with, so a fresh operator can trust the pod's own allocated annotations.
+const AnnotationAllocationMeta = "hostport.io/allocation-meta"
+
+// AllocationMeta is the JSON value of AnnotationAllocationMeta
+type AllocationMeta struct {
+	Policy  PortPolicy `json:"policy"`
+	MinPort int32      `json:"minPort"`
+	MaxPort int32      `json:"maxPort"`
+	Index   int32      `json:"index"`
+}
+
+// ExtraPortNamePrefix names Dynamic ports a pod requests by count rather than
+// as container ports, e.g. "dynamic-0". They exist only as allocated
+// annotations, so the allocator reads them back from there.
+const ExtraPortNamePrefix = "dynamic-"
+
+// AllocationKey is the suffix of a port's allocated annotation
+// (hostport.io/allocated-<key>). TCP ports use the bare name; other protocols
+// are qualified ("game-udp") so a name shared across protocols doesn't collide.
+func AllocationKey(name string, protocol corev1.Protocol) string {
+	if protocol == "" || protocol == corev1.ProtocolTCP {
+		return name
+	}
+	return name + "-" + strings.ToLower(string(protocol))
+}
+
+// extraPortAnnotationPrefix is the allocated annotation prefix of extra ports
+const extraPortAnnotationPrefix = "hostport.io/allocated-" + ExtraPortNamePrefix
+
+// AnnotationNodeReserved on a Node lists ports reserved on it by node-local
+// agents (e.g. a DaemonSet), e.g. "30000,30001" or "30000-30010". They are
+// never allocated on that node.
+const AnnotationNodeReserved = "hostport.io/node-reserved"
+
+// IPv6Protocol is the pseudo-protocol ports bound to IPv6 host addresses are
+// tracked under, e.g. "TCP6", next to the protocol itself for IPv4 and
+// unspecified host addresses.
+func IPv6Protocol(protocol corev1.Protocol) corev1.Protocol {
+	return protocol + "6"
+}
+
+// AnnotationPlacedNode records the node the webhook placed a pending pod on
+// (see LeastUtilizedNode); its ports are tracked there until it is bound.
+const AnnotationPlacedNode = "hostport.io/placed-node"
+
+// AnnotationAssumedNode records, on a pod allocated before it was bound, the
+// node its ports were checked against: a node name, "pending" or GlobalNodeName.
+const AnnotationAssumedNode = "hostport.io/assumed-node"
+
+// PlacedElsewhere reports whether a bound pod's ports were checked against
+// another node than the one it was scheduled to, so they may conflict there.
+// Ports checked while pending or in the global space hold on any node.
+func PlacedElsewhere(pod *corev1.Pod) bool {
+	assumed := pod.Annotations[AnnotationAssumedNode]
+	if assumed == "" || assumed == "pending" || assumed == GlobalNodeName || pod.Spec.NodeName == "" {
+		return false
+	}
+	return assumed != pod.Spec.NodeName
+}
+
+// AnnotationRelease set to "true" on a pod, e.g. by a handoff script before
+// the pod stops serving, frees its ports at once: they are no longer held for
+// it, although the pod still declares them.
+const AnnotationRelease = "hostport.io/release"
+
+// DefaultEphemeralRange is the Linux default range for ephemeral source ports
+var DefaultEphemeralRange = PortRange{Min: 32768, Max: 60999}
+
+// ProtocolAny makes a Reserve or Unreserve cover every protocol at once
+const ProtocolAny corev1.Protocol = "*"
+
+// GlobalNodeName is the node every pod's ports are tracked under with
+// WithGlobalConflictSpace. It can't clash with a real node name.
+const GlobalNodeName = "*"
+
+// ErrRangeExhausted is wrapped by allocation errors caused by running out of free ports
+var ErrRangeExhausted = errors.New("port range exhausted")
+
+// ErrNamespaceCap is wrapped by allocation errors caused by a namespace
+// holding as many ports as WithNamespaceCap allows
+var ErrNamespaceCap = errors.New("namespace hostPort cap reached")
+
 // Allocator manages hostPort allocation with node-awareness and protocol safety
 type Allocator struct {
 	mu     sync.Mutex
 	client client.Client
 	// allocated tracks used ports per node to avoid conflicts
-	// Key: nodeName/protocol (e.g. "worker-1/TCP"), Value: set of used ports
-	allocated map[string]map[int32]bool
+	// Key: nodeName/protocol (e.g. "worker-1/TCP"), Value: used ports
+	allocated map[string]map[int32]portEntry
+	// reserved holds manual maintenance holds, keyed like allocated. Unlike
+	// allocated it is never rebuilt from the cluster state.
+	reserved map[string]map[int32]bool
+	// drained holds nodes that take no new Dynamic or Index allocations
+	drained map[string]bool
+	// assignedNodeAnnotation names a pod annotation a scheduler sets to the
+	// target node before spec.nodeName; empty disables it
+	assignedNodeAnnotation string
+	// ready is set once the initial warmup List has succeeded
+	ready atomic.Bool
+	// systemPortMax is the highest port of the system band; 0 disables the band
+	systemPortMax int32
+	// privilegedNamespaces may be granted ports in the system band
+	privilegedNamespaces map[string]bool
+	// neverAllocate holds ports that are never granted, whatever the range or policy
+	neverAllocate map[int32]bool
+	// widenIncrement and widenCeiling control automatic range widening on exhaustion
+	widenIncrement int32
+	widenCeiling   int32
+	// hashedScanStart starts Dynamic scans at a per-pod hashed offset instead of the range start
+	hashedScanStart bool
+	// excludeEphemeral keeps Dynamic allocation out of the node's ephemeral port range
+	excludeEphemeral bool
+	// indexProtocolBands splits each Index stride block into one sub-band per protocol
+	indexProtocolBands bool
+	// exclusiveMaxPort treats maxPort as the first port past the range, so 7000-8000 is 1000 ports
+	exclusiveMaxPort bool
+	// policies computes ports per PortPolicy; see WithPolicy
+	policies map[PortPolicy]Policy
+	// indexFallback scans the range like Dynamic when an Index port is taken
+	indexFallback bool
+	// gallopingScan makes Dynamic scans probe geometrically before scanning linearly
+	gallopingScan bool
+	// namespaceCap is the most ports the pods of one namespace may hold across
+	// all nodes; 0 disables the cap
+	namespaceCap int
+	// tracing records spans around allocation with the context's tracer
+	tracing bool
+	// rotatingScanStart starts Dynamic scans past the port last allocated on
+	// the node; highWater holds that port, keyed like allocated
+	rotatingScanStart bool
+	highWater         map[string]int32
+	// secondaryPrefix is an old annotation prefix (e.g. "example.com/") whose
+	// allocated annotations are still read for stickiness; empty disables it
+	secondaryPrefix string
+	// fragmentationRange is where LargestFreeBlock is measured; a zero range disables it
+	fragmentationRange PortRange
+	// serviceProtocols fills missing request protocols from the Services selecting the pod
+	serviceProtocols bool
+	// hostPortResource names the node extended resource advertising how many
+	// hostPorts the node can hold; empty disables the check
+	hostPortResource corev1.ResourceName
+	// globalConflictSpace tracks every pod's ports under GlobalNodeName
+	globalConflictSpace bool
+	// terminationGrace keeps released ports out of reach for their holder's
+	// terminationGracePeriodSeconds; graceHolds holds them, keyed like
+	// allocated. Unlike allocated it is never rebuilt from the cluster state.
+	terminationGrace bool
+	graceHolds       map[string]map[int32]graceHold
+	// clock times cache entries and grace holds; see WithClock
+	clock Clock
+	// requireReadyNode denies Dynamic and Index allocation on NotReady nodes
+	requireReadyNode bool
+	// maintenance pauses Dynamic and Index allocation while the clock is in
+	// one of its windows
+	maintenance []TimeWindow
+	// capacityPortsPerPod, when positive, scales the Dynamic range to the
+	// node's capacity, read from capacityLabel or its allocatable pods
+	capacityLabel       string
+	capacityPortsPerPod int32
+	// stuckTerminatingAfter, when positive, frees the ports of pods still
+	// Terminating that long past their deletionTimestamp
+	stuckTerminatingAfter time.Duration
+	// publisher is told about allocated and released ports; see WithPublisher
+	publisher bus.Publisher
+	// phantomResolution decides what node rebuilds do with cached ports no
+	// listed pod backs; see WithPhantomResolution
+	phantomResolution PhantomResolution
+}
+
+// PhantomResolution is what a node rebuild does when the cache holds a port
+// for a pod the fresh List doesn't have, e.g. one deleted without the
+// allocator hearing about it
+type PhantomResolution string
+
+const (
+	// PhantomDrop trusts the List: phantom ports are freed right away
+	PhantomDrop PhantomResolution = "drop"
+	// PhantomKeep trusts the cache: phantom ports stay held until
+	// ReleaseOrphans ages them out, for clusters whose List may lag
+	// behind admissions
+	PhantomKeep PhantomResolution = "keep"
+)
+
+// Clock tells the allocator the time. Cache entry ages, orphan TTLs and
+// grace periods are measured with it, so tests can control them.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// graceHold is a released port not reusable before until, except by its former owner
+type graceHold struct {
+	until time.Time
+	owner string
+}
+
+// Option configures an Allocator
+type Option func(*Allocator)
+
+// WithSystemPortBand restricts ports up to and including maxPort to pods in
+// the given privileged namespaces.
+func WithSystemPortBand(maxPort int32, privilegedNamespaces ...string) Option {
+	return func(a *Allocator) {
+		a.systemPortMax = maxPort
+		for _, ns := range privilegedNamespaces {
+			a.privilegedNamespaces[ns] = true
+		}
+	}
+}
+
+// portEntry records a port held in the allocator cache
+type portEntry struct {
+	// markedAt is when the port was last observed in use
+	markedAt time.Time
+	// owner is the namespace/name of the pod holding the port
+	owner string
+	// allocatedAt is when the owner was created, or admitted if not yet created
+	allocatedAt time.Time
+	// grace is the owner's termination grace period
+	grace time.Duration
+	// policy is the policy the owner was allocated with, empty for ports the
+	// operator didn't allocate; entries with one count in ActiveAllocations
+	policy PortPolicy
+	// mirror marks a pending pool entry of a pod scheduled on a node, which
+	// counts under that node instead
+	mirror bool
+}
+
+// WithNeverAllocate sets ports that are never granted, e.g. 22 or 6443.
+// Dynamic allocation skips them and explicit requests for them are denied.
+func WithNeverAllocate(ports ...int32) Option {
+	return func(a *Allocator) {
+		for _, p := range ports {
+			a.neverAllocate[p] = true
+		}
+	}
+}
+
+// WithRangeWidening lets Dynamic allocation extend an exhausted range past its
+// max port in steps of increment, up to ceiling, instead of failing outright.
+func WithRangeWidening(increment, ceiling int32) Option {
+	return func(a *Allocator) {
+		a.widenIncrement = increment
+		a.widenCeiling = ceiling
+	}
+}
+
+// WithHashedScanStart makes Dynamic allocation start its scan at an offset
+// hashed from the pod name and containerPort, so repeated admission of the
+// same pod returns the same port even if lower ports were taken meanwhile.
+func WithHashedScanStart() Option {
+	return func(a *Allocator) {
+		a.hashedScanStart = true
+	}
+}
+
+// WithRotatingScanStart makes Dynamic allocation start its scan just past the
+// port it last allocated on the node, wrapping at the end of the range, so
+// allocations trend upward and a freed low port isn't reused right away while
+// NAT or conntrack may still track its old flows. It takes precedence over
+// WithHashedScanStart.
+func WithRotatingScanStart() Option {
+	return func(a *Allocator) {
+		a.rotatingScanStart = true
+	}
+}
+
+// WithoutEphemeralExclusion lets Dynamic allocation hand out ports in the
+// node's ephemeral range, which is skipped by default to avoid clashing with
+// outbound connections.
+func WithoutEphemeralExclusion() Option {
+	return func(a *Allocator) {
+		a.excludeEphemeral = false
+	}
+}
+
+// WithTerminalPodsFree used to make ports of pods that finished for good
+// (e.g. completed Jobs) free when building the conflict map.
+//
+// Deprecated: terminal pods no longer bind their ports and are always left
+// out of the conflict map, matching the release done on their phase change.
+func WithTerminalPodsFree() Option {
+	return func(*Allocator) {}
+}
+
+// WithPhantomResolution sets what node rebuilds do with cached ports of pods
+// missing from the List. The default is PhantomDrop.
+func WithPhantomResolution(resolution PhantomResolution) Option {
+	return func(a *Allocator) {
+		a.phantomResolution = resolution
+	}
+}
+
+// WithStuckTerminatingReclaim treats ports of pods still Terminating after
+// their deletionTimestamp (the end of their grace period) plus after as free,
+// e.g. pods of a lost node or with a finalizer nobody removes, instead of
+// holding them until the pod object is finally gone.
+func WithStuckTerminatingReclaim(after time.Duration) Option {
+	return func(a *Allocator) {
+		a.stuckTerminatingAfter = after
+	}
+}
+
+// WithIndexProtocolBands splits each pod's Index stride block into equal
+// sub-bands, one per protocol the pod requests (TCP, then UDP, then SCTP), so
+// a pod's TCP ports and UDP ports are each contiguous instead of interleaved.
+func WithIndexProtocolBands() Option {
+	return func(a *Allocator) {
+		a.indexProtocolBands = true
+	}
+}
+
+// WithExclusiveMaxPort makes the maxPort given to Allocate exclusive, so a
+// 7000-8000 range holds 1000 ports (7000-7999) rather than 1001. Both the
+// Index bound check and the Dynamic scan honour it; explicit Ranges stay
+// inclusive.
+func WithExclusiveMaxPort() Option {
+	return func(a *Allocator) {
+		a.exclusiveMaxPort = true
+	}
+}
+
+// WithIndexFallback makes the Index policy fall back to a Dynamic scan of the
+// range when the pod's computed port is already taken on the node, instead of
+// denying the pod. The result's EffectivePolicy is then PolicyDynamic.
+func WithIndexFallback() Option {
+	return func(a *Allocator) {
+		a.indexFallback = true
+	}
+}
+
+// WithAssignedNodeAnnotation scopes pods without spec.nodeName to the node
+// named by the given annotation, for schedulers that record their decision
+// there before binding, instead of tracking them as pending.
+func WithAssignedNodeAnnotation(key string) Option {
+	return func(a *Allocator) {
+		a.assignedNodeAnnotation = key
+	}
+}
+
+// WithGlobalConflictSpace makes a port held by any pod unavailable on every
+// node, for CNIs that map hostPorts cluster-wide rather than on the pod's
+// node. All ports are then tracked under GlobalNodeName, and node-level
+// settings (reserved ports, ephemeral range, drains) no longer apply.
+func WithGlobalConflictSpace() Option {
+	return func(a *Allocator) {
+		a.globalConflictSpace = true
+	}
+}
+
+// WithTerminationGrace keeps a port from being handed out again for the
+// terminationGracePeriodSeconds of the pod that held it once it is released
+// or its pod is gone, as the pod's process may still be bound to it. A
+// replacement pod of the same name reclaims its ports right away.
+func WithTerminationGrace() Option {
+	return func(a *Allocator) {
+		a.terminationGrace = true
+	}
+}
+
+// WithNodeReadinessCheck denies Dynamic and Index allocation for pods
+// targeting a node whose Ready condition isn't True, as such pods are unlikely
+// to start there. The node is read through the client, so the manager's
+// cached client serves it from the node informer.
+func WithNodeReadinessCheck() Option {
+	return func(a *Allocator) {
+		a.requireReadyNode = true
+	}
+}
+
+// WithMaintenanceWindow denies Dynamic and Index allocation while the clock is
+// inside one of the windows, e.g. during a coordinated change of the port
+// ranges. Static ports are still granted, as their pods bring their own.
+func WithMaintenanceWindow(windows ...TimeWindow) Option {
+	return func(a *Allocator) {
+		a.maintenance = append(a.maintenance, windows...)
+	}
+}
+
+// WithCapacityScaledRange shrinks the [minPort, maxPort] range Dynamic scans
+// on a node to portsPerPod ports for each pod the node can run, so a small
+// node uses the start of the range and a large one more of it. The node's
+// capacity is the integer value of its labelKey label when set, else its
+// allocatable pods. Explicit Ranges and Pools are used as given.
+func WithCapacityScaledRange(labelKey string, portsPerPod int32) Option {
+	return func(a *Allocator) {
+		a.capacityLabel = labelKey
+		a.capacityPortsPerPod = portsPerPod
+	}
+}
+
+// WithPublisher emits an event to the publisher for every port Allocate
+// grants and every port released through Release, ReleasePods,
+// ReleaseByPrefix or ReleaseOrphans, e.g. to a Kafka or NATS topic for
+// external accounting. Ports dropped by a node sync aren't reported.
+func WithPublisher(p bus.Publisher) Option {
+	return func(a *Allocator) {
+		a.publisher = p
+	}
+}
+
+// dryRunKey marks a context of an admission that won't be persisted
+type dryRunKey struct{}
+
+// DryRunContext marks ctx as belonging to a dry-run admission: Allocate then
+// publishes nothing to the WithPublisher publisher
+func DryRunContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// isDryRun reports whether ctx comes from DryRunContext
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// WithClock replaces the wall clock, e.g. with allocatortest.FakeClock
+func WithClock(clock Clock) Option {
+	return func(a *Allocator) {
+		a.clock = clock
+	}
+}
+
+// NodeNameOf returns the node a pod's ports are tracked under: GlobalNodeName
+// with WithGlobalConflictSpace, else its spec.nodeName, else the node in the
+// WithAssignedNodeAnnotation annotation, else the AnnotationPlacedNode node,
+// else "pending".
+func (a *Allocator) NodeNameOf(pod *corev1.Pod) string {
+	if a.globalConflictSpace {
+		return GlobalNodeName
+	}
+	if pod.Spec.NodeName != "" {
+		return pod.Spec.NodeName
+	}
+	if a.assignedNodeAnnotation != "" {
+		if node := pod.Annotations[a.assignedNodeAnnotation]; node != "" {
+			return node
+		}
+	}
+	if node := pod.Annotations[AnnotationPlacedNode]; node != "" {
+		return node
+	}
+	return "pending"
+}
+
+// LeastUtilizedNode returns the node among candidates whose cached ports use
+// the fewest of the ranges, across protocols, the first on a tie. It reads
+// the cache as last synced, without listing pods.
+func (a *Allocator) LeastUtilizedNode(candidates []string, ranges []PortRange) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	best, bestUsed := "", -1
+	for _, node := range candidates {
+		used := 0
+		for key, ports := range a.allocated {
+			if !strings.HasPrefix(key, node+"/") {
+				continue
+			}
+			for p := range ports {
+				if slices.ContainsFunc(ranges, func(r PortRange) bool { return p >= r.Min && p <= r.Max }) {
+					used++
+				}
+			}
+		}
+		if bestUsed < 0 || used < bestUsed {
+			best, bestUsed = node, used
+		}
+	}
+	return best
+}
+
+// WithGallopingScan makes Dynamic allocation probe the range geometrically
+// before scanning it, which is much faster on very large ranges whose free
+// ports are all far from the scan start. The port found is free but not
+// always the first free one in scan order.
+func WithGallopingScan() Option {
+	return func(a *Allocator) {
+		a.gallopingScan = true
+	}
+}
+
+// WithNamespaceCap limits the ports the pods of any one namespace may hold,
+// summed across nodes, so one team can't exhaust shared ranges. Requests past
+// the cap are denied with an error wrapping ErrNamespaceCap.
+func WithNamespaceCap(limit int) Option {
+	return func(a *Allocator) {
+		a.namespaceCap = limit
+	}
+}
+
+// WithTracing records OpenTelemetry spans around Allocate, the node state
+// sync and the Dynamic scan, using the tracer provider of the span carried by
+// the context. Without it no span is started at all.
+func WithTracing() Option {
+	return func(a *Allocator) {
+		a.tracing = true
+	}
+}
+
+// WithHostPortResource honours the node extended resource of the given name
+// (e.g. "hostport.io/host-ports") as the number of hostPorts the node can
+// hold, so the allocator agrees with scheduler-level accounting. A node
+// reporting zero takes no hostPorts; nodes without the resource are unlimited.
+func WithHostPortResource(name corev1.ResourceName) Option {
+	return func(a *Allocator) {
+		a.hostPortResource = name
+	}
+}
+
+// WithSecondaryAnnotationPrefix makes sticky recovery also read allocated
+// annotations written under an old prefix, e.g. "example.com/" for
+// "example.com/allocated-game", while pods migrate to hostport.io/. It is
+// honoured on reads only; new annotations always use hostport.io/, which wins
+// when a pod carries both.
+func WithSecondaryAnnotationPrefix(prefix string) Option {
+	return func(a *Allocator) {
+		a.secondaryPrefix = prefix
+	}
+}
+
+// WithFragmentationRange reports, each time a node is synced, the longest run
+// of consecutive free ports within r for each of its protocols, so operators
+// can tell whether contiguous or paired allocations still fit when the free
+// count alone looks healthy.
+func WithFragmentationRange(r PortRange) Option {
+	return func(a *Allocator) {
+		a.fragmentationRange = r
+	}
+}
+
+// WithServiceProtocols fills in the protocol of requests that leave it empty
+// from the Services selecting the pod: a Service port targeting the request's
+// port name, or else its containerPort, lends its protocol. Requests no
+// Service targets stay TCP.
+func WithServiceProtocols() Option {
+	return func(a *Allocator) {
+		a.serviceProtocols = true
+	}
+}
+
+// tracerName names the tracer of the allocator's spans
+const tracerName = "github.com/SkynetNext/hostport-operator/internal/allocator"
+
+// startSpan starts a span named name when tracing is enabled. The returned
+// function ends it.
+func (a *Allocator) startSpan(ctx context.Context, name string) (context.Context, func()) {
+	if !a.tracing {
+		return ctx, func() {}
+	}
+	ctx, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name)
+	return ctx, func() { span.End() }
+}
+
+// IsReleased reports whether the pod asked for its ports to be freed with AnnotationRelease
+func IsReleased(pod *corev1.Pod) bool {
+	return pod.Annotations[AnnotationRelease] == "true"
+}
+
+// IsTerminal reports whether the pod is done and won't run its containers again
+func IsTerminal(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+		return false
+	}
+	return pod.Spec.RestartPolicy != corev1.RestartPolicyAlways
+}
+
+func NewAllocator(client client.Client, opts ...Option) *Allocator {
+	a := &Allocator{
+		client:               client,
+		excludeEphemeral:     true,
+		allocated:            make(map[string]map[int32]portEntry),
+		reserved:             make(map[string]map[int32]bool),
+		drained:              make(map[string]bool),
+		highWater:            make(map[string]int32),
+		graceHolds:           make(map[string]map[int32]graceHold),
+		clock:                realClock{},
+		publisher:            bus.Nop{},
+		neverAllocate:        make(map[int32]bool),
+		privilegedNamespaces: make(map[string]bool),
+		policies:             builtinPolicies(),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// PortRange is an inclusive range of host ports
+type PortRange struct {
+	Min int32
+	Max int32
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("[%d, %d]", r.Min, r.Max)
+}
+
+// IndexPort computes the hostPort the Index policy assigns to the portIdx-th
+// port of the pod with the given ordinal: minPort + index*stride + portIdx.
+// It doesn't check a max port, only that the result is a valid port number.
+func IndexPort(minPort, index, stride, portIdx int32) (int32, error) {
+	if index < 0 || stride < 0 || portIdx < 0 {
+		return 0, fmt.Errorf("index %d, stride %d and port index %d must not be negative", index, stride, portIdx)
+	}
+	port := int64(minPort) + int64(index)*int64(stride) + int64(portIdx)
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("index port %d (index %d, stride %d, port_idx %d) is outside the valid port range", port, index, stride, portIdx)
+	}
+	return int32(port), nil
+}
+
+// protocolBandOffset returns the offset within the stride block of the i-th
+// request when the block is split into one sub-band per protocol among the
+// Index requests: the request's position among Index ports of its protocol,
+// plus the start of that protocol's sub-band.
+func protocolBandOffset(requests []PortRequest, i int, stride int32) (int32, error) {
+	protocolOf := func(r PortRequest) corev1.Protocol {
+		if r.Protocol == "" {
+			return corev1.ProtocolTCP
+		}
+		return r.Protocol
+	}
+
+	var bands []corev1.Protocol
+	for _, p := range []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP} {
+		if slices.ContainsFunc(requests, func(r PortRequest) bool { return r.Policy == PolicyIndex && protocolOf(r) == p }) {
+			bands = append(bands, p)
+		}
+	}
+	protocol := protocolOf(requests[i])
+	band := int32(slices.Index(bands, protocol))
+	bandSize := stride / int32(len(bands))
+
+	var pos int32
+	for _, r := range requests[:i] {
+		if r.Policy == PolicyIndex && protocolOf(r) == protocol {
+			pos++
+		}
+	}
+	if pos >= bandSize {
+		return 0, fmt.Errorf("%d %s ports don't fit the %s sub-band of %d ports (stride %d)", pos+1, protocol, protocol, bandSize, stride)
+	}
+	return band*bandSize + pos, nil
+}
+
+// TimeWindow is the time interval [Start, End)
+type TimeWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Contains reports whether t is inside the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// ParseTimeWindow parses an RFC 3339 interval "start/end", e.g.
+// "2024-06-01T22:00:00Z/2024-06-02T02:00:00Z".
+func ParseTimeWindow(val string) (TimeWindow, error) {
+	startStr, endStr, ok := strings.Cut(val, "/")
+	if !ok {
+		return TimeWindow{}, fmt.Errorf("invalid time window %q: want start/end", val)
+	}
+	start, err := time.Parse(time.RFC3339, strings.TrimSpace(startStr))
+	if err != nil {
+		return TimeWindow{}, fmt.Errorf("invalid time window start %q: %w", startStr, err)
+	}
+	end, err := time.Parse(time.RFC3339, strings.TrimSpace(endStr))
+	if err != nil {
+		return TimeWindow{}, fmt.Errorf("invalid time window end %q: %w", endStr, err)
+	}
+	if !end.After(start) {
+		return TimeWindow{}, fmt.Errorf("invalid time window %q: end must be after start", val)
+	}
+	return TimeWindow{Start: start, End: end}, nil
+}
+
+// inMaintenance returns the WithMaintenanceWindow window the clock is in
+func (a *Allocator) inMaintenance() (TimeWindow, bool) {
+	if len(a.maintenance) == 0 {
+		return TimeWindow{}, false
+	}
+	now := a.clock.Now()
+	for _, w := range a.maintenance {
+		if w.Contains(now) {
+			return w, true
+		}
+	}
+	return TimeWindow{}, false
+}
+
+// ParsePorts parses a comma-separated list of ports and inclusive port
+// ranges, e.g. "22,6443,7010-7015".
+func ParsePorts(val string) ([]int32, error) {
+	var ports []int32
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		lowStr, highStr, isRange := strings.Cut(item, "-")
+		low, err := strconv.Atoi(lowStr)
+		if err != nil || low < 1 || low > 65535 {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		high := low
+		if isRange {
+			high, err = strconv.Atoi(highStr)
+			if err != nil || high < low || high > 65535 {
+				return nil, fmt.Errorf("invalid port range %q", item)
+			}
+		}
+		for p := low; p <= high; p++ {
+			ports = append(ports, int32(p))
+		}
+	}
+	return ports, nil
+}
+
+// PortRequest defines the allocation requirements
+type PortRequest struct {
+	Name          string
+	ContainerPort int32
+	HostPort      int32
+	Protocol      corev1.Protocol
+	Policy        PortPolicy
+	// Ranges optionally replaces [minPort, maxPort] for Dynamic allocation
+	Ranges []PortRange
+	// Pools, for Dynamic, replace Ranges with port pools in priority order:
+	// a pool is only scanned once every pool before it is exhausted
+	Pools []PortRange
+	// PairProtocols, for Dynamic, allocates one port number that is free in
+	// every listed protocol (e.g. TCP and UDP) and holds it in all of them.
+	// Order is preference: the first protocol's free ports drive the scan.
+	PairProtocols []corev1.Protocol
+	// DualStack holds the port in both IP families: it must be free both for
+	// IPv4 (0.0.0.0) and IPv6 (::) bindings and is reserved in both, the IPv6
+	// family under IPv6Protocol(Protocol). For the IPv6 hold to outlive the
+	// next rebuild from the pod list, the pod declares the port a second time
+	// with an IPv6 hostIP, as the webhook does for hostport.io/dual-stack pods.
+	DualStack bool
+	// PairWithNext allocates an even port P together with P+1, e.g. RTP and
+	// RTCP, and holds both; the result's HostPort is P. Dynamic scans for an
+	// even port with its successor free; other policies must yield an even port.
+	// Like DualStack, P+1 stays held across rebuilds only if the pod declares it.
+	PairWithNext bool
+	// ExcludePorts are never granted to this request, on top of the
+	// allocator's never-allocate set
+	ExcludePorts []int32
+	// Optional, for Dynamic, lets the rest of the batch succeed when no port
+	// is free for this request; it is then returned with HostPort 0
+	Optional bool
+	// EffectivePolicy is set on results to the policy that actually produced
+	// the port, which differs from Policy when a fallback was taken
+	EffectivePolicy PortPolicy
+}
+
+// Allocate performs Agones-aligned port allocation
+func (a *Allocator) Allocate(ctx context.Context, pod *corev1.Pod, requests []PortRequest, minPort, maxPort, index, stride int32) ([]PortRequest, error) {
+	startTime := time.Now()
+	// A batch counts as sticky when it reused a previous port without any range scan
+	batch := &batchState{}
+	defer func() {
+		duration := time.Since(startTime).Seconds()
+		// Record duration for the first request's policy (all requests in a batch share the same policy)
+		if len(requests) > 0 {
+			sticky := strconv.FormatBool(batch.reusedSticky && !batch.scanned)
+			metrics.PortAllocationDurationSeconds.WithLabelValues(string(requests[0].Policy), sticky).Observe(duration)
+		}
+	}()
+
+	ctx, endSpan := a.startSpan(ctx, "Allocate")
+	defer endSpan()
+
+	// Deferred before the unlock, so it runs once a.mu is released
+	var events []bus.Event
+	defer func() { a.publish(events) }()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	nodeName := a.NodeNameOf(pod)
+
+	// Ports marked for this batch, with whatever they replaced; a failed
+	// batch restores them so a rejected pod leaves no phantom ports behind
+	var marked []markedPort
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		for i := len(marked) - 1; i >= 0; i-- {
+			m := marked[i]
+			dropEntry(a.allocated[m.key], m.port)
+			if m.replaced {
+				countEntry(m.prev, 1)
+				a.allocated[m.key][m.port] = m.prev
+			}
+		}
+	}()
+
+	// 1. Sync current node state to build the conflict map and find sticky candidates
+	meta := AllocationMeta{MinPort: minPort, MaxPort: maxPort, Index: index}
+	if len(requests) > 0 {
+		meta.Policy = requests[0].Policy
+	}
+	var err error
+	syncCtx, endSync := a.startSpan(ctx, "syncNodeState")
+	batch.stickyPorts, err = a.syncNodeState(syncCtx, pod, nodeName, meta)
+	endSync()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync node state: %w", err)
+	}
+
+	// The meta above records maxPort as given; from here on it is inclusive
+	if a.exclusiveMaxPort {
+		maxPort--
+	}
+
+	// hostPorts preset in the pod's own spec (e.g. hostPort == containerPort
+	// set by a chart) aren't requests, but they hold their ports all the same
+	a.markSpecPorts(nodeName, pod)
+
+	results := make([]PortRequest, len(requests))
+	// podPorts tracks ports granted earlier in this batch, keyed by protocol/port,
+	// so duplicates within the pod are reported as such rather than as node conflicts
+	podPorts := make(map[string]string)
+	// Node-level settings: ports the node advertises as reserved are never
+	// granted, and nodeSkip holds the ranges Dynamic never scans on this node
+	node := a.getNode(ctx, nodeName)
+	batch.nodeReserved = nodeReservedPorts(ctx, node)
+	if a.excludeEphemeral {
+		batch.nodeSkip = append(batch.nodeSkip, ephemeralRange(ctx, node))
+	}
+	for _, p := range batch.nodeReserved {
+		batch.nodeSkip = append(batch.nodeSkip, PortRange{Min: p, Max: p})
+	}
+	// Ports the namespace's other pods hold, for the namespace cap
+	var namespaceUsed int
+	if a.namespaceCap > 0 {
+		namespaceUsed = a.namespacePorts(pod)
+	}
+	// mark holds a port for the pod, recording it for the rollback and the cap
+	mark := func(protocol corev1.Protocol, port int32, policy PortPolicy) {
+		key := nodeName + "/" + string(protocol)
+		prev, replaced := a.allocated[key][port]
+		marked = append(marked, markedPort{key: key, port: port, prev: prev, replaced: replaced})
+		a.markAllocated(nodeName, protocol, port, pod, policy)
+		// PairProtocols repeat the request's own protocol; a port counts once
+		if !replaced || prev.owner != podOwner(pod) {
+			namespaceUsed++
+		}
+	}
+	// Ports the node can still hold by its extended resource; -1 is unlimited
+	nodeFree := a.nodeResourceFree(node, pod)
+	// The end of the Dynamic range on this node, by its capacity
+	dynamicMax := a.capacityMaxPort(ctx, node, minPort, maxPort)
+	// Events for the ports granted, published once the whole batch succeeds
+	var granted []bus.Event
+	// Protocols of the Service ports targeting the pod, for requests without one
+	var serviceProtocols map[string]corev1.Protocol
+	if a.serviceProtocols {
+		serviceProtocols = a.protocolsFromServices(ctx, pod)
+	}
+	for i, req := range requests {
+		if a.namespaceCap > 0 && namespaceUsed >= a.namespaceCap {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "namespace_cap").Inc()
+			return nil, fmt.Errorf("%w: namespace %s holds %d hostPorts, the cap is %d", ErrNamespaceCap, pod.Namespace, namespaceUsed, a.namespaceCap)
+		}
+
+		if nodeFree == 0 {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "node_resource").Inc()
+			return nil, fmt.Errorf("%w: node %s has no %s left", ErrRangeExhausted, nodeName, a.hostPortResource)
+		}
+
+		protocol := req.Protocol
+		if protocol == "" {
+			protocol = serviceProtocols["name:"+req.Name]
+		}
+		if protocol == "" {
+			protocol = serviceProtocols["port:"+strconv.Itoa(int(req.ContainerPort))]
+		}
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+
+		if a.drained[nodeName] && (req.Policy == PolicyDynamic || req.Policy == PolicyIndex) {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "node_drained").Inc()
+			return nil, fmt.Errorf("node %s is drained: no new %s hostPorts are allocated on it", nodeName, req.Policy)
+		}
+
+		if a.requireReadyNode && node != nil && !isNodeReady(node) && (req.Policy == PolicyDynamic || req.Policy == PolicyIndex) {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "node_not_ready").Inc()
+			return nil, fmt.Errorf("node %s is NotReady: no %s hostPorts are allocated on it until it is Ready", nodeName, req.Policy)
+		}
+
+		if window, ok := a.inMaintenance(); ok && (req.Policy == PolicyDynamic || req.Policy == PolicyIndex) {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "maintenance_window").Inc()
+			return nil, fmt.Errorf("%s hostPort allocation is paused for a maintenance window until %s; Static ports are still granted",
+				req.Policy, window.End.Format(time.RFC3339))
+		}
+
+		policy, ok := a.policies[req.Policy]
+		if !ok {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "unsupported_policy").Inc()
+			return nil, fmt.Errorf("unsupported port policy: %s", req.Policy)
+		}
+		policyReq := &PolicyRequest{
+			PortRequest: req,
+			Position:    i,
+			Requests:    requests,
+			Pod:         pod,
+			NodeName:    nodeName,
+			MinPort:     minPort,
+			MaxPort:     maxPort,
+			Index:       index,
+			Stride:      stride,
+			alloc:       a,
+			batch:       batch,
+		}
+		policyReq.Protocol = protocol
+		policyReq.EffectivePolicy = req.Policy
+		if req.Policy == PolicyDynamic {
+			policyReq.MaxPort = dynamicMax
+		}
+		if req.DualStack {
+			// The IPv6 family is one more protocol the port must be free in
+			pairs := req.PairProtocols
+			if len(pairs) == 0 {
+				pairs = []corev1.Protocol{protocol}
+			}
+			policyReq.PairProtocols = slices.Clone(pairs)
+			for _, p := range pairs {
+				policyReq.PairProtocols = append(policyReq.PairProtocols, IPv6Protocol(p))
+			}
+		}
+		allocatedPort, err := policy.Allocate(ctx, policyReq)
+		if errors.Is(err, errSkipped) {
+			results[i] = req
+			results[i].HostPort = 0
+			results[i].Protocol = protocol
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if a.neverAllocate[allocatedPort] {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "never_allocate").Inc()
+			return nil, fmt.Errorf("port %d is in the operator's never-allocate set", allocatedPort)
+		}
+
+		if slices.Contains(req.ExcludePorts, allocatedPort) {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "excluded").Inc()
+			return nil, fmt.Errorf("port %d is in the pod's exclusion set", allocatedPort)
+		}
+
+		if slices.Contains(batch.nodeReserved, allocatedPort) {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "node_reserved").Inc()
+			return nil, fmt.Errorf("port %d is reserved by node %s (%s)", allocatedPort, nodeName, AnnotationNodeReserved)
+		}
+
+		// System band: low ports are reserved for privileged namespaces
+		if a.systemPortMax > 0 && allocatedPort <= a.systemPortMax && !a.privilegedNamespaces[pod.Namespace] {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "system_band").Inc()
+			return nil, fmt.Errorf("port %d is in the system band (<= %d) reserved for privileged namespaces", allocatedPort, a.systemPortMax)
+		}
+
+		if a.isReserved(nodeName, protocol, allocatedPort) {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "reserved").Inc()
+			return nil, fmt.Errorf("port %d/%s is reserved on node %s", allocatedPort, protocol, nodeName)
+		}
+
+		if until, held := a.inGrace(nodeName+"/"+string(protocol), allocatedPort, podOwner(pod)); held {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "termination_grace").Inc()
+			return nil, fmt.Errorf("port %d/%s on node %s was released by a terminating pod and is reusable from %s",
+				allocatedPort, protocol, nodeName, until.Format(time.RFC3339))
+		}
+
+		podKey := fmt.Sprintf("%s/%d", protocol, allocatedPort)
+		if prev, dup := podPorts[podKey]; dup {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "intra_pod_duplicate").Inc()
+			return nil, fmt.Errorf("port %d/%s is requested by both %q and %q in the same pod", allocatedPort, protocol, prev, req.Name)
+		}
+
+		if req.DualStack && a.isPortInUse(nodeName, IPv6Protocol(protocol), allocatedPort) {
+			metrics.PortConflictsTotal.WithLabelValues(nodeName, string(IPv6Protocol(protocol)), string(req.Policy)).Inc()
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "conflict").Inc()
+			return nil, fmt.Errorf("port %d/%s for %q is already in use for IPv6 on node %s", allocatedPort, protocol, req.Name, nodeName)
+		}
+
+		// Conflict check: distinguish between TCP and UDP (Agones feature)
+		if a.isPortInUse(nodeName, protocol, allocatedPort) {
+			metrics.PortConflictsTotal.WithLabelValues(nodeName, string(protocol), string(req.Policy)).Inc()
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "conflict").Inc()
+			if owner := a.allocated[nodeName+"/"+string(protocol)][allocatedPort].owner; owner != "" {
+				return nil, fmt.Errorf("port %d/%s for %q is already in use on node %s by pod %s", allocatedPort, protocol, req.Name, nodeName, owner)
+			}
+			return nil, fmt.Errorf("port %d/%s for %q is already in use on node %s", allocatedPort, protocol, req.Name, nodeName)
+		}
+
+		// The successor of a paired port is held too, or neither is
+		next := allocatedPort + 1
+		nextKey := fmt.Sprintf("%s/%d", protocol, next)
+		if req.PairWithNext {
+			if allocatedPort%2 != 0 || next > 65535 {
+				metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "pair_alignment").Inc()
+				return nil, fmt.Errorf("port %d for %q must be even to pair with the next port", allocatedPort, req.Name)
+			}
+			_, dup := podPorts[nextKey]
+			if dup || !a.isFree(nodeName+"/"+string(protocol), next) ||
+				slices.Contains(batch.nodeReserved, next) || slices.Contains(req.ExcludePorts, next) {
+				metrics.PortConflictsTotal.WithLabelValues(nodeName, string(protocol), string(req.Policy)).Inc()
+				metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "conflict").Inc()
+				return nil, fmt.Errorf("port %d/%s paired with %d for %q is not free on node %s", next, protocol, allocatedPort, req.Name, nodeName)
+			}
+		}
+
+		// Each port held in each protocol counts against the namespace cap,
+		// as namespacePorts counts them
+		marks := 1
+		for _, p := range policyReq.PairProtocols {
+			if p != protocol {
+				marks++
+			}
+		}
+		if req.PairWithNext {
+			marks++
+		}
+		if a.namespaceCap > 0 && namespaceUsed+marks > a.namespaceCap {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "namespace_cap").Inc()
+			return nil, fmt.Errorf("%w: namespace %s holds %d hostPorts, %q needs %d more, the cap is %d",
+				ErrNamespaceCap, pod.Namespace, namespaceUsed, req.Name, marks, a.namespaceCap)
+		}
+
+		// Mark as used in local memory to prevent intra-Pod conflicts
+		mark(protocol, allocatedPort, req.Policy)
+		podPorts[podKey] = req.Name
+		granted = append(granted, portEvent(bus.EventAllocated, nodeName, protocol, allocatedPort, podOwner(pod)))
+		if req.PairWithNext {
+			mark(protocol, next, req.Policy)
+			podPorts[nextKey] = req.Name
+			granted = append(granted, portEvent(bus.EventAllocated, nodeName, protocol, next, podOwner(pod)))
+		}
+		for _, pairProtocol := range policyReq.PairProtocols {
+			mark(pairProtocol, allocatedPort, req.Policy)
+			podPorts[fmt.Sprintf("%s/%d", pairProtocol, allocatedPort)] = req.Name
+			granted = append(granted, portEvent(bus.EventAllocated, nodeName, pairProtocol, allocatedPort, podOwner(pod)))
+		}
+
+		if nodeFree > 0 {
+			nodeFree--
+		}
+
+		// Record successful allocation
+		metrics.PortAllocationsTotal.WithLabelValues(string(req.Policy), string(protocol)).Inc()
+
+		results[i] = req
+		results[i].HostPort = allocatedPort
+		results[i].Protocol = protocol
+		results[i].EffectivePolicy = policyReq.EffectivePolicy
+	}
+
+	succeeded = true
+	if !isDryRun(ctx) {
+		events = granted
+	}
+	return results, nil
+}
+
+// markedPort is a cache entry an Allocate batch set, and the entry it replaced
+type markedPort struct {
+	key      string
+	port     int32
+	prev     portEntry
+	replaced bool
+}
+
+// publish hands events to the publisher. It is called without a.mu held, so
+// a slow publisher or one calling back into the allocator stalls no admission.
+func (a *Allocator) publish(events []bus.Event) {
+	for _, e := range events {
+		a.publisher.Publish(e)
+	}
+}
+
+// portEvent describes a port of owner (namespace/name) for the publisher
+func portEvent(typ bus.EventType, nodeName string, protocol corev1.Protocol, port int32, owner string) bus.Event {
+	namespace, name, _ := strings.Cut(owner, "/")
+	return bus.Event{Type: typ, Node: nodeName, Namespace: namespace, Pod: name, Port: port, Protocol: string(protocol)}
+}
+
+func (a *Allocator) syncNodeState(ctx context.Context, targetPod *corev1.Pod, nodeName string, meta AllocationMeta) (map[string]int32, error) {
+	// stickyPorts will store ports from an existing pod with the same name (e.g. during rollout)
+	stickyPorts := make(map[string]int32)
+
+	// Host ports are node-wide, so the authoritative state is every pod on the
+	// node, whatever its namespace
+	var podList corev1.PodList
+	if err := a.client.List(ctx, &podList); err != nil {
+		return nil, err
+	}
+
+	// Rebuild the node's cache from the List, keeping the old entries to
+	// resolve phantoms: cached ports no pod backs (e.g. the pod was deleted)
+	listed := make(map[string]bool, len(podList.Items))
+	for _, p := range podList.Items {
+		listed[podOwner(&p)] = true
+	}
+	previous := make(map[string]map[int32]portEntry)
+	for key, ports := range a.allocated {
+		if strings.HasPrefix(key, nodeName+"/") {
+			previous[key] = ports
+			a.allocated[key] = make(map[int32]portEntry)
+			for _, entry := range ports {
+				countEntry(entry, -1)
+			}
+		}
+	}
+	for _, key := range []string{nodeName + "/TCP", nodeName + "/UDP"} {
+		if a.allocated[key] == nil {
+			a.allocated[key] = make(map[int32]portEntry)
+		}
+	}
+	defer a.resolvePhantoms(ctx, previous, listed, podOwner(targetPod))
+
+	for _, p := range podList.Items {
+		// 1. Skip pods on other nodes
+		if nodeName != "pending" && a.NodeNameOf(&p) != nodeName {
+			continue
+		}
+
+		// 2. Identify "Sticky Candidate": A pod with the same name
+		// This is usually the old Pod during a StatefulSet RollingUpdate
+		// A DaemonSet runs one pod per node, so its pods are keyed by the node instead
+		isSamePod := p.Namespace == targetPod.Namespace && p.Name == targetPod.Name
+		if owner := daemonSetOwner(targetPod); owner != "" && nodeName != "pending" && nodeName != GlobalNodeName {
+			isSamePod = isSamePod || daemonSetOwner(&p) == owner
+		}
+
+		// 3. Recovery: If it's the same pod name, extract its current allocations as sticky candidates
+		if isSamePod {
+			for annKey, annVal := range p.Annotations {
+				portName, ok := strings.CutPrefix(annKey, "hostport.io/allocated-")
+				legacy := false
+				if !ok && a.secondaryPrefix != "" {
+					portName, ok = strings.CutPrefix(annKey, a.secondaryPrefix+"allocated-")
+					legacy = true
+				}
+				if !ok {
+					continue
+				}
+				if _, seen := stickyPorts[portName]; seen && legacy {
+					// The current prefix wins over the old one
+					continue
+				}
+				if port, err := strconv.Atoi(annVal); err == nil {
+					stickyPorts[portName] = int32(port)
+				}
+			}
+		}
+
+		// 4. Conflict Check:
+		// If it's the SAME Pod name (and it's being deleted), DON'T mark its ports as "in use"
+		// so the new Pod can reclaim them.
+		if isSamePod && p.DeletionTimestamp != nil {
+			continue
+		}
+
+		// The pending pool holds every pod in the cluster, but a DaemonSet runs
+		// one pod per node: an unscheduled pod never shares a node with the
+		// other pods of its DaemonSet, which all hold the same ports
+		if nodeName == "pending" && !isSamePod {
+			if owner := daemonSetOwner(targetPod); owner != "" && daemonSetOwner(&p) == owner {
+				continue
+			}
+		}
+
+		// Pods that finished for good no longer bind their ports
+		if IsTerminal(&p) {
+			continue
+		}
+
+		// Pods that gave their ports up, or are stuck Terminating
+		if IsReleased(&p) || a.stuckTerminating(&p) {
+			continue
+		}
+
+		// Otherwise, mark its ports as occupied
+		a.markPodPorts(nodeName, &p)
+	}
+
+	// 5. Recovery without the old pod: the pod may carry its own prior
+	// allocation (e.g. restored from a backup). Trust it only if it was made
+	// with the same parameters; ports of an existing same-name pod win.
+	for name, port := range ownAllocations(targetPod, meta) {
+		if _, ok := stickyPorts[name]; !ok {
+			stickyPorts[name] = port
+		}
+	}
+
+	if a.fragmentationRange.Max > 0 {
+		for key := range a.allocated {
+			if node, protocol, _ := strings.Cut(key, "/"); node == nodeName {
+				metrics.LargestFreeBlock.WithLabelValues(nodeName, protocol).Set(float64(a.largestFreeBlock(key, a.fragmentationRange)))
+			}
+		}
+	}
+	return stickyPorts, nil
+}
+
+// resolvePhantoms handles cached ports that a rebuild from the List dropped.
+// By default they stay dropped and are held for the grace period of the pod
+// that held them. With PhantomKeep, ports of pods missing from the List are
+// put back, except the target pod's own, which its allocation replaces;
+// ports of listed pods (e.g. terminal ones) stay dropped either way.
+func (a *Allocator) resolvePhantoms(ctx context.Context, previous map[string]map[int32]portEntry, listed map[string]bool, self string) {
+	for key, ports := range previous {
+		var dropped, kept []int32
+		for p, entry := range ports {
+			if _, ok := a.allocated[key][p]; ok {
+				continue
+			}
+			if a.phantomResolution == PhantomKeep && entry.owner != "" && entry.owner != self && !listed[entry.owner] {
+				a.allocated[key][p] = entry
+				countEntry(entry, 1)
+				kept = append(kept, p)
+				continue
+			}
+			dropped = append(dropped, p)
+			a.holdForGrace(key, p, entry)
+		}
+		if len(dropped) > 0 {
+			slices.Sort(dropped)
+			log.FromContext(ctx).V(1).Info("Dropped cached ports no pod holds", "key", key, "ports", dropped)
+		}
+		if len(kept) > 0 {
+			slices.Sort(kept)
+			log.FromContext(ctx).V(1).Info("Kept cached ports of pods missing from the List", "key", key, "ports", kept)
+		}
+	}
+}
+
+// ownAllocations returns the pod's own allocated annotations if its
+// AnnotationAllocationMeta matches meta, and nothing otherwise
+func ownAllocations(pod *corev1.Pod, meta AllocationMeta) map[string]int32 {
+	val, ok := pod.Annotations[AnnotationAllocationMeta]
+	if !ok {
+		return nil
+	}
+	var recorded AllocationMeta
+	if err := json.Unmarshal([]byte(val), &recorded); err != nil || recorded != meta {
+		return nil
+	}
+	ports := make(map[string]int32)
+	for annKey, annVal := range pod.Annotations {
+		name, ok := strings.CutPrefix(annKey, "hostport.io/allocated-")
+		if !ok {
+			continue
+		}
+		if port, err := strconv.Atoi(annVal); err == nil && port >= int(meta.MinPort) && port <= int(meta.MaxPort) {
+			ports[name] = int32(port)
+		}
+	}
+	return ports
+}
+
+// markPodPorts marks every hostPort held by the pod as used on the given node
+func (a *Allocator) markPodPorts(nodeName string, p *corev1.Pod) {
+	a.markSpecPorts(nodeName, p)
+	for _, port := range extraPorts(p) {
+		a.markUsed(nodeName, corev1.ProtocolTCP, port, p)
+	}
+}
+
+// markSpecPorts marks the hostPorts declared in the pod spec as used on the given node
+func (a *Allocator) markSpecPorts(nodeName string, p *corev1.Pod) {
+	for _, c := range p.Spec.Containers {
+		for _, port := range c.Ports {
+			if port.HostPort != 0 {
+				a.markUsed(nodeName, portFamilyProtocol(port), port.HostPort, p)
+			}
+		}
+	}
+}
+
+// portFamilyProtocol returns the protocol a spec port is tracked under:
+// IPv6Protocol of its protocol when bound to an IPv6 hostIP, else the
+// protocol, TCP if unset
+func portFamilyProtocol(port corev1.ContainerPort) corev1.Protocol {
+	proto := port.Protocol
+	if proto == "" {
+		proto = corev1.ProtocolTCP
+	}
+	if ip := net.ParseIP(port.HostIP); ip != nil && ip.To4() == nil {
+		return IPv6Protocol(proto)
+	}
+	return proto
+}
+
+// extraPorts returns the TCP ports allocated to the pod by count, which
+// appear only in its allocated annotations and not in the spec
+func extraPorts(p *corev1.Pod) []int32 {
+	var ports []int32
+	for key, val := range p.Annotations {
+		if !strings.HasPrefix(key, extraPortAnnotationPrefix) {
+			continue
+		}
+		if port, err := strconv.Atoi(val); err == nil && port > 0 && port <= 65535 {
+			ports = append(ports, int32(port))
+		}
+	}
+	return ports
+}
+
+// Warmup builds the port cache from all existing pods in the cluster.
+// The allocator reports ready only once this has succeeded.
+func (a *Allocator) Warmup(ctx context.Context) error {
+	var podList corev1.PodList
+	if err := a.client.List(ctx, &podList); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, p := range podList.Items {
+		if IsTerminal(&p) || IsReleased(&p) || a.stuckTerminating(&p) {
+			continue
+		}
+		nodeName := a.NodeNameOf(&p)
+		a.markPodPorts(nodeName, &p)
+	}
+	a.ready.Store(true)
+	return nil
+}
+
+// ReadyzCheck is a healthz.Checker that fails until warmup has completed
+func (a *Allocator) ReadyzCheck(_ *http.Request) error {
+	if !a.ready.Load() {
+		return errors.New("allocator warmup not complete")
+	}
+	return nil
+}
+
+// Start implements manager.Runnable, retrying warmup until it succeeds
+func (a *Allocator) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("allocator")
+	err := wait.PollUntilContextCancel(ctx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		if err := a.Warmup(ctx); err != nil {
+			logger.Error(err, "Allocator warmup failed, retrying")
+			return false, nil
+		}
+		logger.Info("Allocator warmup complete")
+		return true, nil
+	})
+	if err != nil {
+		// Context cancelled before warmup finished: the manager is shutting down
+		return nil
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Every replica
+// serves the webhook, so every replica must warm up.
+func (a *Allocator) NeedLeaderElection() bool {
+	return false
+}
+
+// findFreePort scans the ranges for a free port, starting offset ports into
+// the combined ranges and wrapping around.
+func (a *Allocator) findFreePort(nodeName string, protocol corev1.Protocol, ranges []PortRange, offset int64) (int32, error) {
+	key := nodeName + "/" + string(protocol)
+	var total int64
+	for _, r := range ranges {
+		total += max(0, int64(r.Max)-int64(r.Min)+1)
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("%w: no %s ports left to scan in ranges %v", ErrRangeExhausted, protocol, ranges)
+	}
+	// probed counts the ports looked at, for the scan distance histogram
+	var probed int64
+	defer func() {
+		metrics.PortScanDistance.WithLabelValues(string(protocol)).Observe(float64(probed))
+	}()
+	if a.gallopingScan {
+		p, probes, ok := a.gallop(key, ranges, offset, total)
+		probed += probes
+		if ok {
+			return p, nil
+		}
+	}
+	for i := int64(0); i < total; i++ {
+		p := portAt(ranges, (offset+i)%total)
+		probed++
+		if a.isFree(key, p) {
+			return p, nil
+		}
+	}
+	if len(ranges) == 1 {
+		return 0, fmt.Errorf("%w: no free %s ports in range %s", ErrRangeExhausted, protocol, ranges[0])
+	}
+	return 0, fmt.Errorf("%w: no free %s ports in ranges %v", ErrRangeExhausted, protocol, ranges)
+}
+
+// gallopLinearWindow is the gap size below which gallop scans linearly
+const gallopLinearWindow = 64
+
+// gallop probes scan positions 0, 1, 3, 7... (and finally the last one) until
+// it hits a free port, then bisects the gap since the previous, taken probe
+// and scans the last gallopLinearWindow positions linearly. It finds a free
+// port in O(log n) probes when the free ports are bunched far into the scan,
+// but not necessarily the first free one. It reports false when no probe is
+// free; the caller then falls back to a full linear scan. It also returns the
+// number of probes made.
+func (a *Allocator) gallop(key string, ranges []PortRange, offset, total int64) (int32, int64, bool) {
+	var probes int64
+	if total <= 0 {
+		return 0, probes, false
+	}
+	free := func(i int64) bool {
+		probes++
+		return a.isFree(key, portAt(ranges, (offset+i)%total))
+	}
+
+	// lo is the last taken probe, hi the first free one
+	lo, hi := int64(-1), int64(-1)
+	for step := int64(1); ; step *= 2 {
+		probe := min(step-1, total-1)
+		if free(probe) {
+			hi = probe
+			break
+		}
+		lo = probe
+		if probe == total-1 {
+			return 0, probes, false
+		}
+	}
+	for hi-lo > gallopLinearWindow {
+		mid := lo + (hi-lo)/2
+		if free(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	for i := lo + 1; i <= hi; i++ {
+		if free(i) {
+			return portAt(ranges, (offset+i)%total), probes, true
+		}
+	}
+	return portAt(ranges, (offset+hi)%total), probes, true
+}
+
+// largestFreeBlock returns the length of the longest run of free ports in r
+func (a *Allocator) largestFreeBlock(key string, r PortRange) int {
+	longest, run := 0, 0
+	for p := int64(r.Min); p <= int64(r.Max); p++ {
+		if !a.isFree(key, int32(p)) {
+			run = 0
+			continue
+		}
+		run++
+		longest = max(longest, run)
+	}
+	return longest
+}
+
+// findFreeNextPair finds an even port that is free together with its
+// successor, both within the same range
+func (a *Allocator) findFreeNextPair(nodeName string, protocol corev1.Protocol, ranges []PortRange) (int32, error) {
+	key := nodeName + "/" + string(protocol)
+	for _, r := range ranges {
+		start := r.Min + r.Min%2
+		for p := int64(start); p+1 <= int64(r.Max); p += 2 {
+			if a.isFree(key, int32(p)) && a.isFree(key, int32(p+1)) {
+				return int32(p), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: no free even %s port with a free successor in ranges %v", ErrRangeExhausted, protocol, ranges)
+}
+
+// findFreePairPort finds one port number free in every protocol. The free
+// space of the first protocol drives the scan; the rest are checked against it.
+func (a *Allocator) findFreePairPort(nodeName string, protocols []corev1.Protocol, ranges []PortRange, offset int64) (int32, error) {
+	driving := nodeName + "/" + string(protocols[0])
+	var total int64
+	for _, r := range ranges {
+		total += max(0, int64(r.Max)-int64(r.Min)+1)
+	}
+	for i := int64(0); i < total; i++ {
+		p := portAt(ranges, (offset+i)%total)
+		if !a.isFree(driving, p) {
+			continue
+		}
+		if a.isFreeInAll(nodeName, protocols[1:], p) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no port free in all of %v in ranges %v", ErrRangeExhausted, protocols, ranges)
+}
+
+// isFree reports whether a port can be handed out under a nodeName/protocol key
+func (a *Allocator) isFree(key string, port int32) bool {
+	return a.isFreeFor(key, port, "")
+}
+
+// isFreeFor is isFree for a given owner, whose own grace holds don't block it
+func (a *Allocator) isFreeFor(key string, port int32, owner string) bool {
+	_, used := a.allocated[key][port]
+	if used {
+		return false
+	}
+	if _, held := a.inGrace(key, port, owner); held {
+		return false
+	}
+	nodeName, protocol, _ := strings.Cut(key, "/")
+	return !a.isReserved(nodeName, corev1.Protocol(protocol), port) && !a.neverAllocate[port]
+}
+
+// isFreeInAll reports whether a port is free on the node for every protocol
+func (a *Allocator) isFreeInAll(nodeName string, protocols []corev1.Protocol, port int32) bool {
+	for _, protocol := range protocols {
+		if !a.isFree(nodeName+"/"+string(protocol), port) {
+			return false
+		}
+	}
+	return true
+}
+
+// widenRange looks for a free port above the exhausted ranges, extending the
+// upper bound one increment at a time up to the configured ceiling.
+// Ports in the skip ranges are never handed out.
+func (a *Allocator) widenRange(ctx context.Context, nodeName string, protocol corev1.Protocol, ranges, skip []PortRange) (int32, bool) {
+	if a.widenIncrement <= 0 || len(ranges) == 0 {
+		return 0, false
+	}
+	upper := ranges[0].Max
+	for _, r := range ranges[1:] {
+		upper = max(upper, r.Max)
+	}
+	for upper < a.widenCeiling {
+		next := min(upper+a.widenIncrement, a.widenCeiling)
+		extension := excludeRanges([]PortRange{{Min: upper + 1, Max: next}}, skip)
+		if len(extension) == 0 {
+			// The whole increment is skipped, e.g. the ephemeral range
+			upper = next
+			continue
+		}
+		if p, err := a.findFreePort(nodeName, protocol, extension, 0); err == nil {
+			log.FromContext(ctx).Info("Port range exhausted, allocating from widened range",
+				"node", nodeName, "protocol", protocol, "maxPort", upper, "widenedTo", next, "port", p)
+			metrics.PortRangeWideningsTotal.WithLabelValues(nodeName, string(protocol)).Inc()
+			return p, true
+		}
+		upper = next
+	}
+	return 0, false
+}
+
+// getNode returns the node a pod is bound to, or nil if it's pending, tracked
+// globally or can't be read; node-level settings then fall back to their defaults.
+func (a *Allocator) getNode(ctx context.Context, nodeName string) *corev1.Node {
+	if nodeName == "pending" || nodeName == GlobalNodeName {
+		return nil
+	}
+	node := &corev1.Node{}
+	if err := a.client.Get(ctx, client.ObjectKey{Name: nodeName}, node); err != nil {
+		return nil
+	}
+	return node
+}
+
+// capacityMaxPort returns the last port of [minPort, maxPort] Dynamic may use
+// on the node with WithCapacityScaledRange: minPort plus the node's capacity
+// times the ports per pod, capped at maxPort
+func (a *Allocator) capacityMaxPort(ctx context.Context, node *corev1.Node, minPort, maxPort int32) int32 {
+	if a.capacityPortsPerPod <= 0 || node == nil {
+		return maxPort
+	}
+	var capacity int64
+	if val, ok := node.Labels[a.capacityLabel]; ok && a.capacityLabel != "" {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n <= 0 {
+			log.FromContext(ctx).Info("Ignoring invalid node capacity label", "node", node.Name, "label", a.capacityLabel, "value", val)
+		} else {
+			capacity = n
+		}
+	}
+	if capacity == 0 {
+		if pods, ok := node.Status.Allocatable[corev1.ResourcePods]; ok {
+			capacity = pods.Value()
+		}
+	}
+	if capacity <= 0 {
+		return maxPort
+	}
+	return int32(min(int64(maxPort), int64(minPort)+capacity*int64(a.capacityPortsPerPod)-1))
+}
+
+// stuckTerminating reports whether the pod has been Terminating for longer
+// than WithStuckTerminatingReclaim allows
+func (a *Allocator) stuckTerminating(pod *corev1.Pod) bool {
+	if a.stuckTerminatingAfter <= 0 || pod.DeletionTimestamp == nil {
+		return false
+	}
+	return a.clock.Now().Sub(pod.DeletionTimestamp.Time) >= a.stuckTerminatingAfter
 }
 
-func NewAllocator(client client.Client) *Allocator {
-	return &Allocator{
-		client:    client,
-		allocated: make(map[string]map[int32]bool),
+// isNodeReady reports whether the node's Ready condition is True
+func isNodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
 	}
+	return false
 }
 
-// PortRequest defines the allocation requirements
-type PortRequest struct {
-	Name          string
-	ContainerPort int32
-	HostPort      int32
-	Protocol      corev1.Protocol
-	Policy        PortPolicy
+// protocolsFromServices returns the protocols of the ports of the Services
+// selecting the pod, keyed "name:<port name>" or "port:<number>" by the
+// container port they target. A failed lookup leaves protocols to default.
+func (a *Allocator) protocolsFromServices(ctx context.Context, pod *corev1.Pod) map[string]corev1.Protocol {
+	services := &corev1.ServiceList{}
+	if err := a.client.List(ctx, services, client.InNamespace(pod.Namespace)); err != nil {
+		log.FromContext(ctx).Info("Ignoring Service protocols, Services can't be listed", "error", err.Error())
+		return nil
+	}
+	protocols := make(map[string]corev1.Protocol)
+	for _, svc := range services.Items {
+		if len(svc.Spec.Selector) == 0 || !labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		for _, port := range svc.Spec.Ports {
+			if port.Protocol == "" {
+				continue
+			}
+			switch {
+			case port.TargetPort.Type == intstr.String:
+				protocols["name:"+port.TargetPort.StrVal] = port.Protocol
+			case port.TargetPort.IntVal != 0:
+				protocols["port:"+strconv.Itoa(int(port.TargetPort.IntVal))] = port.Protocol
+			default:
+				// An unset targetPort defaults to the Service port
+				protocols["port:"+strconv.Itoa(int(port.Port))] = port.Protocol
+			}
+		}
+	}
+	return protocols
 }
 
-// Allocate performs Agones-aligned port allocation
-func (a *Allocator) Allocate(ctx context.Context, pod *corev1.Pod, requests []PortRequest, minPort, maxPort, index, stride int32) ([]PortRequest, error) {
-	startTime := time.Now()
-	defer func() {
-		duration := time.Since(startTime).Seconds()
-		// Record duration for the first request's policy (all requests in a batch share the same policy)
-		if len(requests) > 0 {
-			metrics.PortAllocationDurationSeconds.WithLabelValues(string(requests[0].Policy)).Observe(duration)
-		}
-	}()
+// ephemeralRange returns the node's ephemeral port range from its
+// AnnotationNodeEphemeralRange, or DefaultEphemeralRange if unset or unknown.
+func ephemeralRange(ctx context.Context, node *corev1.Node) PortRange {
+	if node == nil {
+		return DefaultEphemeralRange
+	}
+	val, ok := node.Annotations[AnnotationNodeEphemeralRange]
+	if !ok {
+		return DefaultEphemeralRange
+	}
+	r, err := parseSysctlRange(val)
+	if err != nil {
+		log.FromContext(ctx).Info("Ignoring invalid ephemeral range annotation", "node", node.Name, "value", val)
+		return DefaultEphemeralRange
+	}
+	return r
+}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// nodeReservedPorts returns the ports the node advertises in AnnotationNodeReserved
+func nodeReservedPorts(ctx context.Context, node *corev1.Node) []int32 {
+	if node == nil {
+		return nil
+	}
+	val, ok := node.Annotations[AnnotationNodeReserved]
+	if !ok {
+		return nil
+	}
+	ports, err := ParsePorts(val)
+	if err != nil {
+		log.FromContext(ctx).Info("Ignoring invalid node reserved ports annotation", "node", node.Name, "value", val)
+		return nil
+	}
+	return ports
+}
 
-	nodeName := pod.Spec.NodeName
-	if nodeName == "" {
-		nodeName = "pending"
+// parseSysctlRange parses a "min max" range as printed by sysctl
+func parseSysctlRange(val string) (PortRange, error) {
+	fields := strings.Fields(val)
+	if len(fields) != 2 {
+		return PortRange{}, fmt.Errorf("range %q must be two ports separated by whitespace", val)
 	}
+	low, err := strconv.Atoi(fields[0])
+	if err != nil || low < 1 || low > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %q", fields[0])
+	}
+	high, err := strconv.Atoi(fields[1])
+	if err != nil || high < low || high > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %q", fields[1])
+	}
+	return PortRange{Min: int32(low), Max: int32(high)}, nil
+}
 
-	// 1. Sync current node state to build the conflict map and find sticky candidates
-	stickyPorts, err := a.syncNodeState(ctx, pod, nodeName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to sync node state: %w", err)
+// excludeRanges returns the ranges with every port of each excluded range removed
+func excludeRanges(ranges, excluded []PortRange) []PortRange {
+	for _, e := range excluded {
+		ranges = excludeRange(ranges, e)
 	}
+	return ranges
+}
 
-	results := make([]PortRequest, len(requests))
-	for i, req := range requests {
-		var allocatedPort int32
-		var err error
+// excludeRange returns the ranges with every port of excluded removed
+func excludeRange(ranges []PortRange, excluded PortRange) []PortRange {
+	var out []PortRange
+	for _, r := range ranges {
+		if r.Max < excluded.Min || r.Min > excluded.Max {
+			out = append(out, r)
+			continue
+		}
+		if r.Min < excluded.Min {
+			out = append(out, PortRange{Min: r.Min, Max: excluded.Min - 1})
+		}
+		if r.Max > excluded.Max {
+			out = append(out, PortRange{Min: excluded.Max + 1, Max: r.Max})
+		}
+	}
+	return out
+}
 
-		protocol := req.Protocol
-		if protocol == "" {
-			protocol = corev1.ProtocolTCP
+// positionAfter returns the scan position of the first port past port across
+// the combined ranges, or 0 when no port of the ranges is past it
+func positionAfter(ranges []PortRange, port int32) int64 {
+	var n int64
+	for _, r := range ranges {
+		size := max(0, int64(r.Max)-int64(r.Min)+1)
+		if port < r.Max {
+			return n + max(0, int64(port)-int64(r.Min)+1)
 		}
+		n += size
+	}
+	return 0
+}
 
-		switch req.Policy {
-		case PolicyStatic:
-			allocatedPort = req.HostPort
-			if allocatedPort == 0 {
-				metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "missing_hostport").Inc()
-				return nil, fmt.Errorf("static policy requires hostPort to be set in spec")
-			}
+// portAt returns the n-th port across the combined ranges
+func portAt(ranges []PortRange, n int64) int32 {
+	for _, r := range ranges {
+		size := max(0, int64(r.Max)-int64(r.Min)+1)
+		if n < size {
+			return r.Min + int32(n)
+		}
+		n -= size
+	}
+	return 0
+}
 
-		case PolicyPassthrough:
-			allocatedPort = req.ContainerPort
+// daemonSetOwner returns namespace/name of the DaemonSet controlling the pod,
+// or "" if it has none
+func daemonSetOwner(pod *corev1.Pod) string {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "DaemonSet" && ref.Controller != nil && *ref.Controller {
+			return pod.Namespace + "/" + ref.Name
+		}
+	}
+	return ""
+}
 
-		case PolicyIndex:
-			// Agones-aligned deterministic stride logic:
-			// pod-0 gets [min, min+stride), pod-1 gets [min+stride, min+2*stride)
-			allocatedPort = minPort + (index * stride) + int32(i)
-			if allocatedPort > maxPort {
-				metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "exceeds_max_port").Inc()
-				return nil, fmt.Errorf("allocated port %d (index %d, port_idx %d) exceeds max-port %d", allocatedPort, index, i, maxPort)
-			}
+// scanOffset derives a stable scan start from the pod name and containerPort,
+// so re-evaluating the same unpersisted pod tends to land on the same port.
+func scanOffset(pod *corev1.Pod, containerPort int32) int64 {
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%s/%d", pod.Namespace, name, containerPort)
+	return int64(h.Sum32())
+}
 
-		case PolicyDynamic:
-			// Stickiness Logic:
-			// Check if we found historical ports for this POD name during syncNodeState
-			foundSticky := false
-			if prevPort, exists := stickyPorts[req.Name]; exists {
-				// Check if the previous port is still free on THIS node
-				if !a.isPortInUse(nodeName, protocol, prevPort) {
-					allocatedPort = prevPort
-					foundSticky = true
-				}
-			}
+func (a *Allocator) isPortInUse(nodeName string, protocol corev1.Protocol, port int32) bool {
+	key := nodeName + "/" + string(protocol)
+	_, used := a.allocated[key][port]
+	return used
+}
 
-			if !foundSticky {
-				allocatedPort, err = a.findFreePort(nodeName, protocol, minPort, maxPort)
-				if err != nil {
-					metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "exhausted").Inc()
-					return nil, err
-				}
-			}
+// Holds reports whether every granted port of allocated is still cached for
+// the pod on its node, e.g. before replaying an earlier admission of the pod
+func (a *Allocator) Holds(pod *corev1.Pod, allocated []PortRequest) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-		default:
-			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "unsupported_policy").Inc()
-			return nil, fmt.Errorf("unsupported port policy: %s", req.Policy)
+	nodeName := a.NodeNameOf(pod)
+	owner := podOwner(pod)
+	for _, r := range allocated {
+		if r.HostPort == 0 {
+			continue
 		}
-
-		// Conflict check: distinguish between TCP and UDP (Agones feature)
-		if a.isPortInUse(nodeName, protocol, allocatedPort) {
-			metrics.PortConflictsTotal.WithLabelValues(nodeName, string(protocol)).Inc()
-			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "conflict").Inc()
-			return nil, fmt.Errorf("port %d/%s is already in use on node %s", allocatedPort, protocol, nodeName)
+		protocol := r.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
 		}
+		entry, ok := a.allocated[nodeName+"/"+string(protocol)][r.HostPort]
+		if !ok || entry.owner != owner {
+			return false
+		}
+	}
+	return true
+}
 
-		// Mark as used in local memory to prevent intra-Pod conflicts
-		a.markUsed(nodeName, protocol, allocatedPort)
+// Snapshot returns a copy of the cached port usage, keyed by "nodeName/protocol"
+// with ports sorted ascending.
+func (a *Allocator) Snapshot() map[string][]int32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-		// Record successful allocation
-		metrics.PortAllocationsTotal.WithLabelValues(string(req.Policy), string(protocol)).Inc()
+	snapshot := make(map[string][]int32, len(a.allocated))
+	for key, ports := range a.allocated {
+		list := make([]int32, 0, len(ports))
+		for p := range ports {
+			list = append(list, p)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		snapshot[key] = list
+	}
+	return snapshot
+}
 
-		results[i] = req
-		results[i].HostPort = allocatedPort
-		results[i].Protocol = protocol
+// FreePorts returns up to n of the lowest ports that are free on a node for
+// the protocol, within the given ranges or the whole port space if none are
+// given. It's a read-only capacity query: nothing is marked as used.
+func (a *Allocator) FreePorts(nodeName string, protocol corev1.Protocol, n int, ranges ...PortRange) []int32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+	if len(ranges) == 0 {
+		ranges = []PortRange{{Min: 1, Max: 65535}}
+	}
+	key := nodeName + "/" + string(protocol)
+	free := make([]int32, 0, max(n, 0))
+	for _, r := range ranges {
+		for p := r.Min; p <= r.Max && len(free) < n; p++ {
+			if a.isFree(key, p) {
+				free = append(free, p)
+			}
+		}
 	}
+	return free
+}
 
-	return results, nil
+// Release frees the given ports on a node so they can be handed out again.
+// Releasing a port also clears the exhaustion flag for that node/protocol.
+func (a *Allocator) Release(nodeName string, protocol corev1.Protocol, ports ...int32) {
+	var events []bus.Event
+	defer func() { a.publish(events) }()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	events = a.release(nodeName, protocol, ports...)
 }
 
-func (a *Allocator) syncNodeState(ctx context.Context, targetPod *corev1.Pod, nodeName string) (map[string]int32, error) {
-	// stickyPorts will store ports from an existing pod with the same name (e.g. during rollout)
-	stickyPorts := make(map[string]int32)
+// release is Release with a.mu held. It returns the events of the released
+// ports, for the caller to publish once a.mu is released.
+func (a *Allocator) release(nodeName string, protocol corev1.Protocol, ports ...int32) []bus.Event {
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+	key := nodeName + "/" + string(protocol)
+	var events []bus.Event
+	for _, p := range ports {
+		if entry, ok := a.allocated[key][p]; ok {
+			a.holdForGrace(key, p, entry)
+			events = append(events, portEvent(bus.EventReleased, nodeName, protocol, p, entry.owner))
+		}
+		dropEntry(a.allocated[key], p)
+	}
+	metrics.PortRangeExhausted.WithLabelValues(nodeName, string(protocol)).Set(0)
+	return events
+}
 
-	// Clear local cache for this node
-	a.allocated[nodeName+"/TCP"] = make(map[int32]bool)
-	a.allocated[nodeName+"/UDP"] = make(map[int32]bool)
+// PortAllocation is a port a pod holds on a node
+type PortAllocation struct {
+	Port     int32
+	Protocol corev1.Protocol
+	// Pod is the namespace/name of the holder
+	Pod string
+	// AllocatedAt is the pod's creation time
+	AllocatedAt time.Time
+}
 
-	var podList corev1.PodList
-	if err := a.client.List(ctx, &podList, client.InNamespace(targetPod.Namespace)); err != nil {
-		return nil, err
+// AllocationsByAge lists the cached ports of a node, oldest allocation
+// first, as a hint for eviction policies.
+func (a *Allocator) AllocationsByAge(nodeName string) []PortAllocation {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var allocations []PortAllocation
+	for key, ports := range a.allocated {
+		node, protocol, _ := strings.Cut(key, "/")
+		if node != nodeName {
+			continue
+		}
+		for port, entry := range ports {
+			allocations = append(allocations, PortAllocation{
+				Port:        port,
+				Protocol:    corev1.Protocol(protocol),
+				Pod:         entry.owner,
+				AllocatedAt: entry.allocatedAt,
+			})
+		}
 	}
+	sort.Slice(allocations, func(i, j int) bool {
+		x, y := allocations[i], allocations[j]
+		if !x.AllocatedAt.Equal(y.AllocatedAt) {
+			return x.AllocatedAt.Before(y.AllocatedAt)
+		}
+		if x.Protocol != y.Protocol {
+			return x.Protocol < y.Protocol
+		}
+		return x.Port < y.Port
+	})
+	return allocations
+}
 
-	for _, p := range podList.Items {
-		// 1. Skip pods on other nodes
-		if nodeName != "pending" && p.Spec.NodeName != nodeName {
+// ReleaseByPrefix frees every cached port on a node held by a pod whose name
+// starts with namePrefix, in any namespace, e.g. during fleet teardown. It
+// returns the number of released ports.
+func (a *Allocator) ReleaseByPrefix(nodeName, namePrefix string) int {
+	var events []bus.Event
+	defer func() { a.publish(events) }()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	released := 0
+	for key, ports := range a.allocated {
+		node, protocol, _ := strings.Cut(key, "/")
+		if node != nodeName {
 			continue
 		}
+		freed := false
+		for port, entry := range ports {
+			_, name, _ := strings.Cut(entry.owner, "/")
+			if entry.owner != "" && strings.HasPrefix(name, namePrefix) {
+				a.holdForGrace(key, port, entry)
+				events = append(events, portEvent(bus.EventReleased, nodeName, corev1.Protocol(protocol), port, entry.owner))
+				dropEntry(ports, port)
+				released++
+				freed = true
+			}
+		}
+		if freed {
+			metrics.PortRangeExhausted.WithLabelValues(nodeName, protocol).Set(0)
+		}
+	}
+	return released
+}
 
-		// 2. Identify "Sticky Candidate": A pod with the same name
-		// This is usually the old Pod during a StatefulSet RollingUpdate
-		isSamePod := p.Name == targetPod.Name
+// ReleasePod frees every hostPort the pod holds on its node
+func (a *Allocator) ReleasePod(pod *corev1.Pod) {
+	a.ReleasePods(pod)
+}
 
-		// 3. Recovery: If it's the same pod name, extract its current allocations as sticky candidates
-		if isSamePod {
-			for annKey, annVal := range p.Annotations {
-				if after, ok := strings.CutPrefix(annKey, "hostport.io/allocated-"); ok {
-					if port, err := strconv.Atoi(annVal); err == nil {
-						portName := after
-						stickyPorts[portName] = int32(port)
-					}
+// ReleasePods frees every hostPort the pods hold on their nodes at once, so
+// no allocation sees a partly freed set, e.g. a deleted StatefulSet's Index band
+func (a *Allocator) ReleasePods(pods ...*corev1.Pod) {
+	var events []bus.Event
+	defer func() { a.publish(events) }()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, pod := range pods {
+		nodeName := a.NodeNameOf(pod)
+		for _, c := range pod.Spec.Containers {
+			for _, port := range c.Ports {
+				if port.HostPort != 0 {
+					events = append(events, a.release(nodeName, portFamilyProtocol(port), port.HostPort)...)
 				}
 			}
 		}
+		if ports := extraPorts(pod); len(ports) > 0 {
+			events = append(events, a.release(nodeName, corev1.ProtocolTCP, ports...)...)
+		}
+	}
+}
 
-		// 4. Conflict Check:
-		// If it's the SAME Pod name (and it's being deleted), DON'T mark its ports as "in use"
-		// so the new Pod can reclaim them.
-		if isSamePod && p.DeletionTimestamp != nil {
-			continue
+// AdoptPod marks the hostPorts of a pod the operator didn't allocate (e.g. one
+// created before it was installed) as used on the pod's node, so they are held
+// without waiting for the next sync of that node.
+func (a *Allocator) AdoptPod(pod *corev1.Pod) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.markPodPorts(a.NodeNameOf(pod), pod)
+}
+
+// ForgetNode drops every cached port and grace hold of a node, e.g. once the
+// node is deleted. Maintenance holds placed by Reserve are kept.
+func (a *Allocator) ForgetNode(nodeName string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key := range a.allocated {
+		if strings.HasPrefix(key, nodeName+"/") {
+			for _, entry := range a.allocated[key] {
+				countEntry(entry, -1)
+			}
+			delete(a.allocated, key)
+			delete(a.highWater, key)
+			_, protocol, _ := strings.Cut(key, "/")
+			metrics.PortRangeExhausted.DeleteLabelValues(nodeName, protocol)
+			metrics.LargestFreeBlock.DeleteLabelValues(nodeName, protocol)
+		}
+	}
+	for key := range a.graceHolds {
+		if strings.HasPrefix(key, nodeName+"/") {
+			delete(a.graceHolds, key)
 		}
+	}
+}
 
-		// Otherwise, mark its ports as occupied
+// Reserve places a maintenance hold on ports of a node so they are never
+// handed out, without any pod owning them. ProtocolAny holds them for every
+// protocol.
+func (a *Allocator) Reserve(nodeName string, protocol corev1.Protocol, ports ...int32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+	key := nodeName + "/" + string(protocol)
+	if a.reserved[key] == nil {
+		a.reserved[key] = make(map[int32]bool)
+	}
+	for _, p := range ports {
+		a.reserved[key][p] = true
+	}
+}
+
+// Unreserve lifts maintenance holds placed by Reserve
+func (a *Allocator) Unreserve(nodeName string, protocol corev1.Protocol, ports ...int32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+	key := nodeName + "/" + string(protocol)
+	for _, p := range ports {
+		delete(a.reserved[key], p)
+	}
+}
+
+// DrainNode stops new Dynamic and Index allocations on a node, e.g. ahead of
+// maintenance. Ports already allocated there stay held, and Static or
+// Passthrough requests are still served.
+func (a *Allocator) DrainNode(nodeName string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.drained[nodeName] = true
+}
+
+// UndrainNode lets a node drained by DrainNode take new allocations again
+func (a *Allocator) UndrainNode(nodeName string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.drained, nodeName)
+}
+
+// ReleaseOrphans drops cached ports that no live pod holds and that have been
+// cached for at least ttl, covering pods force-deleted without cleanup.
+// It returns the number of released ports.
+func (a *Allocator) ReleaseOrphans(ctx context.Context, ttl time.Duration) (int, error) {
+	var podList corev1.PodList
+	if err := a.client.List(ctx, &podList); err != nil {
+		return 0, err
+	}
+
+	// live ports per node/protocol, plus per protocol across all nodes for the "pending" union
+	live := make(map[string]map[int32]bool)
+	liveAnyNode := make(map[string]map[int32]bool)
+	mark := func(set map[string]map[int32]bool, key string, port int32) {
+		if set[key] == nil {
+			set[key] = make(map[int32]bool)
+		}
+		set[key][port] = true
+	}
+	for _, p := range podList.Items {
+		nodeName := a.NodeNameOf(&p)
 		for _, c := range p.Spec.Containers {
 			for _, port := range c.Ports {
-				if port.HostPort != 0 {
-					proto := string(port.Protocol)
-					if proto == "" {
-						proto = "TCP"
-					}
-					key := nodeName + "/" + proto
-					if a.allocated[key] == nil {
-						a.allocated[key] = make(map[int32]bool)
-					}
-					a.allocated[key][port.HostPort] = true
+				if port.HostPort == 0 {
+					continue
 				}
+				proto := string(portFamilyProtocol(port))
+				mark(live, nodeName+"/"+proto, port.HostPort)
+				mark(liveAnyNode, proto, port.HostPort)
 			}
 		}
+		for _, port := range extraPorts(&p) {
+			mark(live, nodeName+"/"+string(corev1.ProtocolTCP), port)
+			mark(liveAnyNode, string(corev1.ProtocolTCP), port)
+		}
 	}
-	return stickyPorts, nil
-}
 
-func (a *Allocator) findFreePort(nodeName string, protocol corev1.Protocol, min, max int32) (int32, error) {
-	key := nodeName + "/" + string(protocol)
-	for p := min; p <= max; p++ {
-		if !a.allocated[key][p] {
-			return p, nil
+	var events []bus.Event
+	defer func() { a.publish(events) }()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	released := 0
+	now := a.clock.Now()
+	for key, ports := range a.allocated {
+		nodeName, proto, _ := strings.Cut(key, "/")
+		for port, entry := range ports {
+			if live[key][port] || (nodeName == "pending" && liveAnyNode[proto][port]) {
+				continue
+			}
+			if now.Sub(entry.markedAt) < ttl {
+				continue
+			}
+			a.holdForGrace(key, port, entry)
+			events = append(events, portEvent(bus.EventReleased, nodeName, corev1.Protocol(proto), port, entry.owner))
+			dropEntry(ports, port)
+			released++
 		}
 	}
-	return 0, fmt.Errorf("exhausted available %s ports in range [%d, %d]", protocol, min, max)
+	return released, nil
 }
 
-func (a *Allocator) isPortInUse(nodeName string, protocol corev1.Protocol, port int32) bool {
-	key := nodeName + "/" + string(protocol)
-	return a.allocated[key][port]
+// isReserved reports whether a port has a maintenance hold for the protocol,
+// either its own or one placed for ProtocolAny
+func (a *Allocator) isReserved(nodeName string, protocol corev1.Protocol, port int32) bool {
+	return a.reserved[nodeName+"/"+string(protocol)][port] || a.reserved[nodeName+"/"+string(ProtocolAny)][port]
+}
+
+// markUsed marks a port as held by the pod, under the policy recorded in its
+// AnnotationAllocationMeta
+func (a *Allocator) markUsed(nodeName string, protocol corev1.Protocol, port int32, pod *corev1.Pod) {
+	a.markAllocated(nodeName, protocol, port, pod, recordedPolicy(pod))
 }
 
-func (a *Allocator) markUsed(nodeName string, protocol corev1.Protocol, port int32) {
+// markAllocated marks a port as held by the pod under policy. A pod not
+// created yet (being admitted) counts as allocated now.
+func (a *Allocator) markAllocated(nodeName string, protocol corev1.Protocol, port int32, pod *corev1.Pod, policy PortPolicy) {
 	key := nodeName + "/" + string(protocol)
 	if a.allocated[key] == nil {
-		a.allocated[key] = make(map[int32]bool)
+		a.allocated[key] = make(map[int32]portEntry)
+	}
+	now := a.clock.Now()
+	allocatedAt := pod.CreationTimestamp.Time
+	if allocatedAt.IsZero() {
+		allocatedAt = now
+	}
+	grace := time.Duration(corev1.DefaultTerminationGracePeriodSeconds) * time.Second
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		grace = time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+	}
+	if old, ok := a.allocated[key][port]; ok {
+		countEntry(old, -1)
+	}
+	entry := portEntry{markedAt: now, owner: podOwner(pod), allocatedAt: allocatedAt, grace: grace, policy: policy,
+		mirror: nodeName == "pending" && a.NodeNameOf(pod) != "pending"}
+	countEntry(entry, 1)
+	a.allocated[key][port] = entry
+}
+
+// dropEntry removes a port from a cache map, uncounting it
+func dropEntry(ports map[int32]portEntry, port int32) {
+	if entry, ok := ports[port]; ok {
+		countEntry(entry, -1)
+		delete(ports, port)
+	}
+}
+
+// countEntry moves ActiveAllocations by delta for an entry with a policy
+func countEntry(entry portEntry, delta float64) {
+	if entry.policy != "" && !entry.mirror {
+		metrics.ActiveAllocations.WithLabelValues(string(entry.policy)).Add(delta)
+	}
+}
+
+// recordedPolicy returns the policy in the pod's AnnotationAllocationMeta, or
+// "" if the operator didn't allocate its ports
+func recordedPolicy(pod *corev1.Pod) PortPolicy {
+	val, ok := pod.Annotations[AnnotationAllocationMeta]
+	if !ok {
+		return ""
+	}
+	var meta AllocationMeta
+	if err := json.Unmarshal([]byte(val), &meta); err != nil {
+		return ""
+	}
+	return meta.Policy
+}
+
+// holdForGrace keeps a port released from the cache out of reach for the
+// termination grace period of the pod that held it
+func (a *Allocator) holdForGrace(key string, port int32, entry portEntry) {
+	if !a.terminationGrace || entry.grace <= 0 {
+		return
+	}
+	if a.graceHolds[key] == nil {
+		a.graceHolds[key] = make(map[int32]graceHold)
+	}
+	a.graceHolds[key][port] = graceHold{until: a.clock.Now().Add(entry.grace), owner: entry.owner}
+}
+
+// inGrace returns when the port's grace hold ends if it holds the port
+// against owner; an expired hold is dropped. An empty owner matches nobody.
+func (a *Allocator) inGrace(key string, port int32, owner string) (time.Time, bool) {
+	hold, ok := a.graceHolds[key][port]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !a.clock.Now().Before(hold.until) {
+		delete(a.graceHolds[key], port)
+		return time.Time{}, false
 	}
-	a.allocated[key][port] = true
+	return hold.until, hold.owner != owner
+}
+
+// namespacePorts counts the cached ports held by pods of the pod's namespace
+// on any node, other than the pod itself. A port is counted once per owner
+// and protocol, as the pending pool mirrors the ports of scheduled pods.
+func (a *Allocator) namespacePorts(pod *corev1.Pod) int {
+	self := podOwner(pod)
+	held := make(map[string]bool)
+	for key, ports := range a.allocated {
+		_, protocol, _ := strings.Cut(key, "/")
+		for port, entry := range ports {
+			if entry.owner != self && strings.HasPrefix(entry.owner, pod.Namespace+"/") {
+				held[fmt.Sprintf("%s/%s/%d", entry.owner, protocol, port)] = true
+			}
+		}
+	}
+	return len(held)
+}
+
+// nodeResourceFree returns how many more ports the node can hold by its
+// WithHostPortResource allocatable, less the cached ports other pods hold on
+// it, or -1 when the node doesn't advertise the resource.
+func (a *Allocator) nodeResourceFree(node *corev1.Node, pod *corev1.Pod) int64 {
+	if a.hostPortResource == "" || node == nil {
+		return -1
+	}
+	quantity, ok := node.Status.Allocatable[a.hostPortResource]
+	if !ok {
+		return -1
+	}
+	self := podOwner(pod)
+	var held int64
+	for key, ports := range a.allocated {
+		if !strings.HasPrefix(key, node.Name+"/") {
+			continue
+		}
+		for _, entry := range ports {
+			if entry.owner != self {
+				held++
+			}
+		}
+	}
+	return max(quantity.Value()-held, 0)
+}
+
+// podOwner is the owner recorded for the ports of a pod
+func podOwner(pod *corev1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
 }
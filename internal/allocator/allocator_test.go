@@ -2,20 +2,60 @@ package allocator
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/SkynetNext/hostport-operator/internal/bus"
+	"github.com/SkynetNext/hostport-operator/internal/bus/bustest"
+
+	"github.com/SkynetNext/hostport-operator/internal/metrics"
 )
 
-func TestAllocator_IndexPolicy(t *testing.T) {
+// newTestAllocator returns an Allocator over a fake client holding objs; the
+// client is alloc.client
+func newTestAllocator(t *testing.T, objs []client.Object, opts ...Option) *Allocator {
+	t.Helper()
 	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("AddToScheme() error = %v", err)
+	}
+	return NewAllocator(fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(), opts...)
+}
 
-	alloc := NewAllocator(fakeClient)
+// podWithPorts returns pod name in default on node, with one container
+// declaring ports if any are given
+func podWithPorts(name, node string, ports ...corev1.ContainerPort) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: node},
+	}
+	if len(ports) > 0 {
+		pod.Spec.Containers = []corev1.Container{{Ports: ports}}
+	}
+	return pod
+}
+
+func TestAllocator_IndexPolicy(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
 
 	tests := []struct {
 		name      string
@@ -113,11 +153,7 @@ func TestAllocator_IndexPolicy(t *testing.T) {
 }
 
 func TestAllocator_PassthroughPolicy(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-	alloc := NewAllocator(fakeClient)
+	alloc := newTestAllocator(t, nil)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -161,11 +197,7 @@ func TestAllocator_PassthroughPolicy(t *testing.T) {
 }
 
 func TestAllocator_StaticPolicy(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-	alloc := NewAllocator(fakeClient)
+	alloc := newTestAllocator(t, nil)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -200,11 +232,7 @@ func TestAllocator_StaticPolicy(t *testing.T) {
 }
 
 func TestAllocator_StaticPolicy_MissingHostPort(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-	alloc := NewAllocator(fakeClient)
+	alloc := newTestAllocator(t, nil)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -235,11 +263,7 @@ func TestAllocator_StaticPolicy_MissingHostPort(t *testing.T) {
 }
 
 func TestAllocator_IndexPolicy_ExceedsMaxPort(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-	alloc := NewAllocator(fakeClient)
+	alloc := newTestAllocator(t, nil)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -270,11 +294,7 @@ func TestAllocator_IndexPolicy_ExceedsMaxPort(t *testing.T) {
 }
 
 func TestAllocator_UnsupportedPolicy(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-	alloc := NewAllocator(fakeClient)
+	alloc := newTestAllocator(t, nil)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -304,9 +324,6 @@ func TestAllocator_UnsupportedPolicy(t *testing.T) {
 }
 
 func TestAllocator_ProtocolSeparation(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-
 	// Create a pod with TCP port already allocated
 	existingPod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -330,8 +347,7 @@ func TestAllocator_ProtocolSeparation(t *testing.T) {
 		},
 	}
 
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(existingPod).Build()
-	alloc := NewAllocator(fakeClient)
+	alloc := newTestAllocator(t, []client.Object{existingPod})
 
 	// Try to allocate UDP on the same port (should succeed - different protocol)
 	newPod := &corev1.Pod{
@@ -365,3 +381,2650 @@ func TestAllocator_ProtocolSeparation(t *testing.T) {
 		t.Errorf("Allocate() result[0].HostPort = %d, want 8080 (UDP should use containerPort)", result[0].HostPort)
 	}
 }
+
+func TestAllocator_RangeExhaustedGauge(t *testing.T) {
+	// Existing pod holds the only port in the range
+	existingPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "holder",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "exhaust-node",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "game",
+							ContainerPort: 8080,
+							HostPort:      7000,
+							Protocol:      corev1.ProtocolTCP,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{existingPod})
+	fakeClient := alloc.client
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "exhaust-node",
+		},
+	}
+
+	requests := []PortRequest{
+		{
+			Name:          "game",
+			ContainerPort: 8080,
+			Protocol:      corev1.ProtocolTCP,
+			Policy:        PolicyDynamic,
+		},
+	}
+
+	ctx := context.Background()
+	gauge := metrics.PortRangeExhausted.WithLabelValues("exhaust-node", "TCP")
+
+	if _, err := alloc.Allocate(ctx, pod, requests, 7000, 7000, 0, 10); err == nil {
+		t.Fatal("Allocate() expected exhaustion error, got nil")
+	}
+	if got := testutil.ToFloat64(gauge); got != 1 {
+		t.Errorf("PortRangeExhausted = %v after exhaustion, want 1", got)
+	}
+
+	// Free the port: the holder goes away and its cached port is released
+	if err := fakeClient.Delete(ctx, existingPod); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	alloc.Release("exhaust-node", corev1.ProtocolTCP, 7000)
+
+	if got := testutil.ToFloat64(gauge); got != 0 {
+		t.Errorf("PortRangeExhausted = %v after release, want 0", got)
+	}
+
+	result, err := alloc.Allocate(ctx, pod, requests, 7000, 7000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7000 {
+		t.Errorf("Allocate() result[0].HostPort = %d, want 7000", result[0].HostPort)
+	}
+	if got := testutil.ToFloat64(gauge); got != 0 {
+		t.Errorf("PortRangeExhausted = %v after successful allocation, want 0", got)
+	}
+}
+
+func TestAllocator_ReadyzCheck(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	failList := true
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithInterceptorFuncs(interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			if failList {
+				return errors.New("apiserver unavailable")
+			}
+			return c.List(ctx, list, opts...)
+		},
+	}).Build()
+	alloc := NewAllocator(fakeClient)
+
+	if err := alloc.ReadyzCheck(nil); err == nil {
+		t.Error("ReadyzCheck() expected error before warmup, got nil")
+	}
+
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err == nil {
+		t.Fatal("Warmup() expected error while List fails, got nil")
+	}
+	if err := alloc.ReadyzCheck(nil); err == nil {
+		t.Error("ReadyzCheck() expected error after failed warmup, got nil")
+	}
+
+	failList = false
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	if err := alloc.ReadyzCheck(nil); err != nil {
+		t.Errorf("ReadyzCheck() error = %v after warmup, want nil", err)
+	}
+}
+
+func TestAllocator_PassthroughPolicy_PerProtocolConflict(t *testing.T) {
+	// Another pod holds 443/TCP only
+	existingPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "existing-pod",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "https",
+							ContainerPort: 443,
+							HostPort:      443,
+							Protocol:      corev1.ProtocolTCP,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{existingPod})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "quic-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+
+	ctx := context.Background()
+
+	// UDP alone doesn't conflict with the TCP holder
+	udpOnly := []PortRequest{
+		{Name: "quic", ContainerPort: 443, Protocol: corev1.ProtocolUDP, Policy: PolicyPassthrough},
+	}
+	if _, err := alloc.Allocate(ctx, pod, udpOnly, 7000, 8000, 0, 10); err != nil {
+		t.Fatalf("Allocate() UDP only error = %v", err)
+	}
+
+	// Declaring both protocols conflicts on TCP only, and the error says so
+	both := []PortRequest{
+		{Name: "quic", ContainerPort: 443, Protocol: corev1.ProtocolUDP, Policy: PolicyPassthrough},
+		{Name: "https", ContainerPort: 443, Protocol: corev1.ProtocolTCP, Policy: PolicyPassthrough},
+	}
+	_, err := alloc.Allocate(ctx, pod, both, 7000, 8000, 0, 10)
+	if err == nil {
+		t.Fatal("Allocate() expected TCP conflict error, got nil")
+	}
+
+	want := `port 443/TCP for "https" is already in use on node node-1 by pod default/existing-pod`
+	if err.Error() != want {
+		t.Errorf("Allocate() error = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestAllocator_SystemPortBand(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		policy    PortPolicy
+		wantErr   bool
+	}{
+		{"privileged namespace static", "kube-system", PolicyStatic, false},
+		{"privileged namespace passthrough", "kube-system", PolicyPassthrough, false},
+		{"non-privileged namespace static", "default", PolicyStatic, true},
+		{"non-privileged namespace passthrough", "default", PolicyPassthrough, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := newTestAllocator(t, nil, WithSystemPortBand(1023, "kube-system"))
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "dns-0",
+					Namespace: tt.namespace,
+				},
+				Spec: corev1.PodSpec{
+					NodeName: "node-1",
+				},
+			}
+
+			requests := []PortRequest{
+				{
+					Name:          "dns",
+					ContainerPort: 53,
+					HostPort:      53,
+					Protocol:      corev1.ProtocolUDP,
+					Policy:        tt.policy,
+				},
+			}
+
+			ctx := context.Background()
+			result, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Allocate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && result[0].HostPort != 53 {
+				t.Errorf("Allocate() result[0].HostPort = %d, want 53", result[0].HostPort)
+			}
+		})
+	}
+}
+
+func TestAllocator_Reserve(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
+	alloc.Reserve("node-1", corev1.ProtocolTCP, 7000, 7001)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+
+	requests := []PortRequest{
+		{
+			Name:          "game",
+			ContainerPort: 8080,
+			Protocol:      corev1.ProtocolTCP,
+			Policy:        PolicyDynamic,
+		},
+	}
+
+	ctx := context.Background()
+	result, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7002 {
+		t.Errorf("Allocate() result[0].HostPort = %d, want 7002 (7000-7001 reserved)", result[0].HostPort)
+	}
+
+	// Reservations survive node re-sync and also block explicit requests
+	static := []PortRequest{
+		{
+			Name:          "game",
+			ContainerPort: 8080,
+			HostPort:      7001,
+			Protocol:      corev1.ProtocolTCP,
+			Policy:        PolicyStatic,
+		},
+	}
+	if _, err := alloc.Allocate(ctx, pod, static, 7000, 8000, 0, 10); err == nil {
+		t.Error("Allocate() expected error for reserved Static port, got nil")
+	}
+
+	alloc.Unreserve("node-1", corev1.ProtocolTCP, 7000, 7001)
+	result, err = alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7000 {
+		t.Errorf("Allocate() result[0].HostPort = %d, want 7000 after unreserve", result[0].HostPort)
+	}
+}
+
+func TestAllocator_HashedScanStart_Idempotent(t *testing.T) {
+	alloc := newTestAllocator(t, nil, WithHashedScanStart())
+	fakeClient := alloc.client
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+
+	requests := []PortRequest{
+		{
+			Name:          "game",
+			ContainerPort: 8080,
+			Protocol:      corev1.ProtocolTCP,
+			Policy:        PolicyDynamic,
+		},
+	}
+
+	ctx := context.Background()
+	first, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+
+	// Another pod is persisted between the two admissions, taking the lowest port
+	other := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "game",
+							ContainerPort: 8080,
+							HostPort:      7000,
+						},
+					},
+				},
+			},
+		},
+	}
+	if first[0].HostPort == 7000 {
+		other.Spec.Containers[0].Ports[0].HostPort = 7001
+	}
+	if err := fakeClient.Create(ctx, other); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	second, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if first[0].HostPort != second[0].HostPort {
+		t.Errorf("Allocate() returned %d then %d, want identical ports", first[0].HostPort, second[0].HostPort)
+	}
+}
+
+// histogramCount returns the number of observations in a histogram series
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestAllocator_DurationStickyLabel(t *testing.T) {
+	// Previous incarnation of app-0 recorded port 7005 for "game"
+	oldPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"hostport.io/allocated-game": "7005",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "sticky-node",
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{oldPod})
+
+	stickySeries := metrics.PortAllocationDurationSeconds.WithLabelValues(string(PolicyDynamic), "true")
+	freshSeries := metrics.PortAllocationDurationSeconds.WithLabelValues(string(PolicyDynamic), "false")
+	stickyBefore := histogramCount(t, stickySeries)
+	freshBefore := histogramCount(t, freshSeries)
+
+	ctx := context.Background()
+
+	// Sticky reuse
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "sticky-node",
+		},
+	}
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7005 {
+		t.Fatalf("Allocate() result[0].HostPort = %d, want sticky 7005", result[0].HostPort)
+	}
+
+	// Fresh scan
+	pod.Name = "app-1"
+	if _, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10); err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+
+	if got := histogramCount(t, stickySeries) - stickyBefore; got != 1 {
+		t.Errorf("sticky=true observations = %d, want 1", got)
+	}
+	if got := histogramCount(t, freshSeries) - freshBefore; got != 1 {
+		t.Errorf("sticky=false observations = %d, want 1", got)
+	}
+}
+
+func TestAllocator_NeverAllocate(t *testing.T) {
+	neverAllocate, err := ParsePorts("22,6443,7000-7001")
+	if err != nil {
+		t.Fatalf("ParsePorts() error = %v", err)
+	}
+
+	alloc := newTestAllocator(t, nil, WithNeverAllocate(neverAllocate...))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+
+	ctx := context.Background()
+
+	// Dynamic skips floored ports even though the range includes them
+	dynamic := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(ctx, pod, dynamic, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7002 {
+		t.Errorf("Allocate() result[0].HostPort = %d, want 7002", result[0].HostPort)
+	}
+
+	// Static on a floored port is denied with a clear message
+	static := []PortRequest{
+		{Name: "api", ContainerPort: 6443, HostPort: 6443, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic},
+	}
+	_, err = alloc.Allocate(ctx, pod, static, 7000, 8000, 0, 10)
+	if err == nil {
+		t.Fatal("Allocate() expected error for never-allocate Static port, got nil")
+	}
+	if want := "port 6443 is in the operator's never-allocate set"; err.Error() != want {
+		t.Errorf("Allocate() error = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    []int32
+		wantErr bool
+	}{
+		{"22", []int32{22}, false},
+		{"22, 6443", []int32{22, 6443}, false},
+		{"7010-7012,22", []int32{7010, 7011, 7012, 22}, false},
+		{"", nil, false},
+		{"abc", nil, true},
+		{"7015-7010", nil, true},
+		{"0", nil, true},
+		{"70000", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.val, func(t *testing.T) {
+			got, err := ParsePorts(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePorts(%q) error = %v, wantErr %v", tt.val, err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParsePorts(%q) = %v, want %v", tt.val, got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("ParsePorts(%q)[%d] = %d, want %d", tt.val, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAllocator_ConflictMetricPolicyLabel(t *testing.T) {
+	existingPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "existing-pod",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "conflict-node",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "http",
+							ContainerPort: 8080,
+							HostPort:      30000,
+							Protocol:      corev1.ProtocolTCP,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{existingPod})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "conflict-node",
+		},
+	}
+
+	requests := []PortRequest{
+		{Name: "http", ContainerPort: 8080, HostPort: 30000, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic},
+	}
+
+	static := metrics.PortConflictsTotal.WithLabelValues("conflict-node", "TCP", string(PolicyStatic))
+	dynamic := metrics.PortConflictsTotal.WithLabelValues("conflict-node", "TCP", string(PolicyDynamic))
+	staticBefore := testutil.ToFloat64(static)
+	dynamicBefore := testutil.ToFloat64(dynamic)
+
+	if _, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 0, 10); err == nil {
+		t.Fatal("Allocate() expected conflict error, got nil")
+	}
+
+	if got := testutil.ToFloat64(static) - staticBefore; got != 1 {
+		t.Errorf("PortConflictsTotal{policy=Static} increased by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(dynamic) - dynamicBefore; got != 0 {
+		t.Errorf("PortConflictsTotal{policy=Dynamic} increased by %v, want 0", got)
+	}
+}
+
+func TestAllocator_RangeWidening(t *testing.T) {
+	// The only port in [7000, 7000] is taken
+	existingPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "holder",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "widen-node",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 8080, HostPort: 7000},
+					},
+				},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{existingPod}, WithRangeWidening(10, 7100))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "widen-node",
+		},
+	}
+
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+
+	widenings := metrics.PortRangeWideningsTotal.WithLabelValues("widen-node", "TCP")
+	before := testutil.ToFloat64(widenings)
+
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7001 {
+		t.Errorf("Allocate() result[0].HostPort = %d, want 7001 from the widened range", result[0].HostPort)
+	}
+	if got := testutil.ToFloat64(widenings) - before; got != 1 {
+		t.Errorf("PortRangeWideningsTotal increased by %v, want 1", got)
+	}
+}
+
+func TestAllocator_NamespaceCapPendingPool(t *testing.T) {
+	// One port held on node-1, which the pending pool mirrors
+	existing := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "team-a"},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7000, HostPort: 7000}}}},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{existing}, WithNamespaceCap(2))
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	pending := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "team-a"}}
+	if _, err := alloc.Allocate(ctx, pending, requests, 7000, 8000, 0, 10); err != nil {
+		t.Fatalf("Allocate(app-1) while pending error = %v, want nil: app-0 holds 1 port, counted once", err)
+	}
+	third := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-2", Namespace: "team-a"}, Spec: corev1.PodSpec{NodeName: "node-2"}}
+	if _, err := alloc.Allocate(ctx, third, requests, 7000, 8000, 0, 10); !errors.Is(err, ErrNamespaceCap) {
+		t.Errorf("Allocate(app-2) error = %v, want ErrNamespaceCap", err)
+	}
+}
+
+func TestAllocator_RangeWideningExcludedIncrement(t *testing.T) {
+	// The only port in [7000, 7000] is taken and the pod excludes the whole
+	// first widening increment
+	existingPod := podWithPorts("holder", "widen-node", corev1.ContainerPort{Name: "game", ContainerPort: 8080, HostPort: 7000})
+	alloc := newTestAllocator(t, []client.Object{existingPod}, WithRangeWidening(10, 7100), WithGallopingScan())
+
+	pod := podWithPorts("app-0", "widen-node")
+	var excluded []int32
+	for p := int32(7001); p <= 7010; p++ {
+		excluded = append(excluded, p)
+	}
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic, ExcludePorts: excluded},
+	}
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7011 {
+		t.Errorf("Allocate() result[0].HostPort = %d, want 7011 from the second increment", result[0].HostPort)
+	}
+
+	// Nothing to scan is exhaustion, not a panic
+	if _, err := alloc.findFreePort("widen-node", corev1.ProtocolTCP, nil, 0); !errors.Is(err, ErrRangeExhausted) {
+		t.Errorf("findFreePort() over no ranges error = %v, want ErrRangeExhausted", err)
+	}
+}
+
+func TestAllocator_PairProtocols(t *testing.T) {
+	// TCP space is busy at 7000-7001, UDP only at 7000
+	existingPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "existing-pod",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "a", ContainerPort: 1, HostPort: 7000, Protocol: corev1.ProtocolTCP},
+						{Name: "b", ContainerPort: 2, HostPort: 7001, Protocol: corev1.ProtocolTCP},
+						{Name: "c", ContainerPort: 3, HostPort: 7000, Protocol: corev1.ProtocolUDP},
+					},
+				},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{existingPod})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "game-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+
+	// UDP is preferred: its free space drives the scan
+	requests := []PortRequest{
+		{
+			Name:          "game",
+			ContainerPort: 7777,
+			Protocol:      corev1.ProtocolTCP,
+			Policy:        PolicyDynamic,
+			PairProtocols: []corev1.Protocol{corev1.ProtocolUDP, corev1.ProtocolTCP},
+		},
+	}
+
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7002 {
+		t.Errorf("Allocate() result[0].HostPort = %d, want 7002 (first port free in UDP then TCP)", result[0].HostPort)
+	}
+
+	snapshot := alloc.Snapshot()
+	for _, key := range []string{"node-1/TCP", "node-1/UDP"} {
+		held := false
+		for _, p := range snapshot[key] {
+			if p == result[0].HostPort {
+				held = true
+			}
+		}
+		if !held {
+			t.Errorf("%s ports = %v, want %d held", key, snapshot[key], result[0].HostPort)
+		}
+	}
+}
+
+func TestIndexPort(t *testing.T) {
+	tests := []struct {
+		name                            string
+		minPort, index, stride, portIdx int32
+		want                            int32
+		wantErr                         bool
+	}{
+		{"pod-0 single port", 7000, 0, 10, 0, 7000, false},
+		{"pod-1 single port", 7000, 1, 10, 0, 7010, false},
+		{"pod-0 third port", 7000, 0, 100, 2, 7002, false},
+		{"pod-1 third port (stride 100)", 7000, 1, 100, 2, 7102, false},
+		{"past 65535", 60000, 1000, 10, 0, 0, true},
+		{"int32 overflow", 7000, 1 << 30, 1 << 30, 0, 0, true},
+		{"negative index", 7000, -1, 10, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := IndexPort(tt.minPort, tt.index, tt.stride, tt.portIdx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IndexPort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("IndexPort() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocator_StaticPolicy_IntraPodDuplicate(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+
+	// Two containers both hardcode hostPort 30000
+	requests := []PortRequest{
+		{Name: "app", ContainerPort: 8080, HostPort: 30000, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic},
+		{Name: "sidecar", ContainerPort: 9090, HostPort: 30000, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic},
+	}
+
+	_, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 0, 10)
+	if err == nil {
+		t.Fatal("Allocate() expected intra-pod duplicate error, got nil")
+	}
+
+	want := `port 30000/TCP is requested by both "app" and "sidecar" in the same pod`
+	if err.Error() != want {
+		t.Errorf("Allocate() error = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestAllocator_EphemeralRangeExclusion(t *testing.T) {
+	// node-custom narrows its ephemeral range via the sysctl annotation
+	customNode := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node-custom",
+			Annotations: map[string]string{AnnotationNodeEphemeralRange: "32768 32799"},
+		},
+	}
+
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+
+	tests := []struct {
+		name     string
+		nodeName string
+		opts     []Option
+		want     int32
+	}{
+		{"default range skipped", "node-1", nil, 61000},
+		{"node annotation range skipped", "node-custom", nil, 32800},
+		{"exclusion disabled", "node-1", []Option{WithoutEphemeralExclusion()}, 32768},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := newTestAllocator(t, []client.Object{customNode}, tt.opts...)
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "default"},
+				Spec:       corev1.PodSpec{NodeName: tt.nodeName},
+			}
+
+			result, err := alloc.Allocate(context.Background(), pod, requests, 32768, 61010, 0, 10)
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			if result[0].HostPort != tt.want {
+				t.Errorf("Allocate() result[0].HostPort = %d, want %d", result[0].HostPort, tt.want)
+			}
+		})
+	}
+
+	t.Run("range inside ephemeral range", func(t *testing.T) {
+		alloc := newTestAllocator(t, nil)
+		pod := podWithPorts("app-0", "node-1")
+		_, err := alloc.Allocate(context.Background(), pod, requests, 40000, 40010, 0, 10)
+		if !errors.Is(err, ErrRangeExhausted) {
+			t.Errorf("Allocate() error = %v, want ErrRangeExhausted", err)
+		}
+	})
+}
+
+func TestAllocator_ExcludePorts(t *testing.T) {
+	// 7003 is excluded globally, 7000-7002 and 7004 by the pod
+	alloc := newTestAllocator(t, nil, WithNeverAllocate(7003))
+
+	pod := podWithPorts("app-0", "node-1")
+	exclude := []int32{7000, 7001, 7002, 7004}
+
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic, ExcludePorts: exclude},
+		{Name: "query", ContainerPort: 8081, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic, ExcludePorts: exclude},
+	}
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7005 || result[1].HostPort != 7006 {
+		t.Errorf("Allocate() ports = %d, %d, want 7005, 7006", result[0].HostPort, result[1].HostPort)
+	}
+
+	// An explicit request for an excluded port is denied
+	static := []PortRequest{
+		{Name: "admin", ContainerPort: 9000, HostPort: 7002, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic, ExcludePorts: exclude},
+	}
+	if _, err := alloc.Allocate(context.Background(), pod, static, 7000, 7010, 0, 10); err == nil {
+		t.Error("Allocate() expected error for a Static port in the exclusion set, got nil")
+	}
+}
+
+func TestAllocator_RecoverOwnAllocations(t *testing.T) {
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+
+	tests := []struct {
+		name string
+		meta string
+		want int32
+	}{
+		{"matching metadata", `{"policy":"Dynamic","minPort":7000,"maxPort":7010,"index":0}`, 7005},
+		{"different range", `{"policy":"Dynamic","minPort":7000,"maxPort":7999,"index":0}`, 7000},
+		{"different policy", `{"policy":"Index","minPort":7000,"maxPort":7010,"index":0}`, 7000},
+		{"malformed metadata", `policy=Dynamic`, 7000},
+		{"no metadata", "", 7000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A fresh allocator with an empty cache and no previous pod of the same name
+			alloc := newTestAllocator(t, nil)
+
+			annotations := map[string]string{"hostport.io/allocated-game": "7005"}
+			if tt.meta != "" {
+				annotations[AnnotationAllocationMeta] = tt.meta
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "default", Annotations: annotations},
+				Spec:       corev1.PodSpec{NodeName: "node-1"},
+			}
+
+			result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			if result[0].HostPort != tt.want {
+				t.Errorf("Allocate() result[0].HostPort = %d, want %d", result[0].HostPort, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocator_StickyPerProtocol(t *testing.T) {
+	// Previous incarnation of app-0: "game" on both protocols with qualified
+	// keys, "rtp" with a key written before qualification
+	oldPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"hostport.io/allocated-game":     "7003",
+				"hostport.io/allocated-game-udp": "7005",
+				"hostport.io/allocated-rtp":      "7007",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{oldPod})
+
+	pod := podWithPorts("app-0", "node-1")
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+		{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolUDP, Policy: PolicyDynamic},
+		{Name: "rtp", ContainerPort: 5004, Protocol: corev1.ProtocolUDP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+
+	want := []int32{7003, 7005, 7007}
+	for i, w := range want {
+		if result[i].HostPort != w {
+			t.Errorf("Allocate() result[%d] (%s/%s) = %d, want %d", i, result[i].Name, result[i].Protocol, result[i].HostPort, w)
+		}
+	}
+}
+
+func TestAllocator_StickyPortNotFree(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		setup func(alloc *Allocator)
+	}{
+		{name: "reserved", setup: func(alloc *Allocator) { alloc.Reserve("node-1", corev1.ProtocolTCP, 7003) }},
+		{name: "never allocated", opts: []Option{WithNeverAllocate(7003)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Previous incarnation of app-0 got 7003
+			oldPod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app-0",
+					Namespace:   "default",
+					Annotations: map[string]string{"hostport.io/allocated-game": "7003"},
+				},
+				Spec: corev1.PodSpec{NodeName: "node-1"},
+			}
+
+			alloc := newTestAllocator(t, []client.Object{oldPod}, tt.opts...)
+			if tt.setup != nil {
+				tt.setup(alloc)
+			}
+
+			pod := podWithPorts("app-0", "node-1")
+			requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+			result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+			if err != nil {
+				t.Fatalf("Allocate() error = %v, want a fresh port instead of the unavailable sticky one", err)
+			}
+			if result[0].HostPort != 7000 {
+				t.Errorf("Allocate() HostPort = %d, want 7000", result[0].HostPort)
+			}
+		})
+	}
+}
+
+func TestAllocationKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol corev1.Protocol
+		want     string
+	}{
+		{"game", corev1.ProtocolTCP, "game"},
+		{"game", "", "game"},
+		{"game", corev1.ProtocolUDP, "game-udp"},
+		{"game", corev1.ProtocolSCTP, "game-sctp"},
+	}
+	for _, tt := range tests {
+		if got := AllocationKey(tt.name, tt.protocol); got != tt.want {
+			t.Errorf("AllocationKey(%q, %q) = %q, want %q", tt.name, tt.protocol, got, tt.want)
+		}
+	}
+}
+
+func FuzzAllocateIndex(f *testing.F) {
+	// min, max, index, stride, port count
+	f.Add(int32(7000), int32(8000), int32(0), int32(10), uint8(1))
+	f.Add(int32(7000), int32(7019), int32(1), int32(10), uint8(10)) // last port lands exactly on maxPort
+	f.Add(int32(7000), int32(7019), int32(1), int32(10), uint8(11)) // one past maxPort
+	f.Add(int32(7000), int32(65535), int32(1<<30), int32(1<<30), uint8(1))
+	f.Add(int32(65535), int32(65535), int32(0), int32(0), uint8(1))
+	f.Add(int32(-5), int32(100), int32(0), int32(1), uint8(1))
+	f.Add(int32(8000), int32(7000), int32(0), int32(10), uint8(1))
+
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	alloc := NewAllocator(fake.NewClientBuilder().WithScheme(scheme).Build())
+
+	f.Fuzz(func(t *testing.T, minPort, maxPort, index, stride int32, count uint8) {
+		count = count%16 + 1
+		pod := podWithPorts("app-0", "fuzz-node")
+		requests := make([]PortRequest, count)
+		for i := range requests {
+			requests[i] = PortRequest{Name: fmt.Sprintf("p%d", i), ContainerPort: 8080 + int32(i), Protocol: corev1.ProtocolTCP, Policy: PolicyIndex}
+		}
+
+		result, err := alloc.Allocate(context.Background(), pod, requests, minPort, maxPort, index, stride)
+
+		// Computed in int64 so the expectation itself can't overflow
+		base := int64(minPort) + int64(index)*int64(stride)
+		last := base + int64(count) - 1
+		fits := index >= 0 && stride >= 0 && base >= 1 && last <= int64(maxPort) && last <= 65535
+		if err != nil {
+			if fits {
+				t.Fatalf("Allocate(min=%d, max=%d, index=%d, stride=%d, count=%d) error = %v, want ports %d-%d",
+					minPort, maxPort, index, stride, count, err, base, last)
+			}
+			return
+		}
+		if !fits {
+			t.Fatalf("Allocate(min=%d, max=%d, index=%d, stride=%d, count=%d) = %v, want error",
+				minPort, maxPort, index, stride, count, result)
+		}
+		for i, r := range result {
+			if r.HostPort < minPort || r.HostPort > maxPort || int64(r.HostPort) != base+int64(i) {
+				t.Fatalf("result[%d].HostPort = %d, want %d within [%d, %d]", i, r.HostPort, base+int64(i), minPort, maxPort)
+			}
+		}
+	})
+}
+
+func TestAllocator_PresetHostPortTracked(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
+
+	// The chart sets hostPort == containerPort on "metrics" by hand
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "metrics", ContainerPort: 7000, HostPort: 7000},
+						{Name: "game", ContainerPort: 8080},
+					},
+				},
+			},
+		},
+	}
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7001 {
+		t.Errorf("Allocate() result[0].HostPort = %d, want 7001 past the preset 7000", result[0].HostPort)
+	}
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 2 || got[0] != 7000 || got[1] != 7001 {
+		t.Errorf("node-1/TCP ports = %v, want [7000 7001]", got)
+	}
+}
+
+func TestAllocator_NodeReservedPorts(t *testing.T) {
+	// A DaemonSet on node-1 holds 7000, 7001 and 7003
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node-1",
+			Annotations: map[string]string{AnnotationNodeReserved: "7000,7001,7003"},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{node})
+
+	pod := podWithPorts("app-0", "node-1")
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+		{Name: "query", ContainerPort: 8081, Protocol: corev1.ProtocolUDP, Policy: PolicyDynamic},
+		{Name: "voice", ContainerPort: 8082, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	want := []int32{7002, 7002, 7004}
+	for i, w := range want {
+		if result[i].HostPort != w {
+			t.Errorf("Allocate() result[%d].HostPort = %d, want %d", i, result[i].HostPort, w)
+		}
+	}
+
+	// Explicit requests for a node-reserved port are denied
+	index := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyIndex},
+	}
+	if _, err := alloc.Allocate(context.Background(), pod, index, 7000, 7010, 0, 10); err == nil {
+		t.Error("Allocate() expected error for an Index port reserved by the node, got nil")
+	}
+
+	// Other nodes are unaffected
+	other := podWithPorts("app-1", "node-2")
+	result, err = alloc.Allocate(context.Background(), other, requests[:1], 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7000 {
+		t.Errorf("Allocate() on node-2 = %d, want 7000", result[0].HostPort)
+	}
+}
+
+func TestAllocator_FreePorts(t *testing.T) {
+	existingPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "a", ContainerPort: 7000, HostPort: 7000},
+						{Name: "b", ContainerPort: 7002, HostPort: 7002},
+					},
+				},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{existingPod}, WithNeverAllocate(7003))
+	if err := alloc.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	alloc.Reserve("node-1", corev1.ProtocolTCP, 7005)
+
+	got := alloc.FreePorts("node-1", corev1.ProtocolTCP, 3, PortRange{Min: 7000, Max: 7010})
+	want := []int32{7001, 7004, 7006}
+	if !slices.Equal(got, want) {
+		t.Errorf("FreePorts() = %v, want %v", got, want)
+	}
+
+	// Asking again returns the same ports: nothing was marked
+	if again := alloc.FreePorts("node-1", corev1.ProtocolTCP, 3, PortRange{Min: 7000, Max: 7010}); !slices.Equal(again, want) {
+		t.Errorf("second FreePorts() = %v, want %v", again, want)
+	}
+	if used := alloc.Snapshot()["node-1/TCP"]; !slices.Equal(used, []int32{7000, 7002}) {
+		t.Errorf("node-1/TCP ports = %v, want [7000 7002]", used)
+	}
+
+	// Fewer than n free ports in range
+	if got := alloc.FreePorts("node-1", corev1.ProtocolTCP, 5, PortRange{Min: 7000, Max: 7002}); !slices.Equal(got, []int32{7001}) {
+		t.Errorf("FreePorts() in a nearly full range = %v, want [7001]", got)
+	}
+	// Other protocols are independent
+	if got := alloc.FreePorts("node-1", corev1.ProtocolUDP, 2, PortRange{Min: 7000, Max: 7010}); !slices.Equal(got, []int32{7000, 7001}) {
+		t.Errorf("FreePorts(UDP) = %v, want [7000 7001]", got)
+	}
+}
+
+func TestAllocator_TerminalPodsFree(t *testing.T) {
+	// A completed Job pod still declares hostPort 7000
+	jobPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "job-abc", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName:      "node-1",
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "work", ContainerPort: 7000, HostPort: 7000}}},
+			},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want int32
+	}{
+		{"reused by default", nil, 7000},
+		{"reused with the deprecated option", []Option{WithTerminalPodsFree()}, 7000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := newTestAllocator(t, []client.Object{jobPod}, tt.opts...)
+
+			pod := podWithPorts("app-0", "node-1")
+			requests := []PortRequest{
+				{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+			}
+			result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			if result[0].HostPort != tt.want {
+				t.Errorf("Allocate() result[0].HostPort = %d, want %d", result[0].HostPort, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocator_ReserveAnyProtocol(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
+	alloc.Reserve("node-1", ProtocolAny, 7000)
+
+	pod := podWithPorts("app-0", "node-1")
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+		{Name: "voice", ContainerPort: 8081, Protocol: corev1.ProtocolUDP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	for i := range requests {
+		if result[i].HostPort != 7001 {
+			t.Errorf("Allocate() result[%d] (%s) = %d, want 7001", i, result[i].Protocol, result[i].HostPort)
+		}
+	}
+
+	// Explicit requests are denied for every protocol
+	static := []PortRequest{
+		{Name: "sctp", ContainerPort: 9000, HostPort: 7000, Protocol: corev1.ProtocolSCTP, Policy: PolicyStatic},
+	}
+	if _, err := alloc.Allocate(context.Background(), pod, static, 7000, 7010, 0, 10); err == nil {
+		t.Error("Allocate() expected error for a Static port held for any protocol, got nil")
+	}
+
+	alloc.Unreserve("node-1", ProtocolAny, 7000)
+	result, err = alloc.Allocate(context.Background(), pod, requests[1:], 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() after Unreserve error = %v", err)
+	}
+	if result[0].HostPort != 7000 {
+		t.Errorf("Allocate() after Unreserve = %d, want 7000", result[0].HostPort)
+	}
+}
+
+func TestAllocator_SyncDropsPhantomPorts(t *testing.T) {
+	gone := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "gone", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7000, HostPort: 7000}}},
+			},
+		},
+	}
+	// Another namespace on the same node still counts
+	neighbour := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "neighbour", Namespace: "other"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7001, HostPort: 7001}}},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{gone, neighbour})
+	fakeClient := alloc.client
+
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	// The pod disappears without the cache hearing about it
+	if err := fakeClient.Delete(ctx, gone); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if got := alloc.Snapshot()["node-1/TCP"]; !slices.Equal(got, []int32{7000, 7001}) {
+		t.Fatalf("node-1/TCP ports before sync = %v, want [7000 7001]", got)
+	}
+
+	pod := podWithPorts("app-0", "node-1")
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+		{Name: "query", ContainerPort: 8081, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(ctx, pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7000 || result[1].HostPort != 7002 {
+		t.Errorf("Allocate() ports = %d, %d, want phantom 7000 reused and 7001 skipped", result[0].HostPort, result[1].HostPort)
+	}
+}
+
+func TestAllocator_SyncKeepsPhantomPorts(t *testing.T) {
+	gone := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "gone", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7000, HostPort: 7000}}},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{gone}, WithPhantomResolution(PhantomKeep))
+	fakeClient := alloc.client
+
+	ctx := context.Background()
+	if err := alloc.Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	if err := fakeClient.Delete(ctx, gone); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	requests := []PortRequest{{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	allocate := func(name string) int32 {
+		t.Helper()
+		pod := podWithPorts(name, "node-1")
+		result, err := alloc.Allocate(ctx, pod, requests, 7000, 7010, 0, 10)
+		if err != nil {
+			t.Fatalf("Allocate(%s) error = %v", name, err)
+		}
+		pod.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{
+			{Name: "game", ContainerPort: result[0].HostPort, HostPort: result[0].HostPort},
+		}}}
+		if err := fakeClient.Create(ctx, pod); err != nil {
+			t.Fatalf("Create(%s) error = %v", name, err)
+		}
+		return result[0].HostPort
+	}
+
+	// The cache wins over the List: the deleted pod's port stays held
+	if got := allocate("app-0"); got != 7001 {
+		t.Errorf("Allocate() with a phantom = %d, want 7001", got)
+	}
+
+	// Until the orphan sweep releases it
+	if n, err := alloc.ReleaseOrphans(ctx, 0); err != nil || n != 1 {
+		t.Fatalf("ReleaseOrphans() = %d, %v, want 1, nil", n, err)
+	}
+	if got := allocate("app-1"); got != 7000 {
+		t.Errorf("Allocate() after ReleaseOrphans = %d, want 7000", got)
+	}
+}
+
+func TestAllocator_StickyRecoveryFailureMetric(t *testing.T) {
+	// Previous incarnation of app-0 recorded port 7005, now held by another pod
+	oldPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"hostport.io/allocated-game": "7005",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "churn-node",
+		},
+	}
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "holder",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "churn-node",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7005, HostPort: 7005}}},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{oldPod, holder})
+
+	failures := metrics.StickyRecoveryFailuresTotal.WithLabelValues("churn-node", "TCP")
+	before := testutil.ToFloat64(failures)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "churn-node",
+		},
+	}
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort == 7005 {
+		t.Fatalf("Allocate() reused 7005 although it is held by another pod")
+	}
+	if got := testutil.ToFloat64(failures) - before; got != 1 {
+		t.Errorf("StickyRecoveryFailuresTotal increased by %v, want 1", got)
+	}
+}
+
+func TestAllocator_IndexProtocolBands(t *testing.T) {
+	pod := podWithPorts("app-1", "node-1")
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyIndex},
+		{Name: "voice", ContainerPort: 7778, Protocol: corev1.ProtocolUDP, Policy: PolicyIndex},
+		{Name: "admin", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: PolicyIndex},
+		{Name: "query", ContainerPort: 27015, Protocol: corev1.ProtocolUDP, Policy: PolicyIndex},
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want []int32
+	}{
+		{name: "shared block", want: []int32{7010, 7011, 7012, 7013}},
+		{name: "protocol bands", opts: []Option{WithIndexProtocolBands()}, want: []int32{7010, 7015, 7011, 7016}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := newTestAllocator(t, nil, tt.opts...)
+			result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 1, 10)
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			for i, r := range result {
+				if r.HostPort != tt.want[i] {
+					t.Errorf("result[%d] (%s/%s) HostPort = %d, want %d", i, r.Name, r.Protocol, r.HostPort, tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("sub-band overflow", func(t *testing.T) {
+		alloc := newTestAllocator(t, nil, WithIndexProtocolBands())
+		if _, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 1, 2); err == nil {
+			t.Error("Allocate() error = nil, want an error for two TCP ports in a 1-port sub-band")
+		}
+	})
+}
+
+func TestAllocator_MaxPortInclusiveness(t *testing.T) {
+	// A 7000-7001 range with 7000 already held: only maxPort itself is left
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7000, HostPort: 7000}}},
+			},
+		},
+	}
+	pod := podWithPorts("app-100", "node-1")
+	index := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyIndex}}
+	dynamic := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		// 7000-8000 is 1001 ports: index 100 with stride 10 lands on 8000
+		{name: "inclusive by default"},
+		// 7000-8000 is 1000 ports: 8000 is past the range
+		{name: "exclusive", opts: []Option{WithExclusiveMaxPort()}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := newTestAllocator(t, []client.Object{holder}, tt.opts...)
+			ctx := context.Background()
+
+			result, err := alloc.Allocate(ctx, pod, index, 7000, 8000, 100, 10)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Index Allocate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && result[0].HostPort != 8000 {
+				t.Errorf("Index HostPort = %d, want 8000", result[0].HostPort)
+			}
+
+			result, err = alloc.Allocate(ctx, pod, dynamic, 7000, 7001, 0, 10)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dynamic Allocate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && result[0].HostPort != 7001 {
+				t.Errorf("Dynamic HostPort = %d, want 7001", result[0].HostPort)
+			}
+		})
+	}
+}
+
+func TestAllocator_IndexFallbackEffectivePolicy(t *testing.T) {
+	// Another pod squats on app-1's Index port 7010
+	squatter := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "squatter", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7010, HostPort: 7010}}},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{squatter}, WithIndexFallback())
+
+	pod := podWithPorts("app-1", "node-1")
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyIndex},
+		{Name: "query", ContainerPort: 27015, Protocol: corev1.ProtocolTCP, Policy: PolicyIndex},
+	}
+
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 1, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7000 || result[0].EffectivePolicy != PolicyDynamic {
+		t.Errorf("result[0] = port %d policy %s, want 7000 via Dynamic fallback", result[0].HostPort, result[0].EffectivePolicy)
+	}
+	if result[1].HostPort != 7011 || result[1].EffectivePolicy != PolicyIndex {
+		t.Errorf("result[1] = port %d policy %s, want 7011 via Index", result[1].HostPort, result[1].EffectivePolicy)
+	}
+	if result[0].Policy != PolicyIndex {
+		t.Errorf("result[0].Policy = %s, want the requested Index kept", result[0].Policy)
+	}
+}
+
+// TestAllocator_ConcurrentAllocate fires Allocate calls from many goroutines
+// across shared and separate nodes; run with -race. Each allocated pod is
+// created right after admission, as the API server would. Dynamic admissions
+// on one node are serialized per node here: the conflict map is rebuilt from
+// the List, so a Dynamic port is only held against other pods once its pod is
+// listed.
+func TestAllocator_ConcurrentAllocate(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
+	fakeClient := alloc.client
+
+	const nodes, podsPerNode = 4, 10
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	granted := make(map[string][]int32)
+	admit := func(pod *corev1.Pod, requests []PortRequest, index int32) {
+		result, err := alloc.Allocate(ctx, pod, requests, 7000, 7099, index, 10)
+		if err != nil {
+			t.Errorf("Allocate(%s) error = %v", pod.Name, err)
+			return
+		}
+		var ports []corev1.ContainerPort
+		for _, r := range result {
+			ports = append(ports, corev1.ContainerPort{Name: r.Name, ContainerPort: r.HostPort, HostPort: r.HostPort, Protocol: r.Protocol})
+		}
+		pod.Spec.Containers = []corev1.Container{{Name: "app", Ports: ports}}
+		if err := fakeClient.Create(ctx, pod); err != nil {
+			t.Errorf("Create(%s) error = %v", pod.Name, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, r := range result {
+			granted[pod.Spec.NodeName] = append(granted[pod.Spec.NodeName], r.HostPort)
+		}
+	}
+	newPod := func(name, node string) *corev1.Pod {
+		return podWithPorts(name, node)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < nodes; n++ {
+		node := fmt.Sprintf("node-%d", n)
+
+		// Dynamic pods of a node, in the range below the Index blocks
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < podsPerNode; i++ {
+				requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic,
+					Ranges: []PortRange{{Min: 6000, Max: 6999}}}}
+				admit(newPod(fmt.Sprintf("dyn-%s-%d", node, i), node), requests, 0)
+			}
+		}()
+
+		// Index pods of the same node, each admitted concurrently
+		for i := 0; i < podsPerNode; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				requests := []PortRequest{
+					{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyIndex},
+					{Name: "query", ContainerPort: 27015, Protocol: corev1.ProtocolUDP, Policy: PolicyIndex},
+				}
+				admit(newPod(fmt.Sprintf("idx-%s-%d", node, i), node), requests, int32(i))
+			}(i)
+		}
+	}
+
+	// Readers of the cache race with the writers
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				alloc.Snapshot()
+				alloc.FreePorts("node-0", corev1.ProtocolTCP, 5)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for node, ports := range granted {
+		if len(ports) != podsPerNode*3 {
+			t.Errorf("%s: %d ports granted, want %d", node, len(ports), podsPerNode*3)
+		}
+		// TCP and UDP Index ports of a pod differ by their port index, so any
+		// repeated number on a node is a duplicate
+		slices.Sort(ports)
+		if dup := slices.Compact(slices.Clone(ports)); len(dup) != len(ports) {
+			t.Errorf("%s: duplicate ports granted: %v", node, ports)
+		}
+	}
+}
+
+func TestAllocator_DrainNode(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
+	ctx := context.Background()
+
+	pod := podWithPorts("app-0", "node-1")
+	dynamic := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	static := []PortRequest{{Name: "metrics", ContainerPort: 9090, HostPort: 9090, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic}}
+
+	alloc.DrainNode("node-1")
+
+	_, err := alloc.Allocate(ctx, pod, dynamic, 7000, 8000, 0, 10)
+	if err == nil || !strings.Contains(err.Error(), "drained") {
+		t.Fatalf("Allocate() on a drained node error = %v, want a drained error", err)
+	}
+	if _, err := alloc.Allocate(ctx, pod, static, 7000, 8000, 0, 10); err != nil {
+		t.Errorf("Allocate() Static on a drained node error = %v, want nil", err)
+	}
+
+	// Other nodes are unaffected
+	other := pod.DeepCopy()
+	other.Spec.NodeName = "node-2"
+	if _, err := alloc.Allocate(ctx, other, dynamic, 7000, 8000, 0, 10); err != nil {
+		t.Errorf("Allocate() on node-2 error = %v, want nil", err)
+	}
+
+	alloc.UndrainNode("node-1")
+	if _, err := alloc.Allocate(ctx, pod, dynamic, 7000, 8000, 0, 10); err != nil {
+		t.Errorf("Allocate() after UndrainNode error = %v, want nil", err)
+	}
+}
+
+func TestAllocator_AssignedNodeAnnotation(t *testing.T) {
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7000, HostPort: 7000}}},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{holder}, WithAssignedNodeAnnotation("scheduler.alpha/assigned-node"))
+
+	// Not bound yet, but the scheduler already picked node-1
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app-0",
+			Namespace:   "default",
+			Annotations: map[string]string{"scheduler.alpha/assigned-node": "node-1"},
+		},
+	}
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7001 {
+		t.Errorf("Allocate() HostPort = %d, want 7001 past node-1's held 7000", result[0].HostPort)
+	}
+	snapshot := alloc.Snapshot()
+	if !slices.Contains(snapshot["node-1/TCP"], 7001) {
+		t.Errorf("node-1/TCP = %v, want 7001 tracked on node-1", snapshot["node-1/TCP"])
+	}
+	if len(snapshot["pending/TCP"]) != 0 {
+		t.Errorf("pending/TCP = %v, want nothing tracked as pending", snapshot["pending/TCP"])
+	}
+}
+
+func TestAllocator_ReleaseByPrefix(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
+	fakeClient := alloc.client
+	ctx := context.Background()
+
+	// Admit app-0..2 and db-0, creating each pod as the API server would
+	for _, name := range []string{"app-0", "app-1", "app-2", "db-0"} {
+		pod := podWithPorts(name, "node-1")
+		requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+		result, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+		if err != nil {
+			t.Fatalf("Allocate(%s) error = %v", name, err)
+		}
+		pod.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{
+			{Name: "game", ContainerPort: result[0].HostPort, HostPort: result[0].HostPort},
+		}}}
+		if err := fakeClient.Create(ctx, pod); err != nil {
+			t.Fatalf("Create(%s) error = %v", name, err)
+		}
+	}
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 4 {
+		t.Fatalf("node-1/TCP = %v, want 4 ports", got)
+	}
+
+	if got := alloc.ReleaseByPrefix("node-2", "app-"); got != 0 {
+		t.Errorf("ReleaseByPrefix(node-2) = %d, want 0", got)
+	}
+	if got := alloc.ReleaseByPrefix("node-1", "app-"); got != 3 {
+		t.Errorf("ReleaseByPrefix(node-1) = %d, want 3", got)
+	}
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 1 {
+		t.Errorf("node-1/TCP after release = %v, want only db-0's port", got)
+	}
+}
+
+func TestAllocator_ConflictNamesOwner(t *testing.T) {
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "game-server-7", Namespace: "team-a"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7000, HostPort: 7000}}},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{holder})
+
+	pod := podWithPorts("app-0", "node-1")
+	requests := []PortRequest{{Name: "game", ContainerPort: 7000, HostPort: 7000, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic}}
+
+	_, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 0, 10)
+	if err == nil {
+		t.Fatal("Allocate() error = nil, want a conflict")
+	}
+	if !strings.Contains(err.Error(), "team-a/game-server-7") {
+		t.Errorf("Allocate() error = %q, want it to name the owning pod team-a/game-server-7", err)
+	}
+}
+
+// filler holds the ports of the scan tests
+var filler = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "filler", Namespace: "default"}}
+
+// topSparseAllocator returns an allocator whose node-1/TCP ports are all taken
+// except the top 100 of the port space
+func topSparseAllocator(opts ...Option) *Allocator {
+	alloc := NewAllocator(nil, opts...)
+	for p := int32(1); p <= 65435; p++ {
+		alloc.markUsed("node-1", corev1.ProtocolTCP, p, filler)
+	}
+	return alloc
+}
+
+func TestAllocator_GallopingScan(t *testing.T) {
+	ranges := []PortRange{{Min: 1, Max: 65535}}
+
+	alloc := topSparseAllocator(WithGallopingScan())
+	p, err := alloc.findFreePort("node-1", corev1.ProtocolTCP, ranges, 0)
+	if err != nil {
+		t.Fatalf("findFreePort() error = %v", err)
+	}
+	if p != 65436 {
+		t.Errorf("findFreePort() = %d, want 65436 at the start of the free region", p)
+	}
+
+	// Scattered free ports below a taken top still fall back to the linear scan
+	alloc.markUsed("node-1", corev1.ProtocolTCP, 65535, filler)
+	alloc.Release("node-1", corev1.ProtocolTCP, 5000)
+	for q := int32(65436); q < 65535; q++ {
+		alloc.markUsed("node-1", corev1.ProtocolTCP, q, filler)
+	}
+	if p, err := alloc.findFreePort("node-1", corev1.ProtocolTCP, ranges, 0); err != nil || p != 5000 {
+		t.Errorf("findFreePort() = %d, %v, want 5000", p, err)
+	}
+}
+
+func BenchmarkFindFreePort(b *testing.B) {
+	ranges := []PortRange{{Min: 1, Max: 65535}}
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "linear"},
+		{name: "galloping", opts: []Option{WithGallopingScan()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			alloc := topSparseAllocator(bc.opts...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := alloc.findFreePort("node-1", corev1.ProtocolTCP, ranges, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocator_NamespaceCap(t *testing.T) {
+	alloc := newTestAllocator(t, nil, WithNamespaceCap(3))
+	ctx := context.Background()
+
+	capped := metrics.PortAllocationErrorsTotal.WithLabelValues(string(PolicyDynamic), "namespace_cap")
+	before := testutil.ToFloat64(capped)
+
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	allocate := func(namespace, name, node string) error {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       corev1.PodSpec{NodeName: node},
+		}
+		_, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+		return err
+	}
+
+	// The cap is summed across nodes
+	for i := 0; i < 3; i++ {
+		if err := allocate("team-a", fmt.Sprintf("app-%d", i), fmt.Sprintf("node-%d", i)); err != nil {
+			t.Fatalf("Allocate(app-%d) error = %v", i, err)
+		}
+	}
+	err := allocate("team-a", "app-3", "node-3")
+	if !errors.Is(err, ErrNamespaceCap) {
+		t.Fatalf("Allocate(app-3) error = %v, want ErrNamespaceCap", err)
+	}
+	if got := testutil.ToFloat64(capped) - before; got != 1 {
+		t.Errorf("namespace_cap errors increased by %v, want 1", got)
+	}
+
+	// Other namespaces have their own cap
+	if err := allocate("team-b", "app-0", "node-3"); err != nil {
+		t.Errorf("Allocate() in team-b error = %v, want nil", err)
+	}
+}
+
+func TestAllocator_NamespaceCapCountsEveryMark(t *testing.T) {
+	paired := PortRequest{Name: "game", ContainerPort: 7777, Policy: PolicyDynamic,
+		PairProtocols: []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}}
+	tests := []struct {
+		name     string
+		requests []PortRequest
+		wantErr  bool
+	}{
+		{name: "one pair fits", requests: []PortRequest{paired}},
+		{name: "a pair is two ports", requests: []PortRequest{paired, {Name: "voice", ContainerPort: 7778, Policy: PolicyDynamic,
+			PairProtocols: []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}}}, wantErr: true},
+		{name: "pair with next is two ports", requests: []PortRequest{paired, {Name: "rtp", ContainerPort: 5004, Protocol: corev1.ProtocolUDP,
+			Policy: PolicyDynamic, PairWithNext: true}}, wantErr: true},
+		{name: "single port fills the cap", requests: []PortRequest{paired, {Name: "query", ContainerPort: 7779, Protocol: corev1.ProtocolTCP,
+			Policy: PolicyDynamic}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := newTestAllocator(t, nil, WithNamespaceCap(3))
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "team-a"},
+				Spec:       corev1.PodSpec{NodeName: "node-1"},
+			}
+			_, err := alloc.Allocate(context.Background(), pod, tt.requests, 7000, 8000, 0, 10)
+			if gotErr := errors.Is(err, ErrNamespaceCap); gotErr != tt.wantErr {
+				t.Errorf("Allocate() error = %v, want ErrNamespaceCap: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllocator_AllocationsByAge(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pod := func(name string, created time.Time, port int32) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", CreationTimestamp: metav1.NewTime(created)},
+			Spec: corev1.PodSpec{
+				NodeName: "node-1",
+				Containers: []corev1.Container{
+					{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: port, HostPort: port}}},
+				},
+			},
+		}
+	}
+
+	alloc := newTestAllocator(t, []client.Object{pod("middle", base.Add(time.Hour), 7000), pod("newest", base.Add(2*time.Hour), 7001), pod("oldest", base, 7002)})
+	if err := alloc.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+
+	got := alloc.AllocationsByAge("node-1")
+	want := []string{"default/oldest", "default/middle", "default/newest"}
+	if len(got) != len(want) {
+		t.Fatalf("AllocationsByAge() = %+v, want %d entries", got, len(want))
+	}
+	for i, a := range got {
+		if a.Pod != want[i] {
+			t.Errorf("AllocationsByAge()[%d].Pod = %q, want %q", i, a.Pod, want[i])
+		}
+	}
+	if !got[0].AllocatedAt.Equal(base) || got[0].Port != 7002 {
+		t.Errorf("oldest = %+v, want port 7002 allocated at %v", got[0], base)
+	}
+	if other := alloc.AllocationsByAge("node-2"); len(other) != 0 {
+		t.Errorf("AllocationsByAge(node-2) = %+v, want none", other)
+	}
+}
+
+func TestAllocator_Tracing(t *testing.T) {
+	pod := podWithPorts("app-0", "node-1")
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{name: "disabled", want: []string{"admission"}},
+		{name: "enabled", opts: []Option{WithTracing()}, want: []string{"syncNodeState", "scan", "Allocate", "admission"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			ctx, span := provider.Tracer("test").Start(context.Background(), "admission")
+			alloc := newTestAllocator(t, nil, tt.opts...)
+			if _, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10); err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			span.End()
+
+			var got []string
+			for _, s := range recorder.Ended() {
+				got = append(got, s.Name())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ended spans = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocator_PoolPriority(t *testing.T) {
+	poolA := PortRange{Min: 9000, Max: 9001}
+	poolB := PortRange{Min: 7000, Max: 7009}
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic,
+		Pools: []PortRange{poolA, poolB}}}
+
+	tests := []struct {
+		name string
+		objs []client.Object
+		want int32
+	}{
+		// poolA comes first although poolB has lower ports
+		{name: "first pool", want: 9000},
+		{name: "first pool full", objs: []client.Object{podWithPorts("holder", "node-1",
+			corev1.ContainerPort{Name: "a", ContainerPort: 9000, HostPort: 9000},
+			corev1.ContainerPort{Name: "b", ContainerPort: 9001, HostPort: 9001},
+		)}, want: 7000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := newTestAllocator(t, tt.objs)
+			result, err := alloc.Allocate(context.Background(), podWithPorts("app-0", "node-1"), requests, 7000, 9001, 0, 10)
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			if result[0].HostPort != tt.want {
+				t.Errorf("Allocate() HostPort = %d, want %d", result[0].HostPort, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocator_HostPortResource(t *testing.T) {
+	const hostPorts corev1.ResourceName = "hostport.io/host-ports"
+
+	nodeWith := func(name string, value int64) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: corev1.NodeStatus{Allocatable: corev1.ResourceList{
+				hostPorts: *resource.NewQuantity(value, resource.DecimalSI),
+			}},
+		}
+	}
+	holder := podWithPorts("holder", "node-2", corev1.ContainerPort{Name: "a", ContainerPort: 7000, HostPort: 7000})
+	alloc := newTestAllocator(t, []client.Object{nodeWith("node-0", 0), nodeWith("node-2", 2), &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-x"}}, holder}, WithHostPortResource(hostPorts))
+	ctx := context.Background()
+
+	requests := func(n int) []PortRequest {
+		var reqs []PortRequest
+		for i := 0; i < n; i++ {
+			reqs = append(reqs, PortRequest{Name: fmt.Sprintf("p%d", i), ContainerPort: int32(7700 + i), Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic})
+		}
+		return reqs
+	}
+	podOn := func(node string) *corev1.Pod {
+		return podWithPorts("app-0", node)
+	}
+
+	// A node reporting zero takes no ports
+	if _, err := alloc.Allocate(ctx, podOn("node-0"), requests(1), 7000, 8000, 0, 10); !errors.Is(err, ErrRangeExhausted) {
+		t.Errorf("Allocate() on node-0 error = %v, want ErrRangeExhausted", err)
+	}
+
+	// node-2 holds one port already, so only one more fits
+	if _, err := alloc.Allocate(ctx, podOn("node-2"), requests(2), 7000, 8000, 0, 10); !errors.Is(err, ErrRangeExhausted) {
+		t.Errorf("Allocate() of 2 ports on node-2 error = %v, want ErrRangeExhausted", err)
+	}
+	result, err := alloc.Allocate(ctx, podOn("node-2"), requests(1), 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() of 1 port on node-2 error = %v", err)
+	}
+	if result[0].HostPort != 7001 {
+		t.Errorf("Allocate() HostPort = %d, want 7001", result[0].HostPort)
+	}
+
+	// Nodes without the resource are unlimited
+	if _, err := alloc.Allocate(ctx, podOn("node-x"), requests(3), 7000, 8000, 0, 10); err != nil {
+		t.Errorf("Allocate() on node-x error = %v, want nil", err)
+	}
+}
+
+func TestAllocator_RotatingScanStart(t *testing.T) {
+	alloc := newTestAllocator(t, nil, WithRotatingScanStart())
+	fakeClient := alloc.client
+	ctx := context.Background()
+
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	admit := func(name string) *corev1.Pod {
+		pod := podWithPorts(name, "node-1")
+		result, err := alloc.Allocate(ctx, pod, requests, 7000, 7002, 0, 10)
+		if err != nil {
+			t.Fatalf("Allocate(%s) error = %v", name, err)
+		}
+		pod.Spec.Containers = []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{
+			{Name: "game", ContainerPort: 7777, HostPort: result[0].HostPort},
+		}}}
+		if err := fakeClient.Create(ctx, pod); err != nil {
+			t.Fatalf("Create(%s) error = %v", name, err)
+		}
+		return pod
+	}
+	hostPort := func(pod *corev1.Pod) int32 { return pod.Spec.Containers[0].Ports[0].HostPort }
+
+	first := admit("app-a")
+	admit("app-b")
+
+	// 7000 is freed, but the scan starts past 7001
+	if err := fakeClient.Delete(ctx, first); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	alloc.ReleasePod(first)
+	if got := hostPort(admit("app-c")); got != 7002 {
+		t.Errorf("HostPort after freeing 7000 = %d, want 7002", got)
+	}
+
+	// Past the end of the range the scan wraps to the start
+	if got := hostPort(admit("app-d")); got != 7000 {
+		t.Errorf("HostPort after wrapping = %d, want 7000", got)
+	}
+}
+
+func TestAllocator_ServiceProtocols(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "game", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "game"},
+			Ports: []corev1.ServicePort{
+				{Name: "game", Port: 7777, TargetPort: intstr.FromString("game"), Protocol: corev1.ProtocolUDP},
+				{Name: "voice", Port: 9000, TargetPort: intstr.FromInt32(9000), Protocol: corev1.ProtocolSCTP},
+			},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{svc}, WithServiceProtocols())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: "default", Labels: map[string]string{"app": "game"}},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	}
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 7777, Policy: PolicyDynamic},
+		{Name: "voice", ContainerPort: 9000, Policy: PolicyDynamic},
+		{Name: "admin", ContainerPort: 8080, Policy: PolicyDynamic},
+		{Name: "stats", ContainerPort: 9100, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	want := []corev1.Protocol{corev1.ProtocolUDP, corev1.ProtocolSCTP, corev1.ProtocolTCP, corev1.ProtocolTCP}
+	for i, r := range result {
+		if r.Protocol != want[i] {
+			t.Errorf("%s Protocol = %s, want %s", r.Name, r.Protocol, want[i])
+		}
+	}
+	if got := alloc.Snapshot()["node-1/UDP"]; len(got) != 1 {
+		t.Errorf("node-1/UDP ports = %v, want the game port", got)
+	}
+}
+
+func TestAllocator_DualStack(t *testing.T) {
+	// 7000 is bound for IPv6 only, 7001 for IPv4 only
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{
+				{Name: "v6", ContainerPort: 7000, HostPort: 7000, HostIP: "::"},
+				{Name: "v4", ContainerPort: 7001, HostPort: 7001, HostIP: "0.0.0.0"},
+			}}},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{holder})
+	ctx := context.Background()
+
+	pod := podWithPorts("app-0", "node-1")
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic, DualStack: true}}
+	result, err := alloc.Allocate(ctx, pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if result[0].HostPort != 7002 {
+		t.Errorf("Allocate() HostPort = %d, want 7002, the first port free in both families", result[0].HostPort)
+	}
+
+	snapshot := alloc.Snapshot()
+	if !slices.Contains(snapshot["node-1/TCP"], 7002) || !slices.Contains(snapshot["node-1/"+string(IPv6Protocol(corev1.ProtocolTCP))], 7002) {
+		t.Errorf("Snapshot() = %v, want 7002 held in TCP and TCP6", snapshot)
+	}
+
+	// A Static dual-stack port taken for IPv6 is a conflict
+	static := []PortRequest{{Name: "game", ContainerPort: 7777, HostPort: 7000, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic, DualStack: true}}
+	if _, err := alloc.Allocate(ctx, pod, static, 7000, 7010, 0, 10); err == nil || !strings.Contains(err.Error(), "in use for IPv6") {
+		t.Errorf("Allocate() of 7000 error = %v, want an IPv6 conflict", err)
+	}
+
+	// The orphan sweep keeps the live IPv6 hold of the holder
+	if _, err := alloc.ReleaseOrphans(ctx, 0); err != nil {
+		t.Fatalf("ReleaseOrphans() error = %v", err)
+	}
+	if got := alloc.Snapshot()["node-1/"+string(IPv6Protocol(corev1.ProtocolTCP))]; !slices.Contains(got, 7000) {
+		t.Errorf("TCP6 ports after ReleaseOrphans() = %v, want 7000 still held", got)
+	}
+}
+
+// bucketCount returns the cumulative count of a histogram bucket
+func bucketCount(t *testing.T, o prometheus.Observer, le float64) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("failed to read histogram: %v", err)
+	}
+	for _, b := range m.GetHistogram().GetBucket() {
+		if b.GetUpperBound() == le {
+			return b.GetCumulativeCount()
+		}
+	}
+	t.Fatalf("histogram has no bucket le=%v", le)
+	return 0
+}
+
+func TestAllocator_ScanDistanceMetric(t *testing.T) {
+	distance := metrics.PortScanDistance.WithLabelValues(string(corev1.ProtocolTCP))
+	lowBefore, highBefore := bucketCount(t, distance, 16384), bucketCount(t, distance, 65536)
+
+	// Only the top 100 ports are free, so the scan walks past 65435 taken ones
+	alloc := topSparseAllocator()
+	if _, err := alloc.findFreePort("node-1", corev1.ProtocolTCP, []PortRange{{Min: 1, Max: 65535}}, 0); err != nil {
+		t.Fatalf("findFreePort() error = %v", err)
+	}
+
+	if got := bucketCount(t, distance, 16384) - lowBefore; got != 0 {
+		t.Errorf("observations up to 16384 increased by %d, want 0", got)
+	}
+	if got := bucketCount(t, distance, 65536) - highBefore; got != 1 {
+		t.Errorf("observations up to 65536 increased by %d, want 1", got)
+	}
+}
+
+func TestAllocator_PairWithNext(t *testing.T) {
+	// 7001 is taken, so the 7000/7001 pair doesn't fit
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{
+				{Name: "a", ContainerPort: 7001, HostPort: 7001, Protocol: corev1.ProtocolUDP},
+			}}},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{holder})
+	ctx := context.Background()
+
+	pod := podWithPorts("media-0", "node-1")
+	rtp := PortRequest{Name: "rtp", ContainerPort: 5004, Protocol: corev1.ProtocolUDP, Policy: PolicyDynamic, PairWithNext: true}
+	result, err := alloc.Allocate(ctx, pod, []PortRequest{rtp}, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if p := result[0].HostPort; p != 7002 {
+		t.Errorf("Allocate() HostPort = %d, want 7002, the first even port with a free successor", p)
+	}
+	if got := alloc.Snapshot()["node-1/UDP"]; !slices.Equal(got, []int32{7001, 7002, 7003}) {
+		t.Errorf("node-1/UDP ports = %v, want [7001 7002 7003]", got)
+	}
+
+	// A Static pair whose successor is taken holds neither port
+	static := rtp
+	static.Policy, static.HostPort = PolicyStatic, 7000
+	other := podWithPorts("media-1", "node-1")
+	if _, err := alloc.Allocate(ctx, other, []PortRequest{static}, 7000, 7010, 0, 10); err == nil {
+		t.Fatal("Allocate() of 7000 paired with the taken 7001 succeeded, want an error")
+	}
+	if slices.Contains(alloc.Snapshot()["node-1/UDP"], 7000) {
+		t.Error("7000 is held after its pair failed, want it rolled back")
+	}
+}
+
+func TestAllocator_LargestFreeBlockMetric(t *testing.T) {
+	// Free blocks in 7000-7019: 7000-7002, 7004-7009 and 7011-7019
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "frag-node",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{
+				{Name: "a", ContainerPort: 7003, HostPort: 7003},
+				{Name: "b", ContainerPort: 7010, HostPort: 7010},
+			}}},
+		},
+	}
+
+	alloc := newTestAllocator(t, []client.Object{holder}, WithFragmentationRange(PortRange{Min: 7000, Max: 7019}))
+
+	pod := podWithPorts("app-0", "frag-node")
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	if _, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7019, 0, 10); err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+
+	if got := testutil.ToFloat64(metrics.LargestFreeBlock.WithLabelValues("frag-node", "TCP")); got != 9 {
+		t.Errorf("largest free TCP block = %v, want 9", got)
+	}
+	if got := testutil.ToFloat64(metrics.LargestFreeBlock.WithLabelValues("frag-node", "UDP")); got != 20 {
+		t.Errorf("largest free UDP block = %v, want 20", got)
+	}
+}
+
+func TestAllocator_GlobalConflictSpace(t *testing.T) {
+	alloc := newTestAllocator(t, nil, WithGlobalConflictSpace())
+	fakeClient := alloc.client
+	ctx := context.Background()
+
+	requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	seen := make(map[int32]string)
+	for i, node := range []string{"node-a", "node-b", "node-c", ""} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("app-%d", i), Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: node},
+		}
+		result, err := alloc.Allocate(ctx, pod, requests, 7000, 7010, 0, 10)
+		if err != nil {
+			t.Fatalf("Allocate(%s) error = %v", pod.Name, err)
+		}
+		port := result[0].HostPort
+		if prev, dup := seen[port]; dup {
+			t.Fatalf("port %d granted to both %s and %s on different nodes", port, prev, pod.Name)
+		}
+		seen[port] = pod.Name
+		pod.Spec.Containers = []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{
+			{Name: "game", ContainerPort: 7777, HostPort: port},
+		}}}
+		if err := fakeClient.Create(ctx, pod); err != nil {
+			t.Fatalf("Create(%s) error = %v", pod.Name, err)
+		}
+	}
+
+	// A Static port held on node-a is taken on node-b too
+	static := podWithPorts("static-0", "node-b")
+	_, err := alloc.Allocate(ctx, static, []PortRequest{{Name: "game", HostPort: 7000, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic}}, 7000, 7010, 0, 10)
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("Allocate(static 7000 on node-b) error = %v, want a conflict", err)
+	}
+
+	if got := alloc.Snapshot()[GlobalNodeName+"/TCP"]; len(got) != 4 {
+		t.Errorf("Snapshot()[%s/TCP] = %v, want the 4 allocated ports", GlobalNodeName, got)
+	}
+}
+
+func TestAllocator_NodeReadinessCheck(t *testing.T) {
+	node := func(name string, status corev1.ConditionStatus) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}}},
+		}
+	}
+
+	alloc := newTestAllocator(t, []client.Object{node("ready", corev1.ConditionTrue), node("not-ready", corev1.ConditionFalse)}, WithNodeReadinessCheck())
+	ctx := context.Background()
+
+	podOn := func(nodeName string) *corev1.Pod {
+		return podWithPorts("app-0", nodeName)
+	}
+	dynamic := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	index := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyIndex}}
+	static := []PortRequest{{Name: "metrics", ContainerPort: 9090, HostPort: 9090, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic}}
+
+	for _, requests := range [][]PortRequest{dynamic, index} {
+		_, err := alloc.Allocate(ctx, podOn("not-ready"), requests, 7000, 8000, 0, 10)
+		if err == nil || !strings.Contains(err.Error(), "node not-ready is NotReady") {
+			t.Errorf("Allocate(%s) on a NotReady node error = %v, want a NotReady error", requests[0].Policy, err)
+		}
+	}
+	if _, err := alloc.Allocate(ctx, podOn("not-ready"), static, 7000, 8000, 0, 10); err != nil {
+		t.Errorf("Allocate(Static) on a NotReady node error = %v, want nil", err)
+	}
+	if _, err := alloc.Allocate(ctx, podOn("ready"), dynamic, 7000, 8000, 0, 10); err != nil {
+		t.Errorf("Allocate() on a Ready node error = %v, want nil", err)
+	}
+}
+
+func TestPlacedElsewhere(t *testing.T) {
+	tests := []struct {
+		assumed  string
+		nodeName string
+		want     bool
+	}{
+		{assumed: "node-a", nodeName: "node-a"},
+		{assumed: "node-a", nodeName: "node-b", want: true},
+		{assumed: "node-a"},
+		{assumed: "pending", nodeName: "node-b"},
+		{assumed: GlobalNodeName, nodeName: "node-b"},
+		{nodeName: "node-b"},
+	}
+	for _, tt := range tests {
+		pod := &corev1.Pod{Spec: corev1.PodSpec{NodeName: tt.nodeName}}
+		if tt.assumed != "" {
+			pod.Annotations = map[string]string{AnnotationAssumedNode: tt.assumed}
+		}
+		if got := PlacedElsewhere(pod); got != tt.want {
+			t.Errorf("PlacedElsewhere(assumed %q, bound to %q) = %v, want %v", tt.assumed, tt.nodeName, got, tt.want)
+		}
+	}
+}
+
+func TestAllocator_ActiveAllocationsGauge(t *testing.T) {
+	alloc := newTestAllocator(t, nil)
+	fakeClient := alloc.client
+	ctx := context.Background()
+
+	active := metrics.ActiveAllocations.WithLabelValues(string(PolicyDynamic))
+	base := testutil.ToFloat64(active)
+
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+		{Name: "voice", ContainerPort: 7778, Protocol: corev1.ProtocolUDP, Policy: PolicyDynamic},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "gauge-0",
+			Namespace:   "default",
+			Annotations: map[string]string{AnnotationAllocationMeta: `{"policy":"Dynamic","minPort":7000,"maxPort":7099,"index":0}`},
+		},
+		Spec: corev1.PodSpec{NodeName: "gauge-node"},
+	}
+	result, err := alloc.Allocate(ctx, pod, requests, 7000, 7099, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if got := testutil.ToFloat64(active) - base; got != 2 {
+		t.Errorf("active Dynamic allocations after Allocate = %v, want 2", got)
+	}
+
+	// A rebuild of the node's cache from the cluster keeps the count
+	for _, r := range result {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: r.Name, Ports: []corev1.ContainerPort{
+			{Name: r.Name, ContainerPort: r.ContainerPort, HostPort: r.HostPort, Protocol: r.Protocol},
+		}})
+	}
+	if err := fakeClient.Create(ctx, pod); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	other := podWithPorts("gauge-1", "gauge-node")
+	if _, err := alloc.Allocate(ctx, other, requests[:1], 7000, 7099, 0, 10); err != nil {
+		t.Fatalf("Allocate(gauge-1) error = %v", err)
+	}
+	if got := testutil.ToFloat64(active) - base; got != 3 {
+		t.Errorf("active Dynamic allocations after a second pod = %v, want 3", got)
+	}
+
+	// The pending pool mirrors gauge-0, which only counts under its node
+	pending := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "gauge-2", Namespace: "default"}}
+	if _, err := alloc.Allocate(ctx, pending, requests[:1], 7000, 7099, 0, 10); err != nil {
+		t.Fatalf("Allocate(gauge-2) error = %v", err)
+	}
+	if got := testutil.ToFloat64(active) - base; got != 4 {
+		t.Errorf("active Dynamic allocations after a pending pod = %v, want 4", got)
+	}
+
+	alloc.ReleasePod(pod)
+	if got := testutil.ToFloat64(active) - base; got != 2 {
+		t.Errorf("active Dynamic allocations after ReleasePod = %v, want 2", got)
+	}
+}
+
+func TestAllocator_CapacityScaledRange(t *testing.T) {
+	node := func(name, capacity string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"example.com/max-game-servers": capacity}},
+			Status:     corev1.NodeStatus{Allocatable: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("110")}},
+		}
+	}
+	unlabeled := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"},
+		Status:     corev1.NodeStatus{Allocatable: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("3")}},
+	}
+	// 2 ports per pod: small gets 7000-7003, large 7000-7015, unlabeled 7000-7005
+	alloc := newTestAllocator(t, []client.Object{node("small", "2"), node("large", "8"), unlabeled}, WithCapacityScaledRange("example.com/max-game-servers", 2))
+	fakeClient := alloc.client
+	ctx := context.Background()
+
+	game := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+	fill := func(nodeName string) []int32 {
+		var ports []int32
+		for i := 0; i < 30; i++ {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("app-%d", i), Namespace: nodeName},
+				Spec:       corev1.PodSpec{NodeName: nodeName},
+			}
+			result, err := alloc.Allocate(ctx, pod, game, 7000, 7099, 0, 10)
+			if err != nil {
+				if !errors.Is(err, ErrRangeExhausted) {
+					t.Fatalf("Allocate() on %s error = %v, want ErrRangeExhausted once full", nodeName, err)
+				}
+				return ports
+			}
+			ports = append(ports, result[0].HostPort)
+			pod.Spec.Containers = []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{
+				{Name: "game", ContainerPort: 7777, HostPort: result[0].HostPort},
+			}}}
+			if err := fakeClient.Create(ctx, pod); err != nil {
+				t.Fatalf("Create(%s) error = %v", pod.Name, err)
+			}
+		}
+		return ports
+	}
+
+	if got := fill("small"); len(got) != 4 || got[3] != 7003 {
+		t.Errorf("ports on small = %v, want 7000-7003", got)
+	}
+	if got := fill("large"); len(got) != 16 || got[15] != 7015 {
+		t.Errorf("ports on large = %v, want 7000-7015", got)
+	}
+	if got := fill("unlabeled"); len(got) != 6 || got[5] != 7005 {
+		t.Errorf("ports on unlabeled = %v, want 7000-7005 from its allocatable pods", got)
+	}
+}
+
+func TestAllocator_Publisher(t *testing.T) {
+	recorder := &bustest.Recorder{}
+	alloc := newTestAllocator(t, nil, WithPublisher(recorder))
+	fakeClient := alloc.client
+	ctx := context.Background()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "games"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	}
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic},
+		{Name: "voice", ContainerPort: 7778, Protocol: corev1.ProtocolUDP, Policy: PolicyDynamic},
+	}
+	result, err := alloc.Allocate(ctx, pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	pod.Spec.Containers = []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{
+		{Name: "game", ContainerPort: 7777, HostPort: result[0].HostPort, Protocol: corev1.ProtocolTCP},
+		{Name: "voice", ContainerPort: 7778, HostPort: result[1].HostPort, Protocol: corev1.ProtocolUDP},
+	}}}
+	if err := fakeClient.Create(ctx, pod); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	want := []bus.Event{
+		{Type: bus.EventAllocated, Node: "node-1", Namespace: "games", Pod: "app-0", Port: 7000, Protocol: "TCP"},
+		{Type: bus.EventAllocated, Node: "node-1", Namespace: "games", Pod: "app-0", Port: 7000, Protocol: "UDP"},
+	}
+	if got := recorder.Events(); !slices.Equal(got, want) {
+		t.Errorf("events after Allocate() = %+v, want %+v", got, want)
+	}
+
+	// A denied batch publishes nothing
+	recorder.Reset()
+	static := []PortRequest{{Name: "game", HostPort: 7000, Protocol: corev1.ProtocolTCP, Policy: PolicyStatic}}
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1", Namespace: "games"}, Spec: corev1.PodSpec{NodeName: "node-1"}}
+	if _, err := alloc.Allocate(ctx, other, static, 7000, 7010, 0, 10); err == nil {
+		t.Fatal("Allocate(7000) expected a conflict, got nil")
+	}
+	if got := recorder.Events(); len(got) != 0 {
+		t.Errorf("events after a denied Allocate() = %+v, want none", got)
+	}
+
+	// A dry run publishes nothing either
+	dryRun := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-2", Namespace: "games"}, Spec: corev1.PodSpec{NodeName: "node-1"}}
+	if _, err := alloc.Allocate(DryRunContext(ctx), dryRun, requests[:1], 7000, 7010, 0, 10); err != nil {
+		t.Fatalf("Allocate() in a dry run error = %v", err)
+	}
+	if got := recorder.Events(); len(got) != 0 {
+		t.Errorf("events after a dry-run Allocate() = %+v, want none", got)
+	}
+
+	alloc.Release("node-1", corev1.ProtocolUDP, 7000)
+	want = []bus.Event{{Type: bus.EventReleased, Node: "node-1", Namespace: "games", Pod: "app-0", Port: 7000, Protocol: "UDP"}}
+	if got := recorder.Events(); !slices.Equal(got, want) {
+		t.Errorf("events after Release() = %+v, want %+v", got, want)
+	}
+}
+
+// snapshotPublisher reads the allocator back from Publish, as a publisher
+// looking up the node's remaining ports would
+type snapshotPublisher struct {
+	alloc  *Allocator
+	events int
+}
+
+func (p *snapshotPublisher) Publish(bus.Event) {
+	p.alloc.Snapshot()
+	p.events++
+}
+
+func TestAllocator_PublisherCallsBack(t *testing.T) {
+	publisher := &snapshotPublisher{}
+	alloc := newTestAllocator(t, nil, WithPublisher(publisher))
+	fakeClient := alloc.client
+	publisher.alloc = alloc
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		requests := []PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: PolicyDynamic}}
+		for _, name := range []string{"app-0", "app-1", "app-2"} {
+			pod := podWithPorts(name, "node-1")
+			result, err := alloc.Allocate(ctx, pod, requests, 7000, 7010, 0, 10)
+			if err != nil {
+				t.Errorf("Allocate(%s) error = %v", name, err)
+				return
+			}
+			pod.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{
+				{Name: "game", ContainerPort: 7777, HostPort: result[0].HostPort},
+			}}}
+			if err := fakeClient.Create(ctx, pod); err != nil {
+				t.Errorf("Create(%s) error = %v", name, err)
+				return
+			}
+			switch name {
+			case "app-0":
+				alloc.ReleasePod(pod)
+			case "app-1":
+				alloc.Release("node-1", corev1.ProtocolTCP, result[0].HostPort)
+			case "app-2":
+				alloc.ReleaseByPrefix("node-1", "app-2")
+			}
+		}
+		if _, err := alloc.ReleaseOrphans(ctx, 0); err != nil {
+			t.Errorf("ReleaseOrphans() error = %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a publisher calling back into the allocator deadlocked it")
+	}
+	if publisher.events < 6 {
+		t.Errorf("published %d events, want at least 6", publisher.events)
+	}
+}
+
+func TestAllocator_FailedBatchRollsBack(t *testing.T) {
+	// Kept phantoms would outlive the next sync, so a leak shows up there too
+	alloc := newTestAllocator(t, nil, WithPhantomResolution(PhantomKeep))
+	alloc.Reserve("rollback-node", corev1.ProtocolUDP, 7005)
+	ctx := context.Background()
+
+	active := metrics.ActiveAllocations.WithLabelValues(string(PolicyDynamic))
+	base := testutil.ToFloat64(active)
+
+	// The first port is granted and its pair marked, then the Static port is refused
+	pod := podWithPorts("rejected-0", "rollback-node")
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 7777, Policy: PolicyDynamic, PairProtocols: []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}},
+		{Name: "query", ContainerPort: 7778, HostPort: 7005, Protocol: corev1.ProtocolUDP, Policy: PolicyStatic},
+	}
+	if _, err := alloc.Allocate(ctx, pod, requests, 7000, 7010, 0, 10); err == nil {
+		t.Fatal("Allocate() error = nil, want the reserved Static port refused")
+	}
+
+	snapshot := alloc.Snapshot()
+	for _, key := range []string{"rollback-node/TCP", "rollback-node/UDP"} {
+		if slices.Contains(snapshot[key], 7000) {
+			t.Errorf("%s holds 7000 after the failed batch: %v", key, snapshot[key])
+		}
+	}
+	if got := testutil.ToFloat64(active) - base; got != 0 {
+		t.Errorf("active Dynamic allocations after the failed batch = %v, want 0", got)
+	}
+
+	other := podWithPorts("other-0", "rollback-node")
+	result, err := alloc.Allocate(ctx, other, requests[:1], 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate(other-0) error = %v", err)
+	}
+	if result[0].HostPort != 7000 {
+		t.Errorf("Allocate(other-0) HostPort = %d, want 7000 released by the failed batch", result[0].HostPort)
+	}
+}
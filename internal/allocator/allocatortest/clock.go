@@ -0,0 +1,36 @@
+package allocatortest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+var _ allocator.Clock = (*FakeClock)(nil)
+
+// FakeClock is an allocator.Clock that only moves when told to, for
+// deterministic tests of TTLs and grace periods
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the clock's current time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,243 @@
+package allocatortest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func TestFakeClock_ReleaseOrphans(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	alloc := allocator.NewAllocator(c, allocator.WithClock(clock))
+	ctx := context.Background()
+
+	// Allocated for a pod that is never created: an orphan once the TTL passes
+	pod := podOnNode("app-0", "node-1")
+	game := []allocator.PortRequest{{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyDynamic}}
+	if _, err := alloc.Allocate(ctx, pod, game, 7000, 7001, 0, 10); err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+
+	clock.Advance(59 * time.Second)
+	if n, err := alloc.ReleaseOrphans(ctx, time.Minute); err != nil || n != 0 {
+		t.Fatalf("ReleaseOrphans() before the TTL = %d, %v, want 0, nil", n, err)
+	}
+	clock.Advance(time.Second)
+	if n, err := alloc.ReleaseOrphans(ctx, time.Minute); err != nil || n != 1 {
+		t.Fatalf("ReleaseOrphans() at the TTL = %d, %v, want 1, nil", n, err)
+	}
+}
+
+func TestFakeClock_TerminationGrace(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	alloc := allocator.NewAllocator(c, allocator.WithTerminationGrace(), allocator.WithClock(clock))
+	ctx := context.Background()
+
+	game := []allocator.PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyDynamic}}
+	admit := func(name string) *corev1.Pod {
+		pod := podOnNode(name, "node-1")
+		pod.Spec.TerminationGracePeriodSeconds = ptr.To(int64(60))
+		result, err := alloc.Allocate(ctx, pod, game, 7000, 7001, 0, 10)
+		if err != nil {
+			t.Fatalf("Allocate(%s) error = %v", name, err)
+		}
+		persist(pod, result)
+		if err := c.Create(ctx, pod); err != nil {
+			t.Fatalf("Create(%s) error = %v", name, err)
+		}
+		return pod
+	}
+	hostPort := func(pod *corev1.Pod) int32 { return pod.Spec.Containers[0].Ports[0].HostPort }
+
+	first := admit("app-a")
+	if got := hostPort(first); got != 7000 {
+		t.Fatalf("HostPort(app-a) = %d, want 7000", got)
+	}
+	if err := c.Delete(ctx, first); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	alloc.ReleasePod(first)
+
+	// Within app-a's 60s grace period 7000 is skipped
+	clock.Advance(30 * time.Second)
+	if got := hostPort(admit("app-b")); got != 7001 {
+		t.Errorf("HostPort within the grace period = %d, want 7001", got)
+	}
+	static := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "static-0", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	}
+	staticReq := []allocator.PortRequest{{Name: "game", HostPort: 7000, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyStatic}}
+	if _, err := alloc.Allocate(ctx, static, staticReq, 7000, 7001, 0, 10); err == nil || !strings.Contains(err.Error(), "terminating pod") {
+		t.Errorf("Allocate(static 7000) within the grace period error = %v, want a grace period error", err)
+	}
+
+	// Once it has passed, 7000 is handed out again
+	clock.Advance(31 * time.Second)
+	if got := hostPort(admit("app-c")); got != 7000 {
+		t.Errorf("HostPort after the grace period = %d, want 7000", got)
+	}
+}
+
+func TestFakeClock_TerminationGraceBulkRelease(t *testing.T) {
+	game := []allocator.PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyDynamic}}
+	release := map[string]func(t *testing.T, ctx context.Context, alloc *allocator.Allocator) int{
+		"ReleaseByPrefix": func(_ *testing.T, _ context.Context, alloc *allocator.Allocator) int {
+			return alloc.ReleaseByPrefix("node-1", "app-")
+		},
+		"ReleaseOrphans": func(t *testing.T, ctx context.Context, alloc *allocator.Allocator) int {
+			n, err := alloc.ReleaseOrphans(ctx, time.Minute)
+			if err != nil {
+				t.Fatalf("ReleaseOrphans() error = %v", err)
+			}
+			return n
+		},
+	}
+	for name, releaseFn := range release {
+		t.Run(name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			corev1.AddToScheme(scheme)
+			c := fake.NewClientBuilder().WithScheme(scheme).Build()
+			clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			alloc := allocator.NewAllocator(c, allocator.WithTerminationGrace(), allocator.WithClock(clock))
+			ctx := context.Background()
+
+			// app-a is gone from the List without its ports being released
+			first := podOnNode("app-a", "node-1")
+			first.Spec.TerminationGracePeriodSeconds = ptr.To(int64(120))
+			if result, err := alloc.Allocate(ctx, first, game, 7000, 7001, 0, 10); err != nil || result[0].HostPort != 7000 {
+				t.Fatalf("Allocate(app-a) = %v, %v, want 7000", result, err)
+			}
+			clock.Advance(time.Minute)
+			if n := releaseFn(t, ctx, alloc); n != 1 {
+				t.Fatalf("released %d ports, want 1", n)
+			}
+
+			// The released port is still within app-a's grace period
+			result, err := alloc.Allocate(ctx, podOnNode("app-b", "node-1"), game, 7000, 7001, 0, 10)
+			if err != nil {
+				t.Fatalf("Allocate(app-b) error = %v", err)
+			}
+			if result[0].HostPort != 7001 {
+				t.Errorf("HostPort within the grace period = %d, want 7001", result[0].HostPort)
+			}
+		})
+	}
+}
+
+func TestFakeClock_TerminationGraceSticky(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	alloc := allocator.NewAllocator(c, allocator.WithTerminationGrace(), allocator.WithClock(clock))
+	ctx := context.Background()
+
+	// other held 7003 and is gone, its grace period still running
+	other := podOnNode("other", "node-1")
+	other.Spec.TerminationGracePeriodSeconds = ptr.To(int64(60))
+	static := []allocator.PortRequest{{Name: "game", ContainerPort: 7003, HostPort: 7003, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyStatic}}
+	if _, err := alloc.Allocate(ctx, other, static, 7000, 7010, 0, 10); err != nil {
+		t.Fatalf("Allocate(other) error = %v", err)
+	}
+	if n := alloc.ReleaseByPrefix("node-1", "other"); n != 1 {
+		t.Fatalf("ReleaseByPrefix() = %d, want 1", n)
+	}
+
+	// The previous incarnation of app-0 recorded 7003 too
+	old := podOnNode("app-0", "node-1")
+	old.Annotations = map[string]string{"hostport.io/allocated-game": "7003"}
+	if err := c.Create(ctx, old); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	game := []allocator.PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyDynamic}}
+	result, err := alloc.Allocate(ctx, podOnNode("app-0", "node-1"), game, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate(app-0) error = %v, want a fresh port instead of the held sticky one", err)
+	}
+	if result[0].HostPort != 7000 {
+		t.Errorf("HostPort = %d, want 7000 while 7003 is in other's grace period", result[0].HostPort)
+	}
+}
+
+func TestFakeClock_MaintenanceWindow(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	window, err := allocator.ParseTimeWindow("2024-01-01T22:00:00Z/2024-01-02T02:00:00Z")
+	if err != nil {
+		t.Fatalf("ParseTimeWindow() error = %v", err)
+	}
+	clock := NewFakeClock(time.Date(2024, 1, 1, 21, 0, 0, 0, time.UTC))
+	alloc := allocator.NewAllocator(c, allocator.WithMaintenanceWindow(window), allocator.WithClock(clock))
+	ctx := context.Background()
+
+	game := []allocator.PortRequest{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyDynamic}}
+	static := []allocator.PortRequest{{Name: "admin", HostPort: 9000, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyStatic}}
+
+	if _, err := alloc.Allocate(ctx, podOnNode("app-0", "node-1"), game, 7000, 7010, 0, 10); err != nil {
+		t.Errorf("Allocate() before the window error = %v, want nil", err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	_, err = alloc.Allocate(ctx, podOnNode("app-1", "node-1"), game, 7000, 7010, 0, 10)
+	if err == nil || !strings.Contains(err.Error(), "maintenance window until 2024-01-02T02:00:00Z") {
+		t.Errorf("Allocate() inside the window error = %v, want a maintenance window error", err)
+	}
+	if _, err := alloc.Allocate(ctx, podOnNode("static-0", "node-1"), static, 7000, 7010, 0, 10); err != nil {
+		t.Errorf("Allocate(static) inside the window error = %v, want nil", err)
+	}
+
+	// The window's end is not part of it
+	clock.Advance(3 * time.Hour)
+	if _, err := alloc.Allocate(ctx, podOnNode("app-2", "node-1"), game, 7000, 7010, 0, 10); err != nil {
+		t.Errorf("Allocate() after the window error = %v, want nil", err)
+	}
+
+	for _, val := range []string{"2024-01-01T22:00:00Z", "2024-01-02T02:00:00Z/2024-01-01T22:00:00Z", "yesterday/today"} {
+		if _, err := allocator.ParseTimeWindow(val); err == nil {
+			t.Errorf("ParseTimeWindow(%q) expected error, got nil", val)
+		}
+	}
+}
+
+func TestFakeClock_StuckTerminatingReclaim(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	deleted := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Its node is gone, so the kubelet never confirms the deletion
+	stuck := podOnNode("app-0", "node-1")
+	stuck.Spec.Containers = []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7000, HostPort: 7000}}}}
+	stuck.DeletionTimestamp = &metav1.Time{Time: deleted}
+	stuck.Finalizers = []string{"example.com/cleanup"}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(stuck).Build()
+	clock := NewFakeClock(deleted.Add(time.Minute))
+	alloc := allocator.NewAllocator(c, allocator.WithStuckTerminatingReclaim(10*time.Minute), allocator.WithClock(clock))
+	ctx := context.Background()
+
+	game := []allocator.PortRequest{{Name: "game", HostPort: 7000, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyStatic}}
+	if _, err := alloc.Allocate(ctx, podOnNode("app-1", "node-1"), game, 7000, 7000, 0, 10); err == nil {
+		t.Errorf("Allocate(7000) while app-0 is Terminating expected error, got nil")
+	}
+
+	clock.Advance(10 * time.Minute)
+	if _, err := alloc.Allocate(ctx, podOnNode("app-1", "node-1"), game, 7000, 7000, 0, 10); err != nil {
+		t.Errorf("Allocate(7000) once app-0 is stuck Terminating error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Package allocatortest provides helpers for testing code built on the
+// allocator, such as replaying scripted allocation sequences.
+package allocatortest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+// OpKind is the kind of a replayed Step
+type OpKind string
+
+const (
+	// OpAllocate calls Allocate for Pod with Requests and the range parameters
+	OpAllocate OpKind = "Allocate"
+	// OpRelease calls Release for Node, Protocol and Ports
+	OpRelease OpKind = "Release"
+	// OpDelete removes a pod persisted by an earlier OpAllocate from the
+	// cluster and releases its ports, as the pod deletion path would
+	OpDelete OpKind = "Delete"
+)
+
+// Step is one scripted operation
+type Step struct {
+	Op OpKind
+
+	// Pod is the pod to allocate for (OpAllocate) or delete (OpDelete, by name)
+	Pod      *corev1.Pod
+	Requests []allocator.PortRequest
+	MinPort  int32
+	MaxPort  int32
+	Index    int32
+	Stride   int32
+	// Persist creates the pod in the cluster after a successful allocation,
+	// with its hostPorts and allocated annotations set as the webhook would.
+	// Allocate rebuilds a node's cache from the cluster, so allocations that
+	// aren't persisted only last until the next allocation on the node.
+	Persist bool
+	// WantErr expects the allocation to fail
+	WantErr bool
+
+	// Node, Protocol and Ports are released by OpRelease
+	Node     string
+	Protocol corev1.Protocol
+	Ports    []int32
+}
+
+// Replay runs the steps against a fresh allocator backed by a fake cluster
+// and returns the allocator's final snapshot. Unexpected allocation results
+// fail the test.
+func Replay(t testing.TB, steps []Step, opts ...allocator.Option) map[string][]int32 {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to build scheme: %v", err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	alloc := allocator.NewAllocator(c, opts...)
+	ctx := context.Background()
+
+	pods := make(map[string]*corev1.Pod)
+	for i, step := range steps {
+		switch step.Op {
+		case OpAllocate:
+			pod := step.Pod.DeepCopy()
+			result, err := alloc.Allocate(ctx, pod, step.Requests, step.MinPort, step.MaxPort, step.Index, step.Stride)
+			if (err != nil) != step.WantErr {
+				t.Fatalf("step %d: Allocate(%s) error = %v, wantErr %v", i, pod.Name, err, step.WantErr)
+			}
+			if err != nil || !step.Persist {
+				continue
+			}
+			persist(pod, result)
+			if err := c.Create(ctx, pod); err != nil {
+				t.Fatalf("step %d: failed to create pod %s: %v", i, pod.Name, err)
+			}
+			pods[pod.Namespace+"/"+pod.Name] = pod
+
+		case OpRelease:
+			alloc.Release(step.Node, step.Protocol, step.Ports...)
+
+		case OpDelete:
+			key := step.Pod.Namespace + "/" + step.Pod.Name
+			pod, ok := pods[key]
+			if !ok {
+				t.Fatalf("step %d: pod %s was not persisted by an earlier step", i, key)
+			}
+			if err := c.Delete(ctx, pod); err != nil {
+				t.Fatalf("step %d: failed to delete pod %s: %v", i, key, err)
+			}
+			alloc.ReleasePod(pod)
+			delete(pods, key)
+
+		default:
+			t.Fatalf("step %d: unknown op %q", i, step.Op)
+		}
+	}
+	return alloc.Snapshot()
+}
+
+// persist applies allocation results to the pod like the mutating webhook
+func persist(pod *corev1.Pod, result []allocator.PortRequest) {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	var ports []corev1.ContainerPort
+	for _, r := range result {
+		// Unnamed ports are keyed by their container port, as by the webhook
+		name := r.Name
+		if name == "" {
+			name = strconv.Itoa(int(r.ContainerPort))
+		}
+		ports = append(ports, corev1.ContainerPort{
+			Name:          name,
+			ContainerPort: r.ContainerPort,
+			HostPort:      r.HostPort,
+			Protocol:      r.Protocol,
+		})
+		pod.Annotations["hostport.io/allocated-"+allocator.AllocationKey(name, r.Protocol)] = fmt.Sprintf("%d", r.HostPort)
+	}
+	pod.Spec.Containers = []corev1.Container{{Name: "app", Ports: ports}}
+}
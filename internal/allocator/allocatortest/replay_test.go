@@ -0,0 +1,77 @@
+package allocatortest
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func podOnNode(name, nodeName string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: nodeName},
+	}
+}
+
+func TestReplay(t *testing.T) {
+	game := []allocator.PortRequest{
+		{Name: "game", ContainerPort: 8080, Protocol: corev1.ProtocolTCP, Policy: allocator.PolicyDynamic},
+	}
+	allocate := func(name string) Step {
+		return Step{Op: OpAllocate, Pod: podOnNode(name, "node-1"), Requests: game, MinPort: 7000, MaxPort: 7001, Persist: true}
+	}
+
+	snapshot := Replay(t, []Step{
+		allocate("app-0"),
+		allocate("app-1"),
+		// The range is full
+		{Op: OpAllocate, Pod: podOnNode("app-2", "node-1"), Requests: game, MinPort: 7000, MaxPort: 7001, WantErr: true},
+		// Deleting app-0 frees 7000 for app-2
+		{Op: OpDelete, Pod: podOnNode("app-0", "node-1")},
+		allocate("app-2"),
+	})
+
+	if got := snapshot["node-1/TCP"]; !slices.Equal(got, []int32{7000, 7001}) {
+		t.Errorf("node-1/TCP ports = %v, want [7000 7001]", got)
+	}
+}
+
+func TestReplay_Release(t *testing.T) {
+	udp := []allocator.PortRequest{
+		{Name: "voice", ContainerPort: 8081, Protocol: corev1.ProtocolUDP, Policy: allocator.PolicyDynamic},
+	}
+
+	snapshot := Replay(t, []Step{
+		{Op: OpAllocate, Pod: podOnNode("app-0", "node-1"), Requests: udp, MinPort: 7000, MaxPort: 7010},
+		{Op: OpRelease, Node: "node-1", Protocol: corev1.ProtocolUDP, Ports: []int32{7000}},
+	})
+
+	if got := snapshot["node-1/UDP"]; len(got) != 0 {
+		t.Errorf("node-1/UDP ports = %v, want none after release", got)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	pod := podOnNode("app-0", "node-1")
+	persist(pod, []allocator.PortRequest{
+		{Name: "game", ContainerPort: 8080, HostPort: 7000, Protocol: corev1.ProtocolTCP},
+		{ContainerPort: 9090, HostPort: 7001, Protocol: corev1.ProtocolUDP},
+	})
+
+	want := []corev1.ContainerPort{
+		{Name: "game", ContainerPort: 8080, HostPort: 7000, Protocol: corev1.ProtocolTCP},
+		{Name: "9090", ContainerPort: 9090, HostPort: 7001, Protocol: corev1.ProtocolUDP},
+	}
+	if got := pod.Spec.Containers[0].Ports; !slices.Equal(got, want) {
+		t.Errorf("persisted ports = %+v, want %+v", got, want)
+	}
+	for key, port := range map[string]string{"hostport.io/allocated-game": "7000", "hostport.io/allocated-9090-udp": "7001"} {
+		if got := pod.Annotations[key]; got != port {
+			t.Errorf("annotation %s = %q, want %q", key, got, port)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/SkynetNext/hostport-operator/internal/metrics"
+)
+
+// Policy computes the hostPort of one port request. Allocate dispatches each
+// request to the Policy registered under its PortPolicy, then applies the
+// common checks (never-allocate, reservations, conflicts) to the returned
+// port and marks it used, whatever the policy.
+type Policy interface {
+	Allocate(ctx context.Context, req *PolicyRequest) (int32, error)
+}
+
+// PolicyFunc adapts a function to the Policy interface
+type PolicyFunc func(ctx context.Context, req *PolicyRequest) (int32, error)
+
+// Allocate calls f
+func (f PolicyFunc) Allocate(ctx context.Context, req *PolicyRequest) (int32, error) {
+	return f(ctx, req)
+}
+
+// WithPolicy registers a Policy under name, so requests with that PortPolicy
+// are dispatched to it. It replaces a built-in policy of the same name.
+func WithPolicy(name PortPolicy, policy Policy) Option {
+	return func(a *Allocator) {
+		a.policies[name] = policy
+	}
+}
+
+// builtinPolicies returns the policies every Allocator starts with
+func builtinPolicies() map[PortPolicy]Policy {
+	return map[PortPolicy]Policy{
+		PolicyStatic:      PolicyFunc(staticPolicy),
+		PolicyPassthrough: PolicyFunc(passthroughPolicy),
+		PolicyIndex:       PolicyFunc(indexPolicy),
+		PolicyDynamic:     PolicyFunc(dynamicPolicy),
+		PolicyDaemonSet:   PolicyFunc(daemonSetPolicy),
+	}
+}
+
+// PolicyRequest is one port request of an Allocate call, with the parameters
+// of the call and read access to the node's port usage. Its Protocol is
+// defaulted to TCP. It is only valid during the Policy's Allocate call.
+type PolicyRequest struct {
+	PortRequest
+	// Position is the request's index among the pod's requests
+	Position int
+	// Requests are all the pod's requests, in order
+	Requests []PortRequest
+	Pod      *corev1.Pod
+	// NodeName is the node the pod runs on, "pending" before scheduling, or
+	// GlobalNodeName with WithGlobalConflictSpace
+	NodeName string
+	MinPort  int32
+	MaxPort  int32
+	Index    int32
+	Stride   int32
+
+	alloc *Allocator
+	batch *batchState
+}
+
+// batchState is shared by the requests of one Allocate call
+type batchState struct {
+	// stickyPorts are the previous ports of the pod, keyed like allocated annotations
+	stickyPorts map[string]int32
+	// nodeReserved are the ports the node advertises as reserved
+	nodeReserved []int32
+	// nodeSkip holds the ranges Dynamic never scans on this node
+	nodeSkip []PortRange
+	// reusedSticky and scanned tell whether the batch was served by sticky reuse
+	reusedSticky bool
+	scanned      bool
+}
+
+// errSkipped reports an Optional request left unallocated
+var errSkipped = errors.New("optional port skipped")
+
+// IsFree reports whether port can be handed out on the node for the
+// request's protocol.
+func (r *PolicyRequest) IsFree(port int32) bool {
+	return r.alloc.isFree(r.NodeName+"/"+string(r.Protocol), port)
+}
+
+func staticPolicy(_ context.Context, req *PolicyRequest) (int32, error) {
+	if req.HostPort == 0 {
+		metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "missing_hostport").Inc()
+		return 0, fmt.Errorf("static policy requires hostPort to be set in spec")
+	}
+	return req.HostPort, nil
+}
+
+func passthroughPolicy(_ context.Context, req *PolicyRequest) (int32, error) {
+	return req.ContainerPort, nil
+}
+
+// indexPolicy is the Agones-aligned deterministic stride logic:
+// pod-0 gets [min, min+stride), pod-1 gets [min+stride, min+2*stride).
+// With WithIndexFallback a taken port falls back to dynamicPolicy.
+func indexPolicy(ctx context.Context, req *PolicyRequest) (int32, error) {
+	portIdx := int32(req.Position)
+	if req.alloc.indexProtocolBands {
+		var err error
+		portIdx, err = protocolBandOffset(req.Requests, req.Position, req.Stride)
+		if err != nil {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "exceeds_max_port").Inc()
+			return 0, err
+		}
+	}
+	allocatedPort, err := IndexPort(req.MinPort, req.Index, req.Stride, portIdx)
+	if err != nil {
+		metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "exceeds_max_port").Inc()
+		return 0, err
+	}
+	if allocatedPort > req.MaxPort {
+		metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "exceeds_max_port").Inc()
+		return 0, fmt.Errorf("allocated port %d (index %d, port_idx %d) exceeds max-port %d", allocatedPort, req.Index, portIdx, req.MaxPort)
+	}
+	if req.alloc.indexFallback && !req.IsFree(allocatedPort) {
+		req.EffectivePolicy = PolicyDynamic
+		return dynamicPolicy(ctx, req)
+	}
+	return allocatedPort, nil
+}
+
+func dynamicPolicy(ctx context.Context, req *PolicyRequest) (int32, error) {
+	a, batch := req.alloc, req.batch
+	nodeName, protocol := req.NodeName, req.Protocol
+
+	// Stickiness Logic:
+	// Check if we found historical ports for this POD name during syncNodeState
+	name := req.Name
+	if name == "" {
+		// Unnamed ports are annotated by containerPort
+		name = strconv.Itoa(int(req.ContainerPort))
+	}
+	prevPort, exists := batch.stickyPorts[AllocationKey(name, protocol)]
+	if !exists {
+		// Annotations written before keys were protocol-qualified
+		prevPort, exists = batch.stickyPorts[req.Name]
+	}
+	if exists {
+		// Check if the previous port is still free on THIS node, as the scan
+		// would: not held, reserved, never-allocated or in another pod's grace
+		// period, else the pod is denied by the checks after the policy
+		inUse := a.isPortInUse(nodeName, protocol, prevPort)
+		free := !inUse && a.isFreeFor(nodeName+"/"+string(protocol), prevPort, podOwner(req.Pod))
+		pairFits := !req.PairWithNext || (prevPort%2 == 0 && req.IsFree(prevPort+1))
+		if free && pairFits && a.isFreeInAll(nodeName, req.PairProtocols, prevPort) &&
+			!slices.Contains(req.ExcludePorts, prevPort) && !slices.Contains(batch.nodeReserved, prevPort) {
+			batch.reusedSticky = true
+			return prevPort, nil
+		}
+		if inUse {
+			// Still held, e.g. by the old pod of a surge rollout: the pod churns to a new port
+			metrics.StickyRecoveryFailuresTotal.WithLabelValues(nodeName, string(protocol)).Inc()
+		}
+	}
+
+	batch.scanned = true
+	ranges := req.Ranges
+	if len(ranges) == 0 {
+		ranges = []PortRange{{Min: req.MinPort, Max: req.MaxPort}}
+	}
+	// skip adds the per-request exclusions to the node's skipped ranges
+	skip := slices.Clone(batch.nodeSkip)
+	for _, p := range req.ExcludePorts {
+		skip = append(skip, PortRange{Min: p, Max: p})
+	}
+	var offset int64
+	if a.hashedScanStart {
+		offset = scanOffset(req.Pod, req.ContainerPort)
+	}
+
+	ctx, endScan := a.startSpan(ctx, "scan")
+	defer endScan()
+
+	// Pools are scanned one after the other, each only once the previous is exhausted
+	tiers := [][]PortRange{ranges}
+	if len(req.Pools) > 0 {
+		tiers = tiers[:0]
+		for _, pool := range req.Pools {
+			tiers = append(tiers, []PortRange{pool})
+		}
+	}
+
+	var allocatedPort int32
+	var err error
+	for t, tier := range tiers {
+		last := t == len(tiers)-1
+		outside := excludeRanges(tier, skip)
+		tierOffset := offset
+		if hw, ok := a.highWater[nodeName+"/"+string(protocol)]; ok && a.rotatingScanStart {
+			tierOffset = positionAfter(outside, hw)
+		}
+		if len(outside) == 0 {
+			err = fmt.Errorf("%w: every port in ranges %v is excluded on node %s", ErrRangeExhausted, tier, nodeName)
+		} else if req.PairWithNext {
+			allocatedPort, err = a.findFreeNextPair(nodeName, protocol, outside)
+		} else if len(req.PairProtocols) > 0 {
+			allocatedPort, err = a.findFreePairPort(nodeName, req.PairProtocols, outside, tierOffset)
+		} else if allocatedPort, err = a.findFreePort(nodeName, protocol, outside, tierOffset); err != nil {
+			if last {
+				metrics.PortRangeExhausted.WithLabelValues(nodeName, string(protocol)).Set(1)
+				if widened, ok := a.widenRange(ctx, nodeName, protocol, outside, skip); ok {
+					allocatedPort, err = widened, nil
+				}
+			}
+		} else {
+			metrics.PortRangeExhausted.WithLabelValues(nodeName, string(protocol)).Set(0)
+		}
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		// Optional requests are reported back unallocated instead of failing the pod
+		if req.Optional {
+			metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "skipped").Inc()
+			return 0, errSkipped
+		}
+		metrics.PortAllocationErrorsTotal.WithLabelValues(string(req.Policy), "exhausted").Inc()
+		return 0, err
+	}
+	if a.rotatingScanStart {
+		a.highWater[nodeName+"/"+string(protocol)] = allocatedPort
+	}
+	return allocatedPort, nil
+}
+
+// daemonSetPolicy gives the i-th port of every pod of a DaemonSet the same
+// number on every node: a slot in the range hashed from the DaemonSet, plus
+// the port index. Pods without a DaemonSet owner hash their generateName.
+func daemonSetPolicy(_ context.Context, req *PolicyRequest) (int32, error) {
+	ranges := req.Ranges
+	if len(ranges) == 0 {
+		ranges = []PortRange{{Min: req.MinPort, Max: req.MaxPort}}
+	}
+	var size int64
+	for _, r := range ranges {
+		size += int64(r.Max) - int64(r.Min) + 1
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("%w: empty ranges %v", ErrRangeExhausted, ranges)
+	}
+
+	key := daemonSetOwner(req.Pod)
+	if key == "" {
+		key = req.Pod.Namespace + "/" + req.Pod.GenerateName
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	offset := (int64(h.Sum32()) + int64(req.Position)) % size
+	for _, r := range ranges {
+		if width := int64(r.Max) - int64(r.Min) + 1; offset >= width {
+			offset -= width
+			continue
+		}
+		return r.Min + int32(offset), nil
+	}
+	return 0, fmt.Errorf("%w: no port in ranges %v", ErrRangeExhausted, ranges)
+}
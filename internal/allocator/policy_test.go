@@ -0,0 +1,176 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAllocator_CustomPolicy(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	// "Descending" hands out the highest free port of the range
+	descending := PolicyFunc(func(_ context.Context, req *PolicyRequest) (int32, error) {
+		for p := req.MaxPort; p >= req.MinPort; p-- {
+			if req.IsFree(p) {
+				return p, nil
+			}
+		}
+		return 0, fmt.Errorf("%w: no free port in %d-%d", ErrRangeExhausted, req.MinPort, req.MaxPort)
+	})
+	alloc := NewAllocator(fakeClient, WithPolicy("Descending", descending))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	}
+	requests := []PortRequest{
+		{Name: "game", ContainerPort: 7777, Policy: "Descending"},
+		{Name: "query", ContainerPort: 27015, Policy: "Descending"},
+	}
+
+	result, err := alloc.Allocate(context.Background(), pod, requests, 7000, 7010, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	// Each port the policy returns is marked used before the next request
+	if result[0].HostPort != 7010 || result[1].HostPort != 7009 {
+		t.Errorf("Allocate() ports = %d, %d, want 7010, 7009", result[0].HostPort, result[1].HostPort)
+	}
+	if result[0].Protocol != corev1.ProtocolTCP {
+		t.Errorf("Allocate() protocol = %q, want TCP", result[0].Protocol)
+	}
+
+	// Unregistered policies are still rejected
+	requests[0].Policy = "Unknown"
+	if _, err := alloc.Allocate(context.Background(), pod, requests[:1], 7000, 7010, 0, 10); err == nil {
+		t.Error("Allocate() with an unregistered policy error = nil, want an error")
+	}
+}
+
+func TestAllocator_DaemonSetPolicy(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	alloc := NewAllocator(fakeClient)
+	ctx := context.Background()
+
+	dsPod := func(name, node string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:         name,
+				GenerateName: "agent-",
+				Namespace:    "monitoring",
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "agent", UID: "ds-uid", Controller: ptr.To(true)},
+				},
+			},
+			Spec: corev1.PodSpec{NodeName: node},
+		}
+	}
+	requests := []PortRequest{
+		{Name: "metrics", ContainerPort: 9100, Protocol: corev1.ProtocolTCP, Policy: PolicyDaemonSet},
+		{Name: "health", ContainerPort: 9101, Protocol: corev1.ProtocolTCP, Policy: PolicyDaemonSet},
+	}
+
+	first, err := alloc.Allocate(ctx, dsPod("agent-abcde", "node-1"), requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() on node-1 error = %v", err)
+	}
+	second, err := alloc.Allocate(ctx, dsPod("agent-fghij", "node-2"), requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() on node-2 error = %v", err)
+	}
+	for i := range requests {
+		if first[i].HostPort != second[i].HostPort {
+			t.Errorf("%s: node-1 got %d, node-2 got %d, want the same port", requests[i].Name, first[i].HostPort, second[i].HostPort)
+		}
+	}
+	if first[0].HostPort == first[1].HostPort {
+		t.Errorf("both ports got %d, want distinct ports", first[0].HostPort)
+	}
+
+	// The terminating old pod of node-1 doesn't block its replacement
+	old := dsPod("agent-abcde", "node-1")
+	old.Finalizers = []string{"test/hold"}
+	old.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{
+		{Name: "metrics", ContainerPort: first[0].HostPort, HostPort: first[0].HostPort},
+		{Name: "health", ContainerPort: first[1].HostPort, HostPort: first[1].HostPort},
+	}}}
+	if err := fakeClient.Create(ctx, old); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := fakeClient.Delete(ctx, old); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	replacement, err := alloc.Allocate(ctx, dsPod("agent-klmno", "node-1"), requests, 7000, 8000, 0, 10)
+	if err != nil {
+		t.Fatalf("Allocate() for the replacement error = %v", err)
+	}
+	if replacement[0].HostPort != first[0].HostPort {
+		t.Errorf("replacement got %d, want %d", replacement[0].HostPort, first[0].HostPort)
+	}
+}
+
+func TestAllocator_DaemonSetPolicyPending(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	alloc := NewAllocator(fakeClient)
+	ctx := context.Background()
+
+	// DaemonSet pods are admitted before the scheduler binds them
+	dsPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:         name,
+				GenerateName: "agent-",
+				Namespace:    "monitoring",
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "agent", UID: "ds-uid", Controller: ptr.To(true)},
+				},
+			},
+		}
+	}
+	requests := []PortRequest{{Name: "metrics", ContainerPort: 9100, Protocol: corev1.ProtocolTCP, Policy: PolicyDaemonSet}}
+	admit := func(pod *corev1.Pod) (int32, error) {
+		result, err := alloc.Allocate(ctx, pod, requests, 7000, 8000, 0, 10)
+		if err != nil {
+			return 0, err
+		}
+		pod.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{
+			{Name: "metrics", ContainerPort: result[0].HostPort, HostPort: result[0].HostPort},
+		}}}
+		if err := fakeClient.Create(ctx, pod); err != nil {
+			t.Fatalf("Create(%s) error = %v", pod.Name, err)
+		}
+		return result[0].HostPort, nil
+	}
+
+	var ports []int32
+	for _, name := range []string{"agent-a", "agent-b", "agent-c"} {
+		port, err := admit(dsPod(name))
+		if err != nil {
+			t.Fatalf("Allocate(%s) while pending error = %v", name, err)
+		}
+		ports = append(ports, port)
+	}
+	if ports[0] != ports[1] || ports[1] != ports[2] {
+		t.Errorf("pending DaemonSet pods got %v, want the same port", ports)
+	}
+
+	// A pod of another owner holding that port still conflicts while pending
+	static := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "static-0", Namespace: "monitoring"}}
+	staticReq := []PortRequest{{Name: "metrics", HostPort: ports[0], Protocol: corev1.ProtocolTCP, Policy: PolicyStatic}}
+	if _, err := alloc.Allocate(ctx, static, staticReq, 7000, 8000, 0, 10); err == nil {
+		t.Errorf("Allocate(Static %d) while pending expected a conflict, got nil", ports[0])
+	}
+}
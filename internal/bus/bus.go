@@ -0,0 +1,35 @@
+// Package bus publishes allocation and release events to a message bus, such
+// as Kafka or NATS, for external accounting. Transports implement Publisher.
+package bus
+
+// EventType tells whether a port was taken or given back
+type EventType string
+
+const (
+	EventAllocated EventType = "Allocated"
+	EventReleased  EventType = "Released"
+)
+
+// Event describes one host port changing hands on a node
+type Event struct {
+	Type      EventType `json:"type"`
+	Node      string    `json:"node"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Port      int32     `json:"port"`
+	Protocol  string    `json:"protocol"`
+}
+
+// Publisher sends events to a message bus. Publish is called once the
+// allocator's lock is released, on the admission path, so implementations
+// should still queue the event and deliver it in the background,
+// best-effort, handling their own errors.
+type Publisher interface {
+	Publish(e Event)
+}
+
+// Nop drops every event; it is the allocator's default Publisher
+type Nop struct{}
+
+// Publish does nothing
+func (Nop) Publish(Event) {}
@@ -0,0 +1,37 @@
+package bustest
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/SkynetNext/hostport-operator/internal/bus"
+)
+
+var _ bus.Publisher = (*Recorder)(nil)
+
+// Recorder is a bus.Publisher keeping every event it is given, for tests
+type Recorder struct {
+	mu     sync.Mutex
+	events []bus.Event
+}
+
+// Publish records the event
+func (r *Recorder) Publish(e bus.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// Events returns the events recorded so far, in publish order
+func (r *Recorder) Events() []bus.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.events)
+}
+
+// Reset forgets the recorded events
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
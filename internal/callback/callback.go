@@ -0,0 +1,92 @@
+package callback
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/SkynetNext/hostport-operator/internal/metrics"
+)
+
+// Event describes one allocated host port, posted to the callback URL
+type Event struct {
+	Node      string `json:"node"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Port      int32  `json:"port"`
+	Protocol  string `json:"protocol"`
+}
+
+// Notifier posts allocation events to an external service, such as a
+// firewall or SDN controller that opens rules for allocated ports. Delivery
+// is asynchronous and best-effort: it never delays or fails an admission.
+type Notifier struct {
+	URL    string
+	Client *http.Client
+	// Attempts is the number of deliveries tried per event
+	Attempts int
+	// Backoff is the wait before the first retry, doubled after each failure
+	Backoff time.Duration
+	Logger  logr.Logger
+}
+
+// NewNotifier returns a Notifier posting to url with 3 attempts per event
+func NewNotifier(url string, logger logr.Logger) *Notifier {
+	return &Notifier{
+		URL:      url,
+		Client:   &http.Client{Timeout: 5 * time.Second},
+		Attempts: 3,
+		Backoff:  time.Second,
+		Logger:   logger,
+	}
+}
+
+// Notify delivers the events in the background, one request per event
+func (n *Notifier) Notify(events ...Event) {
+	for _, e := range events {
+		go n.deliver(e)
+	}
+}
+
+func (n *Notifier) deliver(e Event) {
+	backoff := n.Backoff
+	var err error
+	for attempt := 1; attempt <= max(n.Attempts, 1); attempt++ {
+		if err = n.post(e); err == nil {
+			return
+		}
+		if attempt < n.Attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	metrics.AllocationCallbackFailuresTotal.Inc()
+	n.Logger.Error(err, "Allocation callback failed", "url", n.URL, "node", e.Node,
+		"pod", e.Namespace+"/"+e.Pod, "port", e.Port, "protocol", e.Protocol)
+}
+
+func (n *Notifier) post(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
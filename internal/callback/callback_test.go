@@ -0,0 +1,65 @@
+package callback
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/SkynetNext/hostport-operator/internal/metrics"
+)
+
+func TestNotifier_RetriesThenSucceeds(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt only
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	n := NewNotifier(server.URL, logr.Discard())
+	n.Backoff = time.Millisecond
+
+	before := testutil.ToFloat64(metrics.AllocationCallbackFailuresTotal)
+	n.deliver(Event{Node: "node-1", Namespace: "default", Pod: "app-0", Port: 7000, Protocol: "TCP"})
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("callback attempts = %d, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.AllocationCallbackFailuresTotal) - before; got != 0 {
+		t.Errorf("AllocationCallbackFailuresTotal increased by %v, want 0", got)
+	}
+}
+
+func TestNotifier_CountsFailures(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	n := NewNotifier(server.URL, logr.Discard())
+	n.Backoff = time.Millisecond
+
+	before := testutil.ToFloat64(metrics.AllocationCallbackFailuresTotal)
+	n.Notify(Event{Node: "node-1", Namespace: "default", Pod: "app-0", Port: 7000, Protocol: "TCP"})
+
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(_ context.Context) (bool, error) {
+		return testutil.ToFloat64(metrics.AllocationCallbackFailuresTotal)-before == 1, nil
+	})
+	if err != nil {
+		t.Fatalf("AllocationCallbackFailuresTotal not incremented: %v", err)
+	}
+	if got := calls.Load(); got != int32(n.Attempts) {
+		t.Errorf("callback attempts = %d, want %d", got, n.Attempts)
+	}
+}
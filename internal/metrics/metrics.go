@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -30,6 +32,54 @@ var (
 			Name: "hostport_conflicts_total",
 			Help: "Total number of port conflicts detected",
 		},
+		[]string{"node", "protocol", "policy"},
+	)
+
+	// ActiveAllocations counts the ports currently held in the allocator cache
+	// by pods allocated with each policy, moved by allocations and releases
+	ActiveAllocations = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hostport_active_allocations",
+			Help: "Number of host ports currently allocated, by policy",
+		},
+		[]string{"policy"},
+	)
+
+	// PortRangeExhausted reports 1 while a node/protocol has no free port left in the requested range
+	PortRangeExhausted = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hostport_range_exhausted",
+			Help: "Whether the port range for a node and protocol is exhausted (1) or not (0)",
+		},
+		[]string{"node", "protocol"},
+	)
+
+	// LargestFreeBlock reports the longest run of consecutive free ports in the
+	// fragmentation range for a node/protocol, as of the node's last sync
+	LargestFreeBlock = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hostport_largest_free_block_ports",
+			Help: "Longest run of consecutive free ports in the fragmentation range for a node and protocol",
+		},
+		[]string{"node", "protocol"},
+	)
+
+	// PortRangeWideningsTotal counts allocations served from an automatically widened range
+	PortRangeWideningsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hostport_range_widenings_total",
+			Help: "Total number of allocations served beyond max-port by automatic range widening",
+		},
+		[]string{"node", "protocol"},
+	)
+
+	// StickyRecoveryFailuresTotal counts Dynamic allocations that could not reuse a
+	// pod's previous port because it was still in use
+	StickyRecoveryFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hostport_sticky_recovery_failures_total",
+			Help: "Total number of Dynamic allocations whose previous port was still in use",
+		},
 		[]string{"node", "protocol"},
 	)
 
@@ -40,7 +90,26 @@ var (
 			Help:    "Duration of port allocation operations in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"policy"},
+		[]string{"policy", "sticky"}, // sticky: "true" when served by sticky reuse without a range scan
+	)
+
+	// PortScanDistance measures how many ports a Dynamic scan probed before it
+	// found a free one (or gave up); high values mean a fragmented range
+	PortScanDistance = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hostport_scan_distance_ports",
+			Help:    "Number of ports probed by a Dynamic scan before finding a free port",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 9), // 1 to 65536
+		},
+		[]string{"protocol"},
+	)
+
+	// AllocationCallbackFailuresTotal counts allocation callbacks dropped after all retries failed
+	AllocationCallbackFailuresTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hostport_allocation_callback_failures_total",
+			Help: "Total number of allocation callbacks that could not be delivered",
+		},
 	)
 
 	// WebhookRequestsTotal counts the total number of webhook requests
@@ -49,6 +118,34 @@ var (
 			Name: "hostport_webhook_requests_total",
 			Help: "Total number of webhook requests",
 		},
-		[]string{"result"}, // result: "allowed", "denied", "errored"
+		[]string{"result", "namespace"}, // result: "allowed", "denied", "errored"
 	)
 )
+
+// OtherNamespace is the namespace label used once MaxNamespaceLabels is reached
+const OtherNamespace = "other"
+
+// MaxNamespaceLabels caps the number of distinct namespace label values to
+// protect against unbounded cardinality. Namespaces beyond the cap are
+// reported as OtherNamespace.
+var MaxNamespaceLabels = 100
+
+var (
+	namespaceLabelsMu sync.Mutex
+	namespaceLabels   = make(map[string]struct{})
+)
+
+// NamespaceLabel returns the label value to record for a namespace
+func NamespaceLabel(namespace string) string {
+	namespaceLabelsMu.Lock()
+	defer namespaceLabelsMu.Unlock()
+
+	if _, ok := namespaceLabels[namespace]; ok {
+		return namespace
+	}
+	if len(namespaceLabels) >= MaxNamespaceLabels {
+		return OtherNamespace
+	}
+	namespaceLabels[namespace] = struct{}{}
+	return namespace
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -17,7 +22,10 @@ import (
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"github.com/SkynetNext/hostport-operator/controllers"
 	"github.com/SkynetNext/hostport-operator/internal/allocator"
+	"github.com/SkynetNext/hostport-operator/internal/callback"
+	"github.com/SkynetNext/hostport-operator/internal/metrics"
 	"github.com/SkynetNext/hostport-operator/webhooks"
 )
 
@@ -34,11 +42,176 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var sweepInterval time.Duration
+	var staleAllocationTTL time.Duration
+	var phantomResolution string
+	var systemPortMax int
+	var privilegedNamespaces string
+	var hashedDynamicScan bool
+	var rotatingDynamicScan bool
+	var excludeEphemeral bool
+	var freeTerminalPods bool
+	var indexProtocolBands bool
+	var exclusiveMaxPort bool
+	var indexFallback bool
+	var gallopingScan bool
+	var namespaceCap int
+	var enableTracing bool
+	var hostPortResource string
+	var adoptSelector string
+	var staticAllowedRanges string
+	var serviceProtocols bool
+	var decisionCacheTTL time.Duration
+	var secondaryPrefix string
+	var globalConflictSpace bool
+	var terminationGrace bool
+	var stuckTerminatingAfter time.Duration
+	var requireReadyNode bool
+	var mergePatch bool
+	var capacityLabel string
+	var capacityPortsPerPod int
+	var maintenanceWindows string
+	var maxPortsPerPod int
+	var protocolInference string
+	var allocationReportInterval time.Duration
+	var systemNamespaces string
+	var assignedNodeAnnotation string
+	var neverAllocatePorts string
+	var widenIncrement int
+	var widenCeiling int
+	var webhookPath string
+	var historySize int
+	var capacityRange string
+	var nodeCapacityInterval time.Duration
+	var callbackURL string
+	var annotatePresetPorts bool
+	var indexSources string
+	var utilizationWarn int
+	var nodePoolLabel string
+	var nodePoolRanges string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", true,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.DurationVar(&sweepInterval, "stale-sweep-interval", 5*time.Minute,
+		"How often cached port allocations are cross-checked against live pods.")
+	flag.DurationVar(&staleAllocationTTL, "stale-allocation-ttl", 10*time.Minute,
+		"How long a cached port allocation without a backing pod is kept before it is released.")
+	flag.StringVar(&phantomResolution, "cache-conflict-resolution", string(allocator.PhantomDrop),
+		"What a node resync does with cached ports of pods missing from a fresh List: "+
+			"\"drop\" frees them at once, \"keep\" holds them until --stale-allocation-ttl releases them.")
+	flag.IntVar(&systemPortMax, "system-port-max", 0,
+		"Highest port of the system band only privileged namespaces may use (e.g. 1023). 0 disables the band.")
+	flag.StringVar(&privilegedNamespaces, "privileged-namespaces", "kube-system",
+		"Comma-separated namespaces allowed to use ports in the system band.")
+	flag.BoolVar(&hashedDynamicScan, "hashed-dynamic-scan", false,
+		"Start Dynamic port scans at an offset hashed from the pod name and containerPort, "+
+			"so re-admission of the same pod returns the same port.")
+	flag.BoolVar(&rotatingDynamicScan, "rotating-dynamic-scan", false,
+		"Start Dynamic port scans past the port last allocated on the node, wrapping at the range end, "+
+			"so freed ports aren't reused immediately. Takes precedence over --hashed-dynamic-scan.")
+	flag.BoolVar(&excludeEphemeral, "exclude-ephemeral-ports", true,
+		"Keep Dynamic allocation out of the node's ephemeral port range (32768-60999, or the node's "+
+			allocator.AnnotationNodeEphemeralRange+" annotation).")
+	flag.BoolVar(&freeTerminalPods, "free-terminal-pod-ports", false,
+		"Deprecated: ports of Succeeded/Failed pods that won't restart are always free.")
+	flag.BoolVar(&indexProtocolBands, "index-protocol-bands", false,
+		"Split each Index stride block into one sub-band per protocol, so a pod's TCP and UDP ports are each contiguous.")
+	flag.BoolVar(&exclusiveMaxPort, "exclusive-max-port", false,
+		"Treat max-port as exclusive, so a 7000-8000 range holds 1000 ports (7000-7999).")
+	flag.BoolVar(&indexFallback, "index-fallback", false,
+		"Fall back to a Dynamic scan of the range when an Index port is already taken, instead of denying the pod.")
+	flag.StringVar(&assignedNodeAnnotation, "assigned-node-annotation", "",
+		"Pod annotation a scheduler sets to the target node before binding (e.g. scheduler.alpha/assigned-node); "+
+			"unbound pods carrying it are allocated against that node. Empty treats all unbound pods as pending.")
+	flag.BoolVar(&gallopingScan, "galloping-scan", false,
+		"Probe Dynamic ranges geometrically before scanning linearly; faster on very large, mostly used ranges, "+
+			"but the port found is not always the lowest free one.")
+	flag.IntVar(&namespaceCap, "namespace-port-cap", 0,
+		"Most hostPorts the pods of one namespace may hold across all nodes. 0 disables the cap.")
+	flag.StringVar(&hostPortResource, "node-hostport-resource", "",
+		"Node extended resource (e.g. hostport.io/host-ports) whose allocatable is the number of hostPorts the node can hold. "+
+			"Empty disables the check.")
+	flag.StringVar(&adoptSelector, "adopt-selector", "",
+		"Label selector of pods that set hostPorts themselves to bring under operator management. Empty disables adoption.")
+	flag.StringVar(&staticAllowedRanges, "static-allowed-ranges", "",
+		"Comma-separated min-max ranges hostPorts chosen by the pod author (Static, Passthrough, pinned or preset) must fall in, "+
+			"enforced by the validating webhook at "+webhooks.DefaultValidatingWebhookPath+". Empty disables the webhook. "+
+			"Its ValidatingWebhookConfiguration is not deployed by default: add validating_webhook.yaml to config/webhook/kustomization.yaml.")
+	flag.BoolVar(&serviceProtocols, "service-protocols", false,
+		"Fill in container ports without a protocol from the Services selecting the pod.")
+	flag.DurationVar(&decisionCacheTTL, "admission-retry-ttl", 0,
+		"How long a pod's allocation is replayed to admission retries instead of allocating again. 0 disables it.")
+	flag.StringVar(&secondaryPrefix, "secondary-annotation-prefix", "",
+		"Old annotation prefix (e.g. example.com/) whose allocated-* annotations are still read for sticky ports "+
+			"during a prefix migration. New annotations always use hostport.io/.")
+	flag.BoolVar(&globalConflictSpace, "global-conflict-space", false,
+		"Treat a hostPort held on any node as taken on every node, for CNIs that map hostPorts cluster-wide.")
+	flag.BoolVar(&terminationGrace, "termination-grace", false,
+		"Keep a released hostPort from being reused for the terminationGracePeriodSeconds of the pod that held it.")
+	flag.DurationVar(&stuckTerminatingAfter, "reclaim-stuck-terminating-after", 0,
+		"Free the hostPorts of pods still Terminating this long after their grace period ended (e.g. on a lost node). "+
+			"0 holds them until the pod is gone.")
+	flag.BoolVar(&requireReadyNode, "require-ready-node", false,
+		"Deny Dynamic and Index allocation for pods targeting a NotReady node.")
+	flag.StringVar(&maintenanceWindows, "maintenance-window", "",
+		"Comma-separated RFC 3339 start/end intervals (e.g. 2024-06-01T22:00:00Z/2024-06-02T02:00:00Z) "+
+			"during which Dynamic and Index allocation is denied. Static ports are still granted.")
+	flag.IntVar(&capacityPortsPerPod, "node-capacity-ports-per-pod", 0,
+		"Scale the Dynamic range on each node to this many ports per pod the node can run, counted from min-port. "+
+			"0 uses the whole range on every node.")
+	flag.StringVar(&capacityLabel, "node-capacity-label", "",
+		"Node label holding the number of pods the node can run, for --node-capacity-ports-per-pod. "+
+			"Nodes without it use their allocatable pods.")
+	flag.BoolVar(&mergePatch, "merge-patch", false,
+		"Answer admission requests with a JSON merge patch instead of a JSON patch, for callers other than the API server, "+
+			"which only accepts JSON patches.")
+	flag.IntVar(&maxPortsPerPod, "max-ports-per-pod", 0,
+		"Most hostPorts one pod may request; pods over it are denied before allocation. "+
+			"The "+webhooks.AnnotationMaxPorts+" annotation may lower it per pod. 0 disables the cap.")
+	flag.StringVar(&protocolInference, "protocol-inference", "",
+		"Comma-separated pattern=protocol rules (e.g. *-udp=UDP,dns=UDP) inferring the protocol of ports without one "+
+			"from their name; the first match wins. Empty disables inference.")
+	flag.DurationVar(&allocationReportInterval, "allocation-report-interval", 0,
+		"How often the "+controllers.AllocationReportName+" ConfigMap listing each namespace's pod hostPorts is refreshed. "+
+			"0 disables the reports.")
+	flag.BoolVar(&enableTracing, "enable-allocation-tracing", false,
+		"Record OpenTelemetry spans around allocation, as children of the admission request's span.")
+	flag.StringVar(&systemNamespaces, "system-namespaces", strings.Join(webhooks.DefaultSystemNamespaces, ","),
+		"Comma-separated namespaces whose pods are never mutated, even when annotated.")
+	flag.StringVar(&neverAllocatePorts, "never-allocate-ports", "",
+		"Comma-separated ports or ranges that are never allocated, whatever the pod requests. "+
+			"Recommended: 22,6443,10250 (SSH, the API server and the kubelet) when the port range reaches them.")
+	flag.IntVar(&widenIncrement, "range-widen-increment", 0,
+		"When a Dynamic range is exhausted, extend its max port by this many ports (with a warning). 0 disables widening.")
+	flag.IntVar(&widenCeiling, "range-widen-ceiling", 0,
+		"Highest port automatic range widening may reach.")
+	flag.StringVar(&webhookPath, "webhook-path", webhooks.DefaultWebhookPath,
+		"The path the mutating webhook is served on.")
+	flag.IntVar(&historySize, "allocation-history-size", 0,
+		"Number of past allocations recorded per pod name in the hostport.io/history annotation, kept across pods in the "+
+			webhooks.HistoryConfigMapName+" ConfigMap of the namespace. 0 disables history.")
+	flag.StringVar(&callbackURL, "allocation-callback-url", "",
+		"URL every allocated host port is POSTed to (best-effort, asynchronous), e.g. for a firewall manager. Empty disables callbacks.")
+	flag.BoolVar(&annotatePresetPorts, "annotate-preset-ports", false,
+		"Record hostPorts already set in a pod spec as hostport.io/preset-<name> annotations.")
+	flag.StringVar(&indexSources, "index-sources", "index-label,annotation,pod-index,name",
+		"Comma-separated order in which the Index policy ordinal is resolved: the first source present on the pod wins.")
+	flag.IntVar(&utilizationWarn, "utilization-warning-percent", 90,
+		"Warn in admission responses when an allocation leaves the node's port range at least this percent full. 0 disables the warning.")
+	flag.DurationVar(&nodeCapacityInterval, "node-capacity-interval", 0,
+		"How often each Node's "+controllers.AnnotationCapacity+" annotation is refreshed from its pods' hostPorts. "+
+			"0 disables the annotation.")
+	flag.StringVar(&capacityRange, "capacity-range", "7000-8000",
+		"Port range (min-max) free ports are counted in for the hostport.io/capacity node annotation "+
+			"and the largest free block metric.")
+	flag.StringVar(&nodePoolLabel, "node-pool-label", "",
+		"Node label whose value selects a default port range from --node-pool-ranges.")
+	flag.StringVar(&nodePoolRanges, "node-pool-ranges", "",
+		"Comma-separated pool=min-max default port ranges per node pool, e.g. gaming=30000-30999.")
+	flag.IntVar(&metrics.MaxNamespaceLabels, "metrics-max-namespaces", 100,
+		"Maximum number of distinct namespace label values on webhook metrics; the rest are reported as \"other\".")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -76,12 +249,224 @@ func main() {
 	}
 
 	// Setup Mutating Webhook for Pod hostPort allocation
-	alloc := allocator.NewAllocator(mgr.GetClient())
-	if err = webhooks.SetupWithManager(mgr, alloc); err != nil {
+	neverAllocate, err := allocator.ParsePorts(neverAllocatePorts)
+	if err != nil {
+		setupLog.Error(err, "invalid --never-allocate-ports")
+		os.Exit(1)
+	}
+	capacityRanges, err := webhooks.ParsePortRanges(capacityRange)
+	if err == nil && len(capacityRanges) != 1 {
+		err = fmt.Errorf("want a single min-max range, got %q", capacityRange)
+	}
+	if err != nil {
+		setupLog.Error(err, "invalid --capacity-range")
+		os.Exit(1)
+	}
+	capacity := capacityRanges[0]
+	allocOpts := []allocator.Option{
+		allocator.WithSystemPortBand(int32(systemPortMax), strings.Split(privilegedNamespaces, ",")...),
+		allocator.WithNeverAllocate(neverAllocate...),
+		allocator.WithRangeWidening(int32(widenIncrement), int32(widenCeiling)),
+		allocator.WithNamespaceCap(namespaceCap),
+		allocator.WithFragmentationRange(capacity),
+	}
+	if hashedDynamicScan {
+		allocOpts = append(allocOpts, allocator.WithHashedScanStart())
+	}
+	if rotatingDynamicScan {
+		allocOpts = append(allocOpts, allocator.WithRotatingScanStart())
+	}
+	if freeTerminalPods {
+		setupLog.Info("--free-terminal-pod-ports is deprecated: terminal pods' ports are always free")
+	}
+	if indexProtocolBands {
+		allocOpts = append(allocOpts, allocator.WithIndexProtocolBands())
+	}
+	if exclusiveMaxPort {
+		allocOpts = append(allocOpts, allocator.WithExclusiveMaxPort())
+	}
+	if indexFallback {
+		allocOpts = append(allocOpts, allocator.WithIndexFallback())
+	}
+	if assignedNodeAnnotation != "" {
+		allocOpts = append(allocOpts, allocator.WithAssignedNodeAnnotation(assignedNodeAnnotation))
+	}
+	if gallopingScan {
+		allocOpts = append(allocOpts, allocator.WithGallopingScan())
+	}
+	if hostPortResource != "" {
+		allocOpts = append(allocOpts, allocator.WithHostPortResource(corev1.ResourceName(hostPortResource)))
+	}
+	if capacityPortsPerPod > 0 {
+		allocOpts = append(allocOpts, allocator.WithCapacityScaledRange(capacityLabel, int32(capacityPortsPerPod)))
+	}
+	if requireReadyNode {
+		allocOpts = append(allocOpts, allocator.WithNodeReadinessCheck())
+	}
+	for _, val := range strings.Split(maintenanceWindows, ",") {
+		if strings.TrimSpace(val) == "" {
+			continue
+		}
+		window, err := allocator.ParseTimeWindow(val)
+		if err != nil {
+			setupLog.Error(err, "invalid --maintenance-window")
+			os.Exit(1)
+		}
+		allocOpts = append(allocOpts, allocator.WithMaintenanceWindow(window))
+	}
+	switch resolution := allocator.PhantomResolution(phantomResolution); resolution {
+	case allocator.PhantomDrop, allocator.PhantomKeep:
+		allocOpts = append(allocOpts, allocator.WithPhantomResolution(resolution))
+	default:
+		setupLog.Error(fmt.Errorf("want %q or %q, got %q", allocator.PhantomDrop, allocator.PhantomKeep, phantomResolution),
+			"invalid --cache-conflict-resolution")
+		os.Exit(1)
+	}
+	if stuckTerminatingAfter > 0 {
+		allocOpts = append(allocOpts, allocator.WithStuckTerminatingReclaim(stuckTerminatingAfter))
+	}
+	if terminationGrace {
+		allocOpts = append(allocOpts, allocator.WithTerminationGrace())
+	}
+	if globalConflictSpace {
+		allocOpts = append(allocOpts, allocator.WithGlobalConflictSpace())
+	}
+	if secondaryPrefix != "" {
+		allocOpts = append(allocOpts, allocator.WithSecondaryAnnotationPrefix(secondaryPrefix))
+	}
+	if serviceProtocols {
+		allocOpts = append(allocOpts, allocator.WithServiceProtocols())
+	}
+	if enableTracing {
+		allocOpts = append(allocOpts, allocator.WithTracing())
+	}
+	if !excludeEphemeral {
+		allocOpts = append(allocOpts, allocator.WithoutEphemeralExclusion())
+	}
+	alloc := allocator.NewAllocator(mgr.GetClient(), allocOpts...)
+	if err = mgr.Add(alloc); err != nil {
+		setupLog.Error(err, "unable to add allocator warmup")
+		os.Exit(1)
+	}
+	poolRanges, err := webhooks.ParseNodePoolRanges(nodePoolRanges)
+	if err != nil {
+		setupLog.Error(err, "invalid --node-pool-ranges")
+		os.Exit(1)
+	}
+	sources, err := webhooks.ParseIndexSources(indexSources)
+	if err != nil {
+		setupLog.Error(err, "invalid --index-sources")
+		os.Exit(1)
+	}
+	protocolRules, err := webhooks.ParseProtocolRules(protocolInference)
+	if err != nil {
+		setupLog.Error(err, "invalid --protocol-inference")
+		os.Exit(1)
+	}
+	webhookOpts := []webhooks.MutatorOption{
+		webhooks.WithNodePoolRanges(nodePoolLabel, poolRanges),
+		webhooks.WithAllocationHistory(historySize),
+		webhooks.WithIndexSources(sources),
+		webhooks.WithUtilizationWarning(utilizationWarn),
+		webhooks.WithSystemNamespaces(splitList(systemNamespaces)...),
+		webhooks.WithDecisionCache(decisionCacheTTL),
+		webhooks.WithMaxPortsPerPod(maxPortsPerPod),
+		webhooks.WithProtocolInference(protocolRules...),
+	}
+	if mergePatch {
+		webhookOpts = append(webhookOpts, webhooks.WithMergePatch())
+	}
+	if annotatePresetPorts {
+		webhookOpts = append(webhookOpts, webhooks.WithPresetPortAnnotations())
+	}
+	if callbackURL != "" {
+		webhookOpts = append(webhookOpts, webhooks.WithAllocationCallback(
+			callback.NewNotifier(callbackURL, ctrl.Log.WithName("callback"))))
+	}
+	if err = webhooks.SetupWithManager(mgr, alloc, webhookPath, webhookOpts...); err != nil {
 		setupLog.Error(err, "unable to setup webhook")
 		os.Exit(1)
 	}
 
+	if staticAllowedRanges != "" {
+		allowed, err := webhooks.ParsePortRanges(staticAllowedRanges)
+		if err != nil || len(allowed) == 0 {
+			setupLog.Error(err, "invalid --static-allowed-ranges")
+			os.Exit(1)
+		}
+		webhooks.RegisterValidator(mgr.GetWebhookServer(), "", webhooks.NewPodValidator(mgr.GetScheme(), allowed...))
+	}
+
+	if err = (&controllers.StaleAllocationSweeper{
+		Allocator: alloc,
+		Interval:  sweepInterval,
+		TTL:       staleAllocationTTL,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to setup stale allocation sweeper")
+		os.Exit(1)
+	}
+
+	if err = (&controllers.PodPhaseReconciler{
+		Client:    mgr.GetClient(),
+		Allocator: alloc,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PodPhase")
+		os.Exit(1)
+	}
+
+	if err = (&controllers.NodeReconciler{
+		Client:    mgr.GetClient(),
+		Allocator: alloc,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Node")
+		os.Exit(1)
+	}
+
+	if err = (&controllers.StatefulSetReconciler{
+		Client:    mgr.GetClient(),
+		Allocator: alloc,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "StatefulSet")
+		os.Exit(1)
+	}
+
+	if adoptSelector != "" {
+		selector, err := labels.Parse(adoptSelector)
+		if err != nil {
+			setupLog.Error(err, "invalid --adopt-selector")
+			os.Exit(1)
+		}
+		if err = (&controllers.PodAdoptionReconciler{
+			Client:    mgr.GetClient(),
+			Allocator: alloc,
+			Selector:  selector,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PodAdoption")
+			os.Exit(1)
+		}
+	}
+
+	if allocationReportInterval > 0 {
+		if err = (&controllers.AllocationReportReconciler{
+			Client:       mgr.GetClient(),
+			ResyncPeriod: allocationReportInterval,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "AllocationReport")
+			os.Exit(1)
+		}
+	}
+
+	if nodeCapacityInterval > 0 {
+		if err = (&controllers.NodeCapacityReconciler{
+			Client:       mgr.GetClient(),
+			Range:        capacity,
+			ResyncPeriod: nodeCapacityInterval,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "NodeCapacity")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -90,6 +475,10 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("allocator", alloc.ReadyzCheck); err != nil {
+		setupLog.Error(err, "unable to set up allocator ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -97,3 +486,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,146 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	mergepatch "github.com/evanphx/json-patch/v5"
+	"gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// PatchTypeMergePatch is the admission response patch type of a JSON merge
+// patch (RFC 7386), see WithMergePatch
+const PatchTypeMergePatch admissionv1.PatchType = "MergePatch"
+
+// buildPatch returns the JSON patch turning original into mutated, limited to
+// the fields the mutator changes: hostNetwork, affinity, container ports and
+// annotations. Operations come in a stable order so identical allocations
+// always produce identical patches.
+func buildPatch(original, mutated *corev1.Pod) []jsonpatch.JsonPatchOperation {
+	var ops []jsonpatch.JsonPatchOperation
+
+	if mutated.Spec.HostNetwork && !original.Spec.HostNetwork {
+		ops = append(ops, jsonpatch.NewOperation("add", "/spec/hostNetwork", true))
+	}
+
+	if !equality.Semantic.DeepEqual(original.Spec.Affinity, mutated.Spec.Affinity) {
+		ops = append(ops, jsonpatch.NewOperation(addOrReplace(original.Spec.Affinity != nil), "/spec/affinity", mutated.Spec.Affinity))
+	}
+
+	for i := range mutated.Spec.Containers {
+		ops = append(ops, portOps(i, original.Spec.Containers[i].Ports, mutated.Spec.Containers[i].Ports)...)
+	}
+
+	ops = append(ops, annotationOps(original.Annotations, mutated.Annotations)...)
+	return ops
+}
+
+// buildMergePatch returns the JSON merge patch turning original into mutated,
+// limited to the same fields as buildPatch. A merge patch replaces lists
+// whole, so it carries every container, with only their ports changed.
+func buildMergePatch(original, mutated *corev1.Pod) ([]byte, error) {
+	limited := original.DeepCopy()
+	limited.Spec.HostNetwork = mutated.Spec.HostNetwork
+	limited.Spec.Affinity = mutated.Spec.Affinity
+	for i := range limited.Spec.Containers {
+		limited.Spec.Containers[i].Ports = mutated.Spec.Containers[i].Ports
+	}
+	limited.Annotations = mutated.Annotations
+
+	before, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	after, err := json.Marshal(limited)
+	if err != nil {
+		return nil, err
+	}
+	return mergepatch.CreateMergePatch(before, after)
+}
+
+// mergePatched is admission.Patched for a merge patch
+func mergePatched(patch []byte) admission.Response {
+	return admission.Response{
+		AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed:   true,
+			Patch:     patch,
+			PatchType: ptr.To(PatchTypeMergePatch),
+		},
+	}
+}
+
+// portOps patches the ports of the i-th container field by field, appending
+// any port entries added by the mutator
+func portOps(i int, original, mutated []corev1.ContainerPort) []jsonpatch.JsonPatchOperation {
+	base := fmt.Sprintf("/spec/containers/%d/ports", i)
+	if len(original) == 0 {
+		if len(mutated) == 0 {
+			return nil
+		}
+		return []jsonpatch.JsonPatchOperation{jsonpatch.NewOperation("add", base, mutated)}
+	}
+
+	var ops []jsonpatch.JsonPatchOperation
+	for j := range original {
+		path := fmt.Sprintf("%s/%d", base, j)
+		before, after := original[j], mutated[j]
+		if after.ContainerPort != before.ContainerPort {
+			ops = append(ops, jsonpatch.NewOperation("replace", path+"/containerPort", after.ContainerPort))
+		}
+		if after.HostPort != before.HostPort {
+			ops = append(ops, jsonpatch.NewOperation(addOrReplace(before.HostPort != 0), path+"/hostPort", after.HostPort))
+		}
+		if after.Protocol != before.Protocol {
+			ops = append(ops, jsonpatch.NewOperation(addOrReplace(before.Protocol != ""), path+"/protocol", after.Protocol))
+		}
+	}
+	for _, port := range mutated[len(original):] {
+		ops = append(ops, jsonpatch.NewOperation("add", base+"/-", port))
+	}
+	return ops
+}
+
+// annotationOps adds or replaces the annotations that differ, in key order
+func annotationOps(original, mutated map[string]string) []jsonpatch.JsonPatchOperation {
+	if len(original) == 0 {
+		if len(mutated) == 0 {
+			return nil
+		}
+		return []jsonpatch.JsonPatchOperation{jsonpatch.NewOperation("add", "/metadata/annotations", mutated)}
+	}
+
+	keys := make([]string, 0, len(mutated))
+	for key := range mutated {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var ops []jsonpatch.JsonPatchOperation
+	for _, key := range keys {
+		before, existed := original[key]
+		if existed && before == mutated[key] {
+			continue
+		}
+		ops = append(ops, jsonpatch.NewOperation(addOrReplace(existed), "/metadata/annotations/"+escapePointer(key), mutated[key]))
+	}
+	return ops
+}
+
+func addOrReplace(exists bool) string {
+	if exists {
+		return "replace"
+	}
+	return "add"
+}
+
+// escapePointer escapes a JSON pointer reference token (RFC 6901)
+func escapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
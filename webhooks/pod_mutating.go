@@ -2,14 +2,25 @@ package webhooks
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -17,60 +28,315 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	"github.com/SkynetNext/hostport-operator/internal/allocator"
+	"github.com/SkynetNext/hostport-operator/internal/callback"
 	"github.com/SkynetNext/hostport-operator/internal/metrics"
 )
 
 const (
-	AnnotationEnabled         = "hostport.io/enabled"
-	AnnotationPolicy          = "hostport.io/policy"
-	AnnotationMinPort         = "hostport.io/min-port"
-	AnnotationMaxPort         = "hostport.io/max-port"
-	AnnotationStride          = "hostport.io/stride"
-	AnnotationAllocatedPrefix = "hostport.io/allocated-"
+	AnnotationEnabled               = "hostport.io/enabled"
+	AnnotationPolicy                = "hostport.io/policy"
+	AnnotationMinPort               = "hostport.io/min-port"
+	AnnotationMaxPort               = "hostport.io/max-port"
+	AnnotationRange                 = "hostport.io/range"
+	AnnotationStride                = "hostport.io/stride"
+	AnnotationBlocks                = "hostport.io/blocks"
+	AnnotationExcludePorts          = "hostport.io/exclude-ports"
+	AnnotationDynamicCount          = "hostport.io/dynamic-count"
+	AnnotationAllocatedPrefix       = "hostport.io/allocated-"
+	AnnotationPresetPrefix          = "hostport.io/preset-"
+	AnnotationProtocolPrefix        = "hostport.io/protocol-"
+	AnnotationPinPrefix             = "hostport.io/pin-"
+	AnnotationStaticPrefix          = "hostport.io/static-"
+	AnnotationPreserveContainerPort = "hostport.io/preserve-container-port"
+	AnnotationIndexFromLabel        = "hostport.io/index-from-label"
+	AnnotationIndex                 = "hostport.io/index"
+	AnnotationMode                  = "hostport.io/mode"
+	AnnotationPartial               = "hostport.io/partial"
+	AnnotationSkipped               = "hostport.io/skipped"
+	AnnotationFallback              = "hostport.io/fallback"
+	AnnotationPools                 = "hostport.io/pools"
+	AnnotationPartition             = "hostport.io/partition"
+	AnnotationCandidateNodes        = "hostport.io/candidate-nodes"
+	AnnotationPartitionOffset       = "hostport.io/partition-offset"
+	AnnotationHistory               = "hostport.io/history"
+	AnnotationMaxPorts              = "hostport.io/max-ports"
+	AnnotationDiagnostics           = "hostport.io/diagnostics"
+	AnnotationDualStack             = "hostport.io/dual-stack"
+)
+
+// Causes in the status details of a denial with AnnotationDiagnostics
+const (
+	// CauseTypeAllocation carries the reason the allocation failed
+	CauseTypeAllocation metav1.CauseType = "HostPortAllocation"
+	// CauseTypeNodeUtilization carries how full the node's range is
+	CauseTypeNodeUtilization metav1.CauseType = "NodeUtilization"
+)
+
+// HistoryConfigMapName is the ConfigMap in each namespace holding the
+// allocation history of its pod names, keyed by pod name, for
+// WithAllocationHistory
+const HistoryConfigMapName = "hostport-allocation-history"
+
+// LabelPodIndex is set on StatefulSet pods by Kubernetes 1.28+
+const LabelPodIndex = "apps.kubernetes.io/pod-index"
+
+// IndexSource is one place the Index policy ordinal can be read from
+type IndexSource string
+
+const (
+	// IndexSourceLabel reads the label named by AnnotationIndexFromLabel
+	IndexSourceLabel IndexSource = "index-label"
+	// IndexSourceAnnotation reads AnnotationIndex
+	IndexSourceAnnotation IndexSource = "annotation"
+	// IndexSourcePodIndex reads LabelPodIndex
+	IndexSourcePodIndex IndexSource = "pod-index"
+	// IndexSourceName reads the numeric suffix of the pod name (app-0, app-1...)
+	IndexSourceName IndexSource = "name"
+)
+
+// DefaultIndexSources is the precedence used unless WithIndexSources is given
+var DefaultIndexSources = []IndexSource{IndexSourceLabel, IndexSourceAnnotation, IndexSourcePodIndex, IndexSourceName}
+
+// DefaultSystemNamespaces are left alone unless WithSystemNamespaces is given
+var DefaultSystemNamespaces = []string{"kube-system", "kube-node-lease"}
+
+// maxDynamicCount caps AnnotationDynamicCount so one pod can't drain a node's range
+const maxDynamicCount = 64
+
+const (
+	// ModeBestEffort admits the pod unchanged when its range is exhausted instead of denying it
+	ModeBestEffort = "best-effort"
 )
 
 type PodMutator struct {
 	Client    client.Client
 	decoder   *admission.Decoder
 	allocator *allocator.Allocator
+	// poolLabel is the node label selecting a pool range from poolRanges
+	poolLabel  string
+	poolRanges map[string]allocator.PortRange
+	// historySize caps the entries kept in AnnotationHistory; 0 disables history
+	historySize int
+	// notifier, if set, is told about every successful allocation
+	notifier *callback.Notifier
+	// annotatePreset records hostPorts already set in the spec under AnnotationPresetPrefix
+	annotatePreset bool
+	// indexSources is the order the pod index is resolved in
+	indexSources []IndexSource
+	// systemNamespaces are never mutated, whatever their pods' annotations
+	systemNamespaces map[string]bool
+	// utilizationWarn is the percentage of a range in use past which admission
+	// responses carry a warning; 0 disables the warning
+	utilizationWarn int
+	// decisionTTL is how long a successful response is replayed for admission
+	// retries of the same pod (see decisionKey); 0 disables the cache
+	decisionTTL time.Duration
+	decisionsMu sync.Mutex
+	decisions   map[string]cachedDecision
+	// maxPortsPerPod is the most hostPorts one pod may request; 0 disables the cap
+	maxPortsPerPod int
+	// protocolRules infer the protocol of ports without one from their name
+	protocolRules []ProtocolRule
+	// mergePatch answers with a JSON merge patch instead of a JSON patch
+	mergePatch bool
+}
+
+// ProtocolRule gives ports whose name matches Pattern (a path.Match glob,
+// e.g. "*-udp") the Protocol, when they don't set one
+type ProtocolRule struct {
+	Pattern  string
+	Protocol corev1.Protocol
+}
+
+// cachedDecision is a response replayed to retries of the same pod
+type cachedDecision struct {
+	resp    admission.Response
+	expires time.Time
+	// pod and allocated are the mutated pod and its ports, to check the
+	// allocator still holds them before the response is replayed
+	pod       *corev1.Pod
+	allocated []allocator.PortRequest
+}
+
+// MutatorOption configures a PodMutator
+type MutatorOption func(*PodMutator)
+
+// WithNodePoolRanges makes the default port range depend on the value of the
+// given label on the pod's node (or the pod's nodeSelector while pending).
+// Pod annotations still take precedence.
+func WithNodePoolRanges(labelKey string, ranges map[string]allocator.PortRange) MutatorOption {
+	return func(m *PodMutator) {
+		m.poolLabel = labelKey
+		m.poolRanges = ranges
+	}
+}
+
+// WithAllocationHistory records the last size allocation decisions for a pod
+// name in AnnotationHistory, to help debug churn across rollouts. The history
+// outlives each pod in the namespace's HistoryConfigMapName ConfigMap.
+func WithAllocationHistory(size int) MutatorOption {
+	return func(m *PodMutator) {
+		m.historySize = size
+	}
+}
+
+// WithIndexSources sets the order in which the pod index is resolved; the
+// first source present on the pod wins.
+func WithIndexSources(sources []IndexSource) MutatorOption {
+	return func(m *PodMutator) {
+		m.indexSources = sources
+	}
+}
+
+// WithSystemNamespaces replaces the namespaces whose pods are admitted
+// unchanged even when annotated for allocation.
+func WithSystemNamespaces(namespaces ...string) MutatorOption {
+	return func(m *PodMutator) {
+		m.systemNamespaces = make(map[string]bool, len(namespaces))
+		for _, ns := range namespaces {
+			m.systemNamespaces[ns] = true
+		}
+	}
+}
+
+// WithUtilizationWarning adds an admission warning whenever an allocation
+// leaves the node's range for a protocol at least percent full, so teams get
+// notice before the range is exhausted.
+func WithUtilizationWarning(percent int) MutatorOption {
+	return func(m *PodMutator) {
+		m.utilizationWarn = percent
+	}
+}
+
+// WithDecisionCache replays the response of a successful allocation when the
+// same pod is admitted again within ttl, e.g. when the API server retries
+// a timed out admission, so the retry gets the same hostPorts instead of a
+// second allocation.
+func WithDecisionCache(ttl time.Duration) MutatorOption {
+	return func(m *PodMutator) {
+		m.decisionTTL = ttl
+	}
+}
+
+// WithMaxPortsPerPod denies pods requesting more than limit hostPorts,
+// e.g. a misconfigured dynamic-count, before anything is allocated. A pod's
+// AnnotationMaxPorts may lower its own cap, but never raise it.
+func WithMaxPortsPerPod(limit int) MutatorOption {
+	return func(m *PodMutator) {
+		m.maxPortsPerPod = limit
+	}
+}
+
+// WithProtocolInference infers the protocol of ports without one from their
+// name, by the first matching rule, e.g. UDP for "game-udp" with "*-udp=UDP".
+// AnnotationProtocolPrefix overrides still win.
+func WithProtocolInference(rules ...ProtocolRule) MutatorOption {
+	return func(m *PodMutator) {
+		m.protocolRules = rules
+	}
+}
+
+// WithMergePatch answers with a JSON merge patch (PatchTypeMergePatch) of the
+// same fields instead of a JSON patch, for callers of the webhook that can't
+// apply JSON patches. The API server itself only accepts JSON patches, so
+// leave it off for a MutatingWebhookConfiguration.
+func WithMergePatch() MutatorOption {
+	return func(m *PodMutator) {
+		m.mergePatch = true
+	}
 }
 
-func NewPodMutator(client client.Client, scheme *runtime.Scheme, alloc *allocator.Allocator) *PodMutator {
-	return &PodMutator{
+// WithPresetPortAnnotations records hostPorts the pod spec already sets
+// (e.g. hostPort == containerPort from a chart) as hostport.io/preset-<name>
+// annotations, next to the allocated ones.
+func WithPresetPortAnnotations() MutatorOption {
+	return func(m *PodMutator) {
+		m.annotatePreset = true
+	}
+}
+
+// WithAllocationCallback reports every allocated port to an external service
+// through the notifier, asynchronously and best-effort.
+func WithAllocationCallback(notifier *callback.Notifier) MutatorOption {
+	return func(m *PodMutator) {
+		m.notifier = notifier
+	}
+}
+
+func NewPodMutator(client client.Client, scheme *runtime.Scheme, alloc *allocator.Allocator, opts ...MutatorOption) *PodMutator {
+	m := &PodMutator{
 		Client:    client,
 		decoder:   admission.NewDecoder(scheme),
 		allocator: alloc,
+		decisions: make(map[string]cachedDecision),
+	}
+	WithSystemNamespaces(DefaultSystemNamespaces...)(m)
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
 }
 
 func (m *PodMutator) Handle(ctx context.Context, req admission.Request) admission.Response {
 	logger := log.FromContext(ctx)
 	pod := &corev1.Pod{}
 	if err := m.decoder.Decode(req, pod); err != nil {
-		metrics.WebhookRequestsTotal.WithLabelValues("errored").Inc()
+		recordRequest(req, "errored")
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
 	if pod.Annotations[AnnotationEnabled] != "true" {
-		metrics.WebhookRequestsTotal.WithLabelValues("allowed").Inc()
+		recordRequest(req, "allowed")
 		return admission.Allowed("hostPort allocation not enabled")
 	}
 
+	namespace := pod.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+	if m.systemNamespaces[namespace] {
+		recordRequest(req, "allowed")
+		return admission.Allowed(fmt.Sprintf("namespace %s is a system namespace, hostPort allocation skipped", namespace))
+	}
+
+	decision := decisionKey(namespace, pod, req)
+	if resp, ok := m.cachedDecision(decision); ok && !isDryRun(req) {
+		logger.V(1).Info("Replaying allocation for admission retry", "key", decision)
+		recordRequest(req, "allowed")
+		return resp
+	}
+
+	// original is kept to patch only what the mutation changes
+	original := pod.DeepCopy()
+
 	// 1. Configuration Parsing
-	minPort := int32(7000)
+	minPort, maxPort := int32(7000), int32(8000)
+	if r, ok := m.nodePoolRange(ctx, pod); ok {
+		minPort, maxPort = r.Min, r.Max
+	}
+
 	if val, ok := pod.Annotations[AnnotationMinPort]; ok {
 		if i, err := strconv.Atoi(val); err == nil {
 			minPort = int32(i)
 		}
 	}
 
-	maxPort := int32(8000)
 	if val, ok := pod.Annotations[AnnotationMaxPort]; ok {
 		if i, err := strconv.Atoi(val); err == nil {
 			maxPort = int32(i)
 		}
 	}
 
+	// "7000..7999" sets min and max in one annotation, easier to template
+	if val, ok := pod.Annotations[AnnotationRange]; ok {
+		r, err := parseRange(val)
+		if err != nil {
+			recordRequest(req, "denied")
+			return admission.Denied(fmt.Sprintf("invalid %s annotation: %v", AnnotationRange, err))
+		}
+		minPort, maxPort = r.Min, r.Max
+	}
+
 	stride := int32(10) // Default stride per Pod (Agones-aligned)
 	if val, ok := pod.Annotations[AnnotationStride]; ok {
 		if i, err := strconv.Atoi(val); err == nil {
@@ -78,51 +344,297 @@ func (m *PodMutator) Handle(ctx context.Context, req admission.Request) admissio
 		}
 	}
 
+	// Compact block notation replaces min/max: "7000/4" is 7000 plus 2^4 ports
+	var ranges []allocator.PortRange
+	if val, ok := pod.Annotations[AnnotationBlocks]; ok {
+		parsed, err := parseBlocks(val)
+		if err != nil {
+			recordRequest(req, "denied")
+			return admission.Denied(fmt.Sprintf("invalid %s annotation: %v", AnnotationBlocks, err))
+		}
+		ranges = parsed
+		minPort, maxPort = ranges[0].Min, ranges[0].Max
+		for _, r := range ranges[1:] {
+			minPort = min(minPort, r.Min)
+			maxPort = max(maxPort, r.Max)
+		}
+	}
+
 	policy := allocator.PolicyIndex
 	if val, ok := pod.Annotations[AnnotationPolicy]; ok {
 		policy = allocator.PortPolicy(val)
 	}
 
-	// 2. Extract Numeric Index from Name (app-0, app-1...)
-	index := int32(0)
-	name := pod.Name
-	if name == "" {
-		name = pod.GenerateName
+	// Named pools (see WithNodePoolRanges) Dynamic ports are taken from, in priority order
+	var pools []allocator.PortRange
+	if val, ok := pod.Annotations[AnnotationPools]; ok {
+		var poolNames []string
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			r, ok := m.poolRanges[name]
+			if !ok {
+				recordRequest(req, "denied")
+				return admission.Denied(fmt.Sprintf("unknown pool %q in %s annotation", name, AnnotationPools))
+			}
+			// Overlapping pools would count their shared ports twice
+			for i, prev := range pools {
+				if r.Min <= prev.Max && prev.Min <= r.Max {
+					recordRequest(req, "denied")
+					return admission.Denied(fmt.Sprintf("pools %q %v and %q %v in %s annotation overlap",
+						poolNames[i], prev, name, r, AnnotationPools))
+				}
+			}
+			poolNames = append(poolNames, name)
+			// Only Dynamic ports come from pools; the pod's range stays as is
+			// for the others, e.g. its Index band
+			if policy == allocator.PolicyDynamic {
+				if len(pools) == 0 {
+					minPort, maxPort = r.Min, r.Max
+				}
+				minPort, maxPort = min(minPort, r.Min), max(maxPort, r.Max)
+			}
+			pools = append(pools, r)
+		}
+	}
+
+	// Per-pod exclusions, merged with the operator's never-allocate set
+	var excludePorts []int32
+	if val, ok := pod.Annotations[AnnotationExcludePorts]; ok {
+		parsed, err := allocator.ParsePorts(val)
+		if err != nil {
+			recordRequest(req, "denied")
+			return admission.Denied(fmt.Sprintf("invalid %s annotation: %v", AnnotationExcludePorts, err))
+		}
+		excludePorts = parsed
+	}
+
+	// 2. Extract Numeric Index from the first configured source present on the pod
+	index, err := podIndexFrom(pod, m.indexSources)
+	if err != nil {
+		recordRequest(req, "denied")
+		return admission.Denied(err.Error())
 	}
-	if lastDash := strings.LastIndex(name, "-"); lastDash != -1 {
-		if o, err := strconv.Atoi(name[lastDash+1:]); err == nil {
-			index = int32(o)
+
+	// Canary rollouts: Index pods at or above the StatefulSet partition are the
+	// new revision and take a separate band, by default the upper half of the
+	// range, so old and new pods never trade ports mid-rollout
+	if val, ok := pod.Annotations[AnnotationPartition]; ok && policy == allocator.PolicyIndex {
+		partition, err := strconv.Atoi(val)
+		if err != nil || partition < 0 {
+			recordRequest(req, "denied")
+			return admission.Denied(fmt.Sprintf("invalid %s annotation %q", AnnotationPartition, val))
+		}
+		if index >= int32(partition) {
+			offset := (maxPort - minPort + 1) / 2
+			if stride > 0 {
+				offset -= offset % stride
+			}
+			if val, ok := pod.Annotations[AnnotationPartitionOffset]; ok {
+				i, err := strconv.Atoi(val)
+				if err != nil || i < 0 {
+					recordRequest(req, "denied")
+					return admission.Denied(fmt.Sprintf("invalid %s annotation %q", AnnotationPartitionOffset, val))
+				}
+				offset = int32(i)
+			}
+			minPort += offset
 		}
 	}
 
-	// 3. Collect Port Requests
+	// Partial mode lets Dynamic ports that don't fit be skipped instead of denying the pod
+	partial := policy == allocator.PolicyDynamic && pod.Annotations[AnnotationPartial] == "true"
+
+	// Dual-stack pods get each port reserved for both IPv4 and IPv6 bindings
+	dualStack := pod.Annotations[AnnotationDualStack] == "true"
+
+	// 3. Collect Port Requests; hostPorts already set in the spec are kept as is
 	var portRequests []allocator.PortRequest
-	for _, container := range pod.Spec.Containers {
-		for _, port := range container.Ports {
+	presetPorts := make(map[string]int32)
+	// Containers declaring the same named port (an app and its proxy sidecar)
+	// share one allocation; the extra spec entries are tracked per request
+	shared := make(map[string][]portRef)
+	for i, container := range pod.Spec.Containers {
+		for j, port := range container.Ports {
+			if port.HostPort != 0 {
+				name := port.Name
+				if name == "" {
+					name = strconv.Itoa(int(port.ContainerPort))
+				}
+				presetPorts[allocator.AllocationKey(name, port.Protocol)] = port.HostPort
+
+				// The chart may declare the hostPort it expects; a spec that drifted from it is denied
+				if val, ok := pod.Annotations[AnnotationStaticPrefix+port.Name]; ok && port.Name != "" {
+					expected, err := strconv.Atoi(val)
+					if err != nil || expected < 1 || expected > 65535 {
+						recordRequest(req, "denied")
+						return admission.Denied(fmt.Sprintf("invalid port %q in annotation %s", val, AnnotationStaticPrefix+port.Name))
+					}
+					if int32(expected) != port.HostPort {
+						recordRequest(req, "denied")
+						return admission.Denied(fmt.Sprintf("hostPort %d of port %q doesn't match %d declared in annotation %s",
+							port.HostPort, port.Name, expected, AnnotationStaticPrefix+port.Name))
+					}
+				}
+			}
 			if port.HostPort == 0 && port.ContainerPort != 0 {
-				portRequests = append(portRequests, allocator.PortRequest{
+				protocol := port.Protocol
+				if protocol == "" {
+					protocol = inferProtocol(m.protocolRules, port.Name)
+				}
+				// Per-port protocol override for charts that can't set it on the container port
+				if val, ok := pod.Annotations[AnnotationProtocolPrefix+port.Name]; ok && port.Name != "" {
+					protocol = corev1.Protocol(strings.ToUpper(val))
+					if protocol != corev1.ProtocolTCP && protocol != corev1.ProtocolUDP && protocol != corev1.ProtocolSCTP {
+						recordRequest(req, "denied")
+						return admission.Denied(fmt.Sprintf("invalid protocol %q in annotation %s", val, AnnotationProtocolPrefix+port.Name))
+					}
+				}
+				portRequest := allocator.PortRequest{
 					Name:          port.Name,
 					ContainerPort: port.ContainerPort,
-					Protocol:      port.Protocol,
+					Protocol:      protocol,
 					Policy:        policy,
-				})
+					Ranges:        ranges,
+					Pools:         pools,
+					ExcludePorts:  excludePorts,
+					Optional:      partial,
+					DualStack:     dualStack,
+				}
+				// A pinned port always gets its given hostPort, like Static, whatever the pod's policy
+				if val, ok := pod.Annotations[AnnotationPinPrefix+port.Name]; ok && port.Name != "" {
+					pinned, err := strconv.Atoi(val)
+					if err != nil || pinned < 1 || pinned > 65535 {
+						recordRequest(req, "denied")
+						return admission.Denied(fmt.Sprintf("invalid port %q in annotation %s", val, AnnotationPinPrefix+port.Name))
+					}
+					portRequest.Policy = allocator.PolicyStatic
+					portRequest.HostPort = int32(pinned)
+				}
+				if port.Name != "" && slices.ContainsFunc(portRequests, func(r allocator.PortRequest) bool {
+					return r.Name == port.Name && r.ContainerPort == port.ContainerPort && r.Protocol == protocol
+				}) {
+					key := allocatedAnnotation(portRequest)
+					shared[key] = append(shared[key], portRef{container: i, port: j})
+					continue
+				}
+				portRequests = append(portRequests, portRequest)
 			}
 		}
 	}
 
+	// Extra ports requested by count, recorded only as annotations (dynamic-0, dynamic-1...)
+	if val, ok := pod.Annotations[AnnotationDynamicCount]; ok {
+		count, err := strconv.Atoi(val)
+		if err != nil || count < 0 || count > maxDynamicCount {
+			recordRequest(req, "denied")
+			return admission.Denied(fmt.Sprintf("invalid %s annotation %q: want 0-%d", AnnotationDynamicCount, val, maxDynamicCount))
+		}
+		for i := 0; i < count; i++ {
+			portRequests = append(portRequests, allocator.PortRequest{
+				Name:         fmt.Sprintf("%s%d", allocator.ExtraPortNamePrefix, i),
+				Protocol:     corev1.ProtocolTCP,
+				Policy:       allocator.PolicyDynamic,
+				Ranges:       ranges,
+				Pools:        pools,
+				ExcludePorts: excludePorts,
+				Optional:     partial,
+			})
+		}
+	}
+
+	// Guard against runaway requests before allocating any of them
+	maxPorts := m.maxPortsPerPod
+	if val, ok := pod.Annotations[AnnotationMaxPorts]; ok {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 {
+			recordRequest(req, "denied")
+			return admission.Denied(fmt.Sprintf("invalid %s annotation %q: want a positive number", AnnotationMaxPorts, val))
+		}
+		if maxPorts == 0 || limit < maxPorts {
+			maxPorts = limit
+		}
+	}
+	if maxPorts > 0 && len(portRequests) > maxPorts {
+		recordRequest(req, "denied")
+		return admission.Denied(fmt.Sprintf("pod requests %d hostPorts, more than the cap of %d per pod", len(portRequests), maxPorts))
+	}
+
+	// Port names become part of annotation keys; reject those that can't
+	for _, r := range portRequests {
+		key := allocatedAnnotation(r)
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			recordRequest(req, "denied")
+			return admission.Denied(fmt.Sprintf("port name %q can't be used in annotation key %q: %s", r.Name, key, strings.Join(errs, "; ")))
+		}
+	}
+
 	if len(portRequests) == 0 {
-		metrics.WebhookRequestsTotal.WithLabelValues("allowed").Inc()
+		recordRequest(req, "allowed")
+		// A malformed pod with nothing to run is told apart from one without hostPorts
+		if len(pod.Spec.Containers) == 0 && len(pod.Spec.InitContainers) == 0 {
+			return admission.Allowed("pod has no containers, hostPort allocation skipped")
+		}
 		return admission.Allowed("no ports need allocation")
 	}
 
+	// Pods free to run on several nodes are placed on the least used one and
+	// pinned there, so ports spread evenly across the fleet
+	if val, ok := pod.Annotations[AnnotationCandidateNodes]; ok && pod.Spec.NodeName == "" {
+		candidates := ranges
+		if len(candidates) == 0 {
+			candidates = []allocator.PortRange{{Min: minPort, Max: maxPort}}
+		}
+		var nodes []string
+		for _, node := range strings.Split(val, ",") {
+			if node = strings.TrimSpace(node); node != "" {
+				nodes = append(nodes, node)
+			}
+		}
+		if len(nodes) > 0 {
+			node := m.allocator.LeastUtilizedNode(nodes, candidates)
+			pod.Annotations[allocator.AnnotationPlacedNode] = node
+			pinToNode(pod, node)
+		}
+	}
+
 	// 4. Perform Allocation with Protocol and Stride Awareness
-	allocated, err := m.allocator.Allocate(ctx, pod, portRequests, minPort, maxPort, index, stride)
+	allocCtx := ctx
+	if isDryRun(req) {
+		allocCtx = allocator.DryRunContext(ctx)
+	}
+	allocated, err := m.allocator.Allocate(allocCtx, pod, portRequests, minPort, maxPort, index, stride)
 	if err != nil {
+		if pod.Annotations[AnnotationMode] == ModeBestEffort && errors.Is(err, allocator.ErrRangeExhausted) {
+			logger.Info("Port range exhausted, admitting pod without hostPorts (best-effort)", "reason", err.Error())
+			recordRequest(req, "allowed")
+			return admission.Allowed("best-effort: no free hostPorts").
+				WithWarnings(fmt.Sprintf("hostPort allocation skipped: %v", err))
+		}
 		logger.Error(err, "Port allocation failed")
-		metrics.WebhookRequestsTotal.WithLabelValues("denied").Inc()
-		return admission.Denied(err.Error())
+		recordRequest(req, "denied")
+		resp := admission.Denied(err.Error())
+		if pod.Annotations[AnnotationDiagnostics] == "true" {
+			denialRanges := ranges
+			if len(denialRanges) == 0 {
+				denialRanges = []allocator.PortRange{{Min: minPort, Max: maxPort}}
+			}
+			resp.Result.Details = m.denialDetails(pod, portRequests, denialRanges, err)
+		}
+		return resp
 	}
 
+	// Ports skipped in partial mode are left unassigned and reported by name
+	var skipped []string
+	granted := allocated[:0]
+	for _, a := range allocated {
+		if a.HostPort == 0 {
+			skipped = append(skipped, portKey(a))
+			continue
+		}
+		granted = append(granted, a)
+	}
+	allocated = granted
+
 	// 5. Apply Mutations
 	if !pod.Spec.HostNetwork {
 		pod.Spec.HostNetwork = true
@@ -132,39 +644,795 @@ func (m *PodMutator) Handle(ctx context.Context, req admission.Request) admissio
 		pod.Annotations = make(map[string]string)
 	}
 
+	var originalPorts [][]corev1.ContainerPort
+	preserve := pod.Annotations[AnnotationPreserveContainerPort] == "true"
+	if preserve {
+		for _, c := range pod.Spec.Containers {
+			originalPorts = append(originalPorts, append([]corev1.ContainerPort(nil), c.Ports...))
+		}
+	}
+
 	for _, a := range allocated {
-		m.applyToSpec(pod, a)
-		pod.Annotations[AnnotationAllocatedPrefix+a.Name] = fmt.Sprintf("%d", a.HostPort)
+		// Extra ports requested by count have no container port to update
+		if a.ContainerPort != 0 {
+			m.applyToSpec(pod, a)
+			for _, ref := range shared[allocatedAnnotation(a)] {
+				setHostPort(&pod.Spec.Containers[ref.container].Ports[ref.port], a)
+			}
+		}
+		pod.Annotations[allocatedAnnotation(a)] = fmt.Sprintf("%d", a.HostPort)
 	}
 
-	marshaledPod, err := json.Marshal(pod)
+	if len(skipped) > 0 {
+		pod.Annotations[AnnotationSkipped] = strings.Join(skipped, ",")
+	}
+
+	// Ports served by another policy than requested, e.g. "game=Dynamic"
+	var fallbacks []string
+	for _, a := range allocated {
+		if a.EffectivePolicy != "" && a.EffectivePolicy != a.Policy {
+			fallbacks = append(fallbacks, fmt.Sprintf("%s=%s", portKey(a), a.EffectivePolicy))
+		}
+	}
+	if len(fallbacks) > 0 {
+		pod.Annotations[AnnotationFallback] = strings.Join(fallbacks, ",")
+	}
+
+	if m.annotatePreset {
+		for key, port := range presetPorts {
+			pod.Annotations[AnnotationPresetPrefix+key] = fmt.Sprintf("%d", port)
+		}
+	}
+
+	if preserve {
+		appendOriginalPorts(pod, originalPorts)
+	}
+
+	if dualStack {
+		appendIPv6Ports(pod, allocated)
+	}
+
+	// Record the allocation parameters so a fresh operator can trust the annotations above
+	meta, err := json.Marshal(allocator.AllocationMeta{Policy: policy, MinPort: minPort, MaxPort: maxPort, Index: index})
 	if err != nil {
-		metrics.WebhookRequestsTotal.WithLabelValues("errored").Inc()
+		recordRequest(req, "errored")
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
+	pod.Annotations[allocator.AnnotationAllocationMeta] = string(meta)
+
+	// An unbound pod may be scheduled elsewhere than its ports were checked on
+	if pod.Spec.NodeName == "" {
+		pod.Annotations[allocator.AnnotationAssumedNode] = m.allocator.NodeNameOf(pod)
+	}
+
+	if m.historySize > 0 {
+		pod.Annotations[AnnotationHistory] = m.nextHistory(ctx, req, pod, allocated)
+	}
+
+	// Defensive: a port left unassigned or assigned twice means the results
+	// were applied to the wrong spec entries
+	if err := verifyMutation(original, pod, skipped); err != nil {
+		logger.Error(err, "Allocation self-check failed")
+		recordRequest(req, "errored")
+		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("allocation self-check failed: %w", err))
+	}
+
+	resp := admission.Patched("", buildPatch(original, pod)...)
+	if m.mergePatch {
+		patch, err := buildMergePatch(original, pod)
+		if err != nil {
+			recordRequest(req, "errored")
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		resp = mergePatched(patch)
+	}
+
+	// A dry run (e.g. kubectl apply --dry-run=server) must have no side
+	// effects outside the admission, as declared by sideEffects: None
+	if m.notifier != nil && !isDryRun(req) {
+		m.notifier.Notify(callbackEvents(req, pod, allocated)...)
+	}
 
-	metrics.WebhookRequestsTotal.WithLabelValues("allowed").Inc()
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+	recordRequest(req, "allowed")
+	var warnings []string
+	if len(skipped) > 0 {
+		warnings = append(warnings, fmt.Sprintf("no free hostPort for %s, running degraded", strings.Join(skipped, ", ")))
+	}
+	if m.utilizationWarn > 0 {
+		if len(ranges) == 0 {
+			ranges = []allocator.PortRange{{Min: minPort, Max: maxPort}}
+		}
+		warnings = append(warnings, m.utilizationWarnings(pod, allocated, ranges)...)
+	}
+	if len(warnings) > 0 {
+		resp = resp.WithWarnings(warnings...)
+	}
+	// A dry run marked nothing, so a later CREATE must not replay it
+	if !isDryRun(req) {
+		m.cacheDecision(decision, cachedDecision{resp: resp, pod: pod, allocated: allocated})
+	}
+	return resp
+}
+
+// cachedDecision returns the unexpired response cached under a decision key,
+// as long as the allocator still holds its ports for the pod. A decision
+// whose ports were dropped meanwhile, e.g. by a resync, is forgotten.
+func (m *PodMutator) cachedDecision(key string) (admission.Response, bool) {
+	if m.decisionTTL <= 0 || key == "" {
+		return admission.Response{}, false
+	}
+	m.decisionsMu.Lock()
+	defer m.decisionsMu.Unlock()
+	d, ok := m.decisions[key]
+	if !ok || time.Now().After(d.expires) {
+		return admission.Response{}, false
+	}
+	if !m.allocator.Holds(d.pod, d.allocated) {
+		delete(m.decisions, key)
+		return admission.Response{}, false
+	}
+	return d.resp, true
+}
+
+// cacheDecision keeps a successful response for retries of the same pod,
+// dropping expired entries on the way
+func (m *PodMutator) cacheDecision(key string, d cachedDecision) {
+	if m.decisionTTL <= 0 || key == "" {
+		return
+	}
+	m.decisionsMu.Lock()
+	defer m.decisionsMu.Unlock()
+	now := time.Now()
+	for k, d := range m.decisions {
+		if now.After(d.expires) {
+			delete(m.decisions, k)
+		}
+	}
+	d.expires = now.Add(m.decisionTTL)
+	m.decisions[key] = d
+}
+
+// decisionKey identifies a pod across admission retries. A pod has no UID
+// yet on CREATE, so it is keyed by namespace/name; a pod named by the API
+// server from generateName has no name either and is keyed by its
+// generateName and the admission request UID instead. A hash of the pod's
+// spec and annotations tells a pod recreated under the same name with
+// other contents apart.
+func decisionKey(namespace string, pod *corev1.Pod, req admission.Request) string {
+	var key string
+	switch {
+	case pod.Name != "":
+		key = namespace + "/" + pod.Name
+	case pod.GenerateName != "" && req.UID != "":
+		key = namespace + "/" + pod.GenerateName + "/" + string(req.UID)
+	default:
+		return ""
+	}
+	raw, err := json.Marshal(struct {
+		Spec        corev1.PodSpec    `json:"spec"`
+		Annotations map[string]string `json:"annotations"`
+	}{pod.Spec, pod.Annotations})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return key + "/" + hex.EncodeToString(sum[:8])
+}
+
+// utilizationWarnings reports, from the allocator snapshot, each protocol of
+// the allocated ports whose range on the pod's node is past the threshold
+func (m *PodMutator) utilizationWarnings(pod *corev1.Pod, allocated []allocator.PortRequest, ranges []allocator.PortRange) []string {
+	nodeName := m.allocator.NodeNameOf(pod)
+
+	var protocols []corev1.Protocol
+	for _, a := range allocated {
+		protocol := a.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		if !slices.Contains(protocols, protocol) {
+			protocols = append(protocols, protocol)
+		}
+	}
+	slices.Sort(protocols)
+
+	snapshot := m.allocator.Snapshot()
+	var warnings []string
+	for _, protocol := range protocols {
+		used, size := rangeUsage(snapshot[nodeName+"/"+string(protocol)], ranges)
+		if size <= 0 {
+			continue
+		}
+		if percent := used * 100 / size; percent >= m.utilizationWarn {
+			warnings = append(warnings, fmt.Sprintf("%s %s range %d%% full", nodeName, protocol, percent))
+		}
+	}
+	return warnings
+}
+
+// rangeUsage counts the held ports within ranges, and the ports of ranges
+func rangeUsage(held []int32, ranges []allocator.PortRange) (used, size int) {
+	for _, r := range ranges {
+		size += int(r.Max - r.Min + 1)
+	}
+	for _, p := range held {
+		for _, r := range ranges {
+			if p >= r.Min && p <= r.Max {
+				used++
+				break
+			}
+		}
+	}
+	return used, size
+}
+
+// denialDetails explains a failed allocation for AnnotationDiagnostics: the
+// allocator's reason, then how full the pod's node is in each requested
+// protocol's range
+func (m *PodMutator) denialDetails(pod *corev1.Pod, requests []allocator.PortRequest, ranges []allocator.PortRange, err error) *metav1.StatusDetails {
+	details := &metav1.StatusDetails{
+		Name:   pod.Name,
+		Kind:   "Pod",
+		Causes: []metav1.StatusCause{{Type: CauseTypeAllocation, Message: err.Error()}},
+	}
+	nodeName := m.allocator.NodeNameOf(pod)
+	var protocols []corev1.Protocol
+	for _, r := range requests {
+		protocol := r.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		if !slices.Contains(protocols, protocol) {
+			protocols = append(protocols, protocol)
+		}
+	}
+	slices.Sort(protocols)
+
+	rangeStrs := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		rangeStrs = append(rangeStrs, r.String())
+	}
+	snapshot := m.allocator.Snapshot()
+	for _, protocol := range protocols {
+		used, size := rangeUsage(snapshot[nodeName+"/"+string(protocol)], ranges)
+		if size <= 0 {
+			continue
+		}
+		details.Causes = append(details.Causes, metav1.StatusCause{
+			Type: CauseTypeNodeUtilization,
+			Message: fmt.Sprintf("node %s: %d of %d %s ports in %s in use (%d%%)",
+				nodeName, used, size, protocol, strings.Join(rangeStrs, ", "), used*100/size),
+		})
+	}
+	return details
+}
+
+// allocatedAnnotation is the annotation key recording a port's allocation.
+// Unnamed ports are keyed by their containerPort.
+func allocatedAnnotation(r allocator.PortRequest) string {
+	return AnnotationAllocatedPrefix + portKey(r)
+}
+
+// portKey names a requested port in annotations, e.g. hostport.io/skipped;
+// unnamed ports are named by their containerPort
+func portKey(r allocator.PortRequest) string {
+	name := r.Name
+	if name == "" {
+		name = strconv.Itoa(int(r.ContainerPort))
+	}
+	return allocator.AllocationKey(name, r.Protocol)
+}
+
+// AllocatedPortFieldPath returns the downward API fieldPath of the annotation
+// holding a port's allocated hostPort, e.g.
+// "metadata.annotations['hostport.io/allocated-game']". The annotation value
+// is the port as a plain decimal ("7010"), a format kept stable so apps can
+// read it from env.
+func AllocatedPortFieldPath(portName string, protocol corev1.Protocol) string {
+	return fmt.Sprintf("metadata.annotations['%s']", allocatedAnnotation(allocator.PortRequest{Name: portName, Protocol: protocol}))
+}
+
+// AllocatedPortEnv returns an env var that exposes a port's allocated hostPort
+// to the container through the downward API, for charts and controllers that
+// build pod templates in Go.
+func AllocatedPortEnv(envName, portName string, protocol corev1.Protocol) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: envName,
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: AllocatedPortFieldPath(portName, protocol)},
+		},
+	}
+}
+
+// isDryRun reports whether the admission request won't be persisted
+func isDryRun(req admission.Request) bool {
+	return req.DryRun != nil && *req.DryRun
+}
+
+// callbackEvents describes the allocated ports of a pod for the notifier
+func callbackEvents(req admission.Request, pod *corev1.Pod, allocated []allocator.PortRequest) []callback.Event {
+	namespace, name := pod.Namespace, pod.Name
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+	if name == "" {
+		name = pod.GenerateName
+	}
+	events := make([]callback.Event, 0, len(allocated))
+	for _, a := range allocated {
+		events = append(events, callback.Event{
+			Node:      pod.Spec.NodeName,
+			Namespace: namespace,
+			Pod:       name,
+			Port:      a.HostPort,
+			Protocol:  string(a.Protocol),
+		})
+	}
+	return events
+}
+
+// nextHistory appends this allocation to the history of the pod name, kept
+// in the namespace's HistoryConfigMapName ConfigMap since the previous pod of
+// the name is gone by the time its replacement is admitted. Entries look like
+// "v3:30024" (ports of one allocation joined by "/") and only the last
+// historySize entries are kept. Pods without a name yet (generateName) have
+// no history to carry on.
+func (m *PodMutator) nextHistory(ctx context.Context, req admission.Request, pod *corev1.Pod, allocated []allocator.PortRequest) string {
+	namespace := pod.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+	history := pod.Annotations[AnnotationHistory]
+	cm := &corev1.ConfigMap{}
+	err := m.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: HistoryConfigMapName}, cm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.FromContext(ctx).Error(err, "Failed to read allocation history", "configmap", HistoryConfigMapName)
+	}
+	if pod.Name != "" && err == nil {
+		history = cm.Data[pod.Name]
+	}
+
+	var entries []string
+	if history != "" {
+		entries = strings.Split(history, ",")
+	}
+
+	version := 1
+	if len(entries) > 0 {
+		last, _, _ := strings.Cut(entries[len(entries)-1], ":")
+		if v, err := strconv.Atoi(strings.TrimPrefix(last, "v")); err == nil {
+			version = v + 1
+		}
+	}
+
+	ports := make([]string, len(allocated))
+	for i, a := range allocated {
+		ports[i] = strconv.Itoa(int(a.HostPort))
+	}
+	entries = append(entries, fmt.Sprintf("v%d:%s", version, strings.Join(ports, "/")))
+	if len(entries) > m.historySize {
+		entries = entries[len(entries)-m.historySize:]
+	}
+	history = strings.Join(entries, ",")
+
+	// History is a debugging aid: failing to store it never fails admission
+	if pod.Name != "" && !isDryRun(req) {
+		if err := m.storeHistory(ctx, namespace, pod.Name, history); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to store allocation history", "configmap", HistoryConfigMapName)
+		}
+	}
+	return history
+}
+
+// storeHistory sets the history of a pod name in the namespace's history
+// ConfigMap. A merge patch of the one key leaves the other names' histories,
+// written concurrently for other pods, alone.
+func (m *PodMutator) storeHistory(ctx context.Context, namespace, name, history string) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      HistoryConfigMapName,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "hostport-operator"},
+		},
+		Data: map[string]string{name: history},
+	}
+	err := m.Client.Create(ctx, cm)
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	patch, err := json.Marshal(map[string]any{"data": map[string]string{name: history}})
+	if err != nil {
+		return err
+	}
+	return m.Client.Patch(ctx, cm, client.RawPatch(types.MergePatchType, patch))
+}
+
+// nodePoolRange resolves the pool range for the pod's node, or for the pool
+// the pod selects via nodeSelector when it isn't scheduled yet.
+func (m *PodMutator) nodePoolRange(ctx context.Context, pod *corev1.Pod) (allocator.PortRange, bool) {
+	if m.poolLabel == "" {
+		return allocator.PortRange{}, false
+	}
+
+	pool := pod.Spec.NodeSelector[m.poolLabel]
+	if pod.Spec.NodeName != "" {
+		node := &corev1.Node{}
+		if err := m.Client.Get(ctx, client.ObjectKey{Name: pod.Spec.NodeName}, node); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to get node for pool range, using defaults", "node", pod.Spec.NodeName)
+			return allocator.PortRange{}, false
+		}
+		pool = node.Labels[m.poolLabel]
+	}
+
+	r, ok := m.poolRanges[pool]
+	return r, ok
+}
+
+// ParseNodePoolRanges parses "pool=min-max" pairs separated by commas,
+// e.g. "gaming=30000-30999,general=7000-8000".
+func ParseNodePoolRanges(val string) (map[string]allocator.PortRange, error) {
+	ranges := make(map[string]allocator.PortRange)
+	if strings.TrimSpace(val) == "" {
+		return ranges, nil
+	}
+	for _, entry := range strings.Split(val, ",") {
+		pool, bounds, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || pool == "" {
+			return nil, fmt.Errorf("pool range %q must be in pool=min-max form", entry)
+		}
+		minStr, maxStr, ok := strings.Cut(bounds, "-")
+		if !ok {
+			return nil, fmt.Errorf("pool range %q must be in pool=min-max form", entry)
+		}
+		minPort, err := strconv.Atoi(minStr)
+		if err != nil {
+			return nil, fmt.Errorf("pool range %q has invalid min port", entry)
+		}
+		maxPort, err := strconv.Atoi(maxStr)
+		if err != nil || maxPort < minPort {
+			return nil, fmt.Errorf("pool range %q has invalid max port", entry)
+		}
+		ranges[pool] = allocator.PortRange{Min: int32(minPort), Max: int32(maxPort)}
+	}
+	return ranges, nil
+}
+
+// podIndexFrom resolves the pod index from the first source present on the
+// pod, falling back to 0. A present but malformed source is an error.
+func podIndexFrom(pod *corev1.Pod, sources []IndexSource) (int32, error) {
+	if len(sources) == 0 {
+		sources = DefaultIndexSources
+	}
+	for _, source := range sources {
+		var val, from string
+		switch source {
+		case IndexSourceLabel:
+			labelKey, ok := pod.Annotations[AnnotationIndexFromLabel]
+			if !ok {
+				continue
+			}
+			if val, ok = pod.Labels[labelKey]; !ok {
+				return 0, fmt.Errorf("index label %q named by %s is not set", labelKey, AnnotationIndexFromLabel)
+			}
+			from = fmt.Sprintf("index label %q", labelKey)
+		case IndexSourceAnnotation:
+			var ok bool
+			if val, ok = pod.Annotations[AnnotationIndex]; !ok {
+				continue
+			}
+			from = fmt.Sprintf("annotation %s", AnnotationIndex)
+		case IndexSourcePodIndex:
+			var ok bool
+			if val, ok = pod.Labels[LabelPodIndex]; !ok {
+				continue
+			}
+			from = fmt.Sprintf("label %s", LabelPodIndex)
+		case IndexSourceName:
+			name := pod.Name
+			if name == "" {
+				name = pod.GenerateName
+			}
+			if lastDash := strings.LastIndex(name, "-"); lastDash != -1 {
+				if o, err := strconv.Atoi(name[lastDash+1:]); err == nil {
+					return int32(o), nil
+				}
+			}
+			continue
+		}
+		i, err := strconv.Atoi(val)
+		if err != nil || i < 0 {
+			return 0, fmt.Errorf("%s has non-numeric value %q", from, val)
+		}
+		return int32(i), nil
+	}
+	return 0, nil
+}
+
+// ParseIndexSources parses a comma-separated index source priority list,
+// e.g. "pod-index,annotation,name".
+func ParseIndexSources(val string) ([]IndexSource, error) {
+	var sources []IndexSource
+	seen := make(map[IndexSource]bool)
+	for _, item := range strings.Split(val, ",") {
+		source := IndexSource(strings.TrimSpace(item))
+		switch source {
+		case IndexSourceLabel, IndexSourceAnnotation, IndexSourcePodIndex, IndexSourceName:
+		default:
+			return nil, fmt.Errorf("unknown index source %q", source)
+		}
+		if seen[source] {
+			return nil, fmt.Errorf("index source %q listed twice", source)
+		}
+		seen[source] = true
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// ParseProtocolRules parses comma-separated "pattern=protocol" rules, e.g.
+// "*-udp=UDP,dns=UDP"
+func ParseProtocolRules(val string) ([]ProtocolRule, error) {
+	var rules []ProtocolRule
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, proto, ok := strings.Cut(item, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("protocol rule %q is not pattern=protocol", item)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("protocol rule %q has an invalid pattern: %w", item, err)
+		}
+		protocol := corev1.Protocol(strings.ToUpper(strings.TrimSpace(proto)))
+		if protocol != corev1.ProtocolTCP && protocol != corev1.ProtocolUDP && protocol != corev1.ProtocolSCTP {
+			return nil, fmt.Errorf("protocol rule %q has unknown protocol %q", item, proto)
+		}
+		rules = append(rules, ProtocolRule{Pattern: strings.TrimSpace(pattern), Protocol: protocol})
+	}
+	return rules, nil
+}
+
+// inferProtocol returns the protocol of the first rule matching name, or ""
+func inferProtocol(rules []ProtocolRule, name string) corev1.Protocol {
+	if name == "" {
+		return ""
+	}
+	for _, r := range rules {
+		if ok, _ := path.Match(r.Pattern, name); ok {
+			return r.Protocol
+		}
+	}
+	return ""
+}
+
+// recordRequest counts a webhook request by result and (bounded) namespace
+func recordRequest(req admission.Request, result string) {
+	metrics.WebhookRequestsTotal.WithLabelValues(result, metrics.NamespaceLabel(req.Namespace)).Inc()
+}
+
+// parseRange parses an inclusive "min..max" port range
+func parseRange(val string) (allocator.PortRange, error) {
+	minStr, maxStr, ok := strings.Cut(strings.TrimSpace(val), "..")
+	if !ok {
+		return allocator.PortRange{}, fmt.Errorf("range %q must be in min..max form", val)
+	}
+	minPort, err := strconv.Atoi(strings.TrimSpace(minStr))
+	if err != nil || minPort < 1 || minPort > 65535 {
+		return allocator.PortRange{}, fmt.Errorf("range %q has invalid min port", val)
+	}
+	maxPort, err := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err != nil || maxPort < 1 || maxPort > 65535 {
+		return allocator.PortRange{}, fmt.Errorf("range %q has invalid max port", val)
+	}
+	if maxPort < minPort {
+		return allocator.PortRange{}, fmt.Errorf("range %q has max below min", val)
+	}
+	return allocator.PortRange{Min: int32(minPort), Max: int32(maxPort)}, nil
+}
+
+// parseBlocks parses a comma-separated list of "start/bits" port blocks,
+// where each block covers 2^bits ports beginning at start.
+func parseBlocks(val string) ([]allocator.PortRange, error) {
+	var ranges []allocator.PortRange
+	for _, block := range strings.Split(val, ",") {
+		block = strings.TrimSpace(block)
+		startStr, bitsStr, ok := strings.Cut(block, "/")
+		if !ok {
+			return nil, fmt.Errorf("block %q must be in start/bits form", block)
+		}
+		start, err := strconv.Atoi(startStr)
+		if err != nil || start < 1 || start > 65535 {
+			return nil, fmt.Errorf("block %q has invalid start port", block)
+		}
+		bits, err := strconv.Atoi(bitsStr)
+		if err != nil || bits < 0 || bits > 16 {
+			return nil, fmt.Errorf("block %q has invalid size, want 0-16 bits", block)
+		}
+		end := start + (1 << bits) - 1
+		if end > 65535 {
+			return nil, fmt.Errorf("block %q extends past port 65535", block)
+		}
+		ranges = append(ranges, allocator.PortRange{Min: int32(start), Max: int32(end)})
+	}
+	return ranges, nil
 }
 
 func (m *PodMutator) applyToSpec(pod *corev1.Pod, alloc allocator.PortRequest) {
 	for i := range pod.Spec.Containers {
 		for j := range pod.Spec.Containers[i].Ports {
 			p := &pod.Spec.Containers[i].Ports[j]
-			// Match by name or by original containerPort
-			if p.Name == alloc.Name || (p.Name == "" && p.ContainerPort == alloc.ContainerPort) {
-				p.HostPort = alloc.HostPort
-				// For hostNetwork, containerPort should be updated to match allocated hostPort
-				p.ContainerPort = alloc.HostPort
+			// Match the first unassigned port by name, or an unnamed one by its
+			// original containerPort and protocol; allocations come in spec
+			// order, so a name shared across protocols resolves to the right entry
+			if p.HostPort == 0 && matchesRequest(*p, alloc) {
+				setHostPort(p, alloc)
+				return
 			}
 		}
 	}
 }
 
-func SetupWithManager(mgr ctrl.Manager, alloc *allocator.Allocator) error {
-	mutator := NewPodMutator(mgr.GetClient(), mgr.GetScheme(), alloc)
-	mgr.GetWebhookServer().Register("/mutate-pods", &webhook.Admission{
+// matchesRequest reports whether a spec port is the one a request was built from
+func matchesRequest(p corev1.ContainerPort, r allocator.PortRequest) bool {
+	if r.Name != "" || p.Name != "" {
+		return p.Name == r.Name
+	}
+	protocol := p.Protocol
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+	requested := r.Protocol
+	if requested == "" {
+		requested = corev1.ProtocolTCP
+	}
+	return p.ContainerPort == r.ContainerPort && protocol == requested
+}
+
+// verifyMutation checks that every port of the original spec requesting a
+// hostPort got one, unless skipped in partial mode, and that no hostPort is
+// used twice for a protocol and host IP, except by ports sharing a name
+// (sidecar shared ports)
+func verifyMutation(original, mutated *corev1.Pod, skipped []string) error {
+	for i, c := range original.Spec.Containers {
+		for j, port := range c.Ports {
+			if port.HostPort != 0 || port.ContainerPort == 0 {
+				continue
+			}
+			got := mutated.Spec.Containers[i].Ports[j]
+			key := portKey(allocator.PortRequest{Name: got.Name, ContainerPort: got.ContainerPort, Protocol: got.Protocol})
+			if got.HostPort == 0 && !slices.Contains(skipped, key) {
+				return fmt.Errorf("port %q of container %s was not assigned a hostPort", port.Name, c.Name)
+			}
+		}
+	}
+
+	owners := make(map[string]string)
+	for _, c := range mutated.Spec.Containers {
+		for _, port := range c.Ports {
+			if port.HostPort == 0 {
+				continue
+			}
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			key := fmt.Sprintf("%s/%s/%d", port.HostIP, protocol, port.HostPort)
+			if owner, ok := owners[key]; ok && owner != port.Name {
+				return fmt.Errorf("hostPort %d/%s is assigned to both port %q and port %q", port.HostPort, protocol, owner, port.Name)
+			}
+			owners[key] = port.Name
+		}
+	}
+	return nil
+}
+
+// portRef locates a port in the pod spec
+type portRef struct {
+	container, port int
+}
+
+// pinToNode requires the pod to be scheduled on the named node, on top of
+// any node affinity it already has
+func pinToNode(pod *corev1.Pod, node string) {
+	field := corev1.NodeSelectorRequirement{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{node}}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	required := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		required = &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{}}}
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+	}
+	// Terms are ORed, so the node goes into each of them
+	for i := range required.NodeSelectorTerms {
+		required.NodeSelectorTerms[i].MatchFields = append(required.NodeSelectorTerms[i].MatchFields, field)
+	}
+}
+
+func setHostPort(p *corev1.ContainerPort, alloc allocator.PortRequest) {
+	p.HostPort = alloc.HostPort
+	p.Protocol = alloc.Protocol
+	// For hostNetwork, containerPort should be updated to match allocated hostPort
+	p.ContainerPort = alloc.HostPort
+}
+
+// appendOriginalPorts adds a port entry carrying the original containerPort for
+// every port whose containerPort was rewritten to the allocated hostPort.
+func appendOriginalPorts(pod *corev1.Pod, originalPorts [][]corev1.ContainerPort) {
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		for j, orig := range originalPorts[i] {
+			if c.Ports[j].ContainerPort == orig.ContainerPort {
+				continue
+			}
+			c.Ports = append(c.Ports, corev1.ContainerPort{
+				Name:          originalPortName(orig.Name),
+				ContainerPort: orig.ContainerPort,
+				Protocol:      c.Ports[j].Protocol,
+			})
+		}
+	}
+}
+
+// appendIPv6Ports declares every dual-stack port a second time bound to the
+// IPv6 wildcard address, so the allocator keeps its IPv6 hold when it
+// rebuilds a node from the pod list.
+func appendIPv6Ports(pod *corev1.Pod, allocated []allocator.PortRequest) {
+	for _, a := range allocated {
+		if !a.DualStack || a.ContainerPort == 0 {
+			continue
+		}
+		for i := range pod.Spec.Containers {
+			c := &pod.Spec.Containers[i]
+			j := slices.IndexFunc(c.Ports, func(p corev1.ContainerPort) bool {
+				return p.HostPort == a.HostPort && p.Protocol == a.Protocol && p.HostIP == ""
+			})
+			if j < 0 {
+				continue
+			}
+			c.Ports = append(c.Ports, corev1.ContainerPort{
+				ContainerPort: c.Ports[j].ContainerPort,
+				HostPort:      a.HostPort,
+				HostIP:        "::",
+				Protocol:      a.Protocol,
+			})
+			break
+		}
+	}
+}
+
+// originalPortName derives the name of a preserved port, keeping within the
+// 15 character limit for port names.
+func originalPortName(name string) string {
+	if name == "" {
+		return ""
+	}
+	if len(name) > 10 {
+		name = strings.TrimSuffix(name[:10], "-")
+	}
+	return name + "-orig"
+}
+
+// DefaultWebhookPath is where the mutating webhook is served unless configured otherwise
+const DefaultWebhookPath = "/mutate-pods"
+
+// Register serves the mutator on the webhook server at path
+func Register(server webhook.Server, path string, mutator *PodMutator) {
+	if path == "" {
+		path = DefaultWebhookPath
+	}
+	server.Register(path, &webhook.Admission{
 		Handler: mutator,
 	})
+}
+
+func SetupWithManager(mgr ctrl.Manager, alloc *allocator.Allocator, path string, opts ...MutatorOption) error {
+	mutator := NewPodMutator(mgr.GetClient(), mgr.GetScheme(), alloc, opts...)
+	Register(mgr.GetWebhookServer(), path, mutator)
 	return nil
 }
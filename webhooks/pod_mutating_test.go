@@ -1,27 +1,40 @@
 package webhooks
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	"github.com/SkynetNext/hostport-operator/internal/allocator"
+	"github.com/SkynetNext/hostport-operator/internal/callback"
+	"github.com/SkynetNext/hostport-operator/internal/metrics"
 )
 
 func TestPodMutator_Handle_NotEnabled(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-	alloc := allocator.NewAllocator(fakeClient)
-	mutator := NewPodMutator(fakeClient, scheme, alloc)
+	mutator := newTestMutator(t, nil)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -61,12 +74,7 @@ func TestPodMutator_Handle_NotEnabled(t *testing.T) {
 }
 
 func TestPodMutator_Handle_IndexPolicy(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-	alloc := allocator.NewAllocator(fakeClient)
-	mutator := NewPodMutator(fakeClient, scheme, alloc)
+	mutator := newTestMutator(t, nil)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -126,12 +134,7 @@ func TestPodMutator_Handle_IndexPolicy(t *testing.T) {
 }
 
 func TestPodMutator_Handle_NoPorts(t *testing.T) {
-	scheme := runtime.NewScheme()
-	corev1.AddToScheme(scheme)
-	fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-	alloc := allocator.NewAllocator(fakeClient)
-	mutator := NewPodMutator(fakeClient, scheme, alloc)
+	mutator := newTestMutator(t, nil)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -165,6 +168,35 @@ func TestPodMutator_Handle_NoPorts(t *testing.T) {
 	}
 }
 
+func TestPodMutator_Handle_NoContainers(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "empty-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Index",
+			},
+		},
+		Spec: corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{}},
+	}
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: rawPod}}}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	if len(resp.Patches) != 0 {
+		t.Errorf("Handle() patches = %v, want none", resp.Patches)
+	}
+	if want := "pod has no containers, hostPort allocation skipped"; resp.Result.Message != want {
+		t.Errorf("Handle() message = %q, want %q", resp.Result.Message, want)
+	}
+}
+
 func TestPodMutator_ExtractIndex(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -181,12 +213,7 @@ func TestPodMutator_ExtractIndex(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			scheme := runtime.NewScheme()
-			corev1.AddToScheme(scheme)
-			fakeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
-
-			alloc := allocator.NewAllocator(fakeClient)
-			mutator := NewPodMutator(fakeClient, scheme, alloc)
+			mutator := newTestMutator(t, nil)
 
 			pod := &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
@@ -229,3 +256,2388 @@ func TestPodMutator_ExtractIndex(t *testing.T) {
 		})
 	}
 }
+
+func TestPodMutator_Handle_ProtocolOverride(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+	alloc := mutator.allocator
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "voice-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled:                "true",
+				AnnotationPolicy:                 "Dynamic",
+				AnnotationMinPort:                "7000",
+				AnnotationMaxPort:                "7010",
+				AnnotationProtocolPrefix + "rtp": "udp",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "rtp",
+							ContainerPort: 5004,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	snapshot := alloc.Snapshot()
+	if got := snapshot["node-1/UDP"]; len(got) != 1 || got[0] != 7000 {
+		t.Errorf("node-1/UDP ports = %v, want [7000]", got)
+	}
+	if got := snapshot["node-1/TCP"]; len(got) != 0 {
+		t.Errorf("node-1/TCP ports = %v, want none", got)
+	}
+}
+
+func TestPodMutator_Handle_ProtocolInference(t *testing.T) {
+	rules, err := ParseProtocolRules("*-udp=udp, dns=UDP")
+	if err != nil {
+		t.Fatalf("ParseProtocolRules() error = %v", err)
+	}
+
+	mutator := newTestMutator(t, nil, WithProtocolInference(rules...))
+	alloc := mutator.allocator
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "game-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Dynamic",
+				AnnotationMinPort: "7000",
+				AnnotationMaxPort: "7010",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{
+				Ports: []corev1.ContainerPort{
+					{Name: "game-udp", ContainerPort: 7777},
+					{Name: "admin", ContainerPort: 8080},
+					// An explicit protocol is never overridden
+					{Name: "sync-udp", ContainerPort: 7778, Protocol: corev1.ProtocolTCP},
+				},
+			}},
+		},
+	}
+	req, rawPod := admissionRequest(t, pod)
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	mutated := applyPatch(t, rawPod, resp)
+	wantProtocols := []corev1.Protocol{corev1.ProtocolUDP, corev1.ProtocolTCP, corev1.ProtocolTCP}
+	for i, want := range wantProtocols {
+		if got := mutated.Spec.Containers[0].Ports[i].Protocol; got != want {
+			t.Errorf("port %s protocol = %q, want %q", mutated.Spec.Containers[0].Ports[i].Name, got, want)
+		}
+	}
+	if got := alloc.Snapshot()["node-1/UDP"]; len(got) != 1 {
+		t.Errorf("node-1/UDP ports = %v, want game-udp's port", got)
+	}
+}
+
+func TestParseProtocolRules(t *testing.T) {
+	rules, err := ParseProtocolRules("*-udp=UDP,dns=udp")
+	if err != nil {
+		t.Fatalf("ParseProtocolRules() error = %v", err)
+	}
+	want := []ProtocolRule{{Pattern: "*-udp", Protocol: corev1.ProtocolUDP}, {Pattern: "dns", Protocol: corev1.ProtocolUDP}}
+	if !slices.Equal(rules, want) {
+		t.Errorf("ParseProtocolRules() = %v, want %v", rules, want)
+	}
+	for _, val := range []string{"dns", "=UDP", "dns=QUIC", "[-udp=UDP"} {
+		if _, err := ParseProtocolRules(val); err == nil {
+			t.Errorf("ParseProtocolRules(%q) expected error, got nil", val)
+		}
+	}
+}
+
+func TestPodMutator_Handle_ExcludePorts(t *testing.T) {
+	tests := []struct {
+		name        string
+		exclude     string
+		wantAllowed bool
+		wantPort    int32
+	}{
+		{"single ports and ranges", "7000, 7002-7004", true, 7001},
+		{"leading range", "7000-7003", true, 7004},
+		{"reversed range", "7004-7000", false, 0},
+		{"non-numeric", "ssh", false, 0},
+		{"out of range port", "70000", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := newTestMutator(t, nil)
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "app-0",
+					Namespace: "default",
+					Annotations: map[string]string{
+						AnnotationEnabled:      "true",
+						AnnotationPolicy:       "Dynamic",
+						AnnotationMinPort:      "7000",
+						AnnotationMaxPort:      "7010",
+						AnnotationExcludePorts: tt.exclude,
+					},
+				},
+				Spec: corev1.PodSpec{
+					NodeName: "node-1",
+					Containers: []corev1.Container{
+						{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 8080}}},
+					},
+				},
+			}
+
+			rawPod, _ := json.Marshal(pod)
+			req := admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Object: runtime.RawExtension{Raw: rawPod},
+				},
+			}
+
+			resp := mutator.Handle(context.Background(), req)
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Handle() allowed = %v, want %v (%s)", resp.Allowed, tt.wantAllowed, resp.Result.Message)
+			}
+			if !tt.wantAllowed {
+				return
+			}
+			patched := applyPatch(t, rawPod, resp)
+			if got := patched.Spec.Containers[0].Ports[0].HostPort; got != tt.wantPort {
+				t.Errorf("hostPort = %d, want %d", got, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestPodMutator_Handle_DynamicCount(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+	fakeClient := mutator.Client
+
+	newPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					AnnotationEnabled:      "true",
+					AnnotationMinPort:      "7000",
+					AnnotationMaxPort:      "7100",
+					AnnotationDynamicCount: "3",
+				},
+			},
+			Spec: corev1.PodSpec{
+				NodeName:   "node-1",
+				Containers: []corev1.Container{{Name: "app"}},
+			},
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range []string{"app-0", "app-1"} {
+		rawPod, _ := json.Marshal(newPod(name))
+		req := admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Object: runtime.RawExtension{Raw: rawPod},
+			},
+		}
+
+		resp := mutator.Handle(context.Background(), req)
+		if !resp.Allowed {
+			t.Fatalf("Handle(%s) expected allowed response, got denied: %s", name, resp.Result.Message)
+		}
+
+		patched := applyPatch(t, rawPod, resp)
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprintf("%s%s%d", AnnotationAllocatedPrefix, allocator.ExtraPortNamePrefix, i)
+			port, ok := patched.Annotations[key]
+			if !ok {
+				t.Fatalf("%s: missing annotation %s", name, key)
+			}
+			if seen[port] {
+				t.Errorf("%s: port %s in %s was already allocated", name, port, key)
+			}
+			seen[port] = true
+		}
+
+		// Admit the pod so the next allocation sees its annotation-only ports
+		if err := fakeClient.Create(context.Background(), patched); err != nil {
+			t.Fatalf("Create(%s) error = %v", name, err)
+		}
+	}
+}
+
+func TestPodMutator_Handle_DynamicCountInvalid(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	for _, val := range []string{"-1", "three", "1000"} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-0",
+				Namespace: "default",
+				Annotations: map[string]string{
+					AnnotationEnabled:      "true",
+					AnnotationDynamicCount: val,
+				},
+			},
+		}
+		rawPod, _ := json.Marshal(pod)
+		req := admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Object: runtime.RawExtension{Raw: rawPod},
+			},
+		}
+		if resp := mutator.Handle(context.Background(), req); resp.Allowed {
+			t.Errorf("Handle() with %s=%q expected denied, got allowed", AnnotationDynamicCount, val)
+		}
+	}
+}
+
+func TestPodMutator_Handle_MaxPortsPerPod(t *testing.T) {
+	tests := []struct {
+		name        string
+		cap         int
+		annotation  string
+		wantAllowed bool
+		wantMessage string
+	}{
+		{name: "within the cap", cap: 5, wantAllowed: true},
+		{name: "over the cap", cap: 3, wantMessage: "pod requests 4 hostPorts, more than the cap of 3 per pod"},
+		{name: "annotation lowers the cap", cap: 5, annotation: "2", wantMessage: "more than the cap of 2 per pod"},
+		{name: "annotation can't raise the cap", cap: 3, annotation: "10", wantMessage: "more than the cap of 3 per pod"},
+		{name: "annotation without a flag cap", annotation: "2", wantMessage: "more than the cap of 2 per pod"},
+		{name: "invalid annotation", cap: 5, annotation: "0", wantMessage: "invalid hostport.io/max-ports annotation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := newTestMutator(t, nil, WithMaxPortsPerPod(tt.cap))
+
+			// Two spec ports plus two by count
+			annotations := map[string]string{
+				AnnotationEnabled:      "true",
+				AnnotationPolicy:       "Dynamic",
+				AnnotationDynamicCount: "2",
+			}
+			if tt.annotation != "" {
+				annotations[AnnotationMaxPorts] = tt.annotation
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "default", Annotations: annotations},
+				Spec: corev1.PodSpec{
+					NodeName: "node-1",
+					Containers: []corev1.Container{{
+						Name:  "app",
+						Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7777}, {Name: "voice", ContainerPort: 7778}},
+					}},
+				},
+			}
+			rawPod, _ := json.Marshal(pod)
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: rawPod}}}
+
+			resp := mutator.Handle(context.Background(), req)
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Handle() allowed = %v, want %v (%s)", resp.Allowed, tt.wantAllowed, resp.Result.Message)
+			}
+			if !tt.wantAllowed && !strings.Contains(resp.Result.Message, tt.wantMessage) {
+				t.Errorf("Handle() message = %q, want it to contain %q", resp.Result.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestPodMutator_Handle_SharedNameAcrossProtocols(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Dynamic",
+				AnnotationMinPort: "7000",
+				AnnotationMaxPort: "7010",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP},
+						{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolUDP},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	patched := applyPatch(t, rawPod, resp)
+	if got := patched.Annotations[AnnotationAllocatedPrefix+"game"]; got != "7000" {
+		t.Errorf("annotation %sgame = %q, want 7000", AnnotationAllocatedPrefix, got)
+	}
+	if got := patched.Annotations[AnnotationAllocatedPrefix+"game-udp"]; got != "7000" {
+		t.Errorf("annotation %sgame-udp = %q, want 7000", AnnotationAllocatedPrefix, got)
+	}
+
+	ports := patched.Spec.Containers[0].Ports
+	if ports[0].Protocol != corev1.ProtocolTCP || ports[0].HostPort != 7000 {
+		t.Errorf("ports[0] = %d/%s, want 7000/TCP", ports[0].HostPort, ports[0].Protocol)
+	}
+	if ports[1].Protocol != corev1.ProtocolUDP || ports[1].HostPort != 7000 {
+		t.Errorf("ports[1] = %d/%s, want 7000/UDP", ports[1].HostPort, ports[1].Protocol)
+	}
+}
+
+func TestPodMutator_Handle_AllocationCallback(t *testing.T) {
+	events := make(chan callback.Event, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e callback.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("failed to decode callback body: %v", err)
+		}
+		events <- e
+	}))
+	defer server.Close()
+
+	notifier := callback.NewNotifier(server.URL, logr.Discard())
+	mutator := newTestMutator(t, nil, WithAllocationCallback(notifier))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: "games",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 8080},
+						{Name: "voice", ContainerPort: 8081, Protocol: corev1.ProtocolUDP},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	want := map[int32]callback.Event{
+		7010: {Node: "node-1", Namespace: "games", Pod: "app-1", Port: 7010, Protocol: "TCP"},
+		7011: {Node: "node-1", Namespace: "games", Pod: "app-1", Port: 7011, Protocol: "UDP"},
+	}
+	for range want {
+		select {
+		case got := <-events:
+			if got != want[got.Port] {
+				t.Errorf("callback payload = %+v, want %+v", got, want[got.Port])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for allocation callback")
+		}
+	}
+}
+
+func TestPodMutator_Handle_AllocationCallbackDryRun(t *testing.T) {
+	calls := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+	}))
+	defer server.Close()
+
+	notifier := callback.NewNotifier(server.URL, logr.Discard())
+	mutator := newTestMutator(t, nil, WithAllocationCallback(notifier))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app-1",
+			Namespace:   "games",
+			Annotations: map[string]string{AnnotationEnabled: "true"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 8080}}}},
+		},
+	}
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+			DryRun: ptr.To(true),
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	select {
+	case <-calls:
+		t.Error("allocation callback sent for a dry run")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPodMutator_Handle_PresetPortAnnotations(t *testing.T) {
+	mutator := newTestMutator(t, nil, WithPresetPortAnnotations())
+	alloc := mutator.allocator
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Dynamic",
+				AnnotationMinPort: "7000",
+				AnnotationMaxPort: "7010",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "metrics", ContainerPort: 7000, HostPort: 7000},
+						{Name: "game", ContainerPort: 8080},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	patched := applyPatch(t, rawPod, resp)
+	if got := patched.Annotations[AnnotationPresetPrefix+"metrics"]; got != "7000" {
+		t.Errorf("annotation %smetrics = %q, want 7000", AnnotationPresetPrefix, got)
+	}
+	if got := patched.Annotations[AnnotationAllocatedPrefix+"game"]; got != "7001" {
+		t.Errorf("annotation %sgame = %q, want 7001", AnnotationAllocatedPrefix, got)
+	}
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 2 || got[0] != 7000 {
+		t.Errorf("node-1/TCP ports = %v, want the preset 7000 tracked as used", got)
+	}
+}
+
+func TestPodMutator_Handle_PartialAllocation(t *testing.T) {
+	// Five named ports, room for three
+	var named []corev1.ContainerPort
+	for i := 0; i < 5; i++ {
+		named = append(named, corev1.ContainerPort{Name: fmt.Sprintf("p%d", i), ContainerPort: 8080 + int32(i)})
+	}
+	// The only port of the range is taken for UDP by another pod
+	udpHolder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{ContainerPort: 7000, HostPort: 7000, Protocol: corev1.ProtocolUDP}}}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		objs    []client.Object
+		partial bool
+		rng     string
+		ports   []corev1.ContainerPort
+		// wantPorts are the hostPorts of the spec ports, 0 for skipped ones
+		wantPorts   []int32
+		wantSkipped string
+		wantDenied  bool
+	}{
+		{name: "all or nothing by default", rng: "7000..7002", ports: named, wantDenied: true},
+		{name: "named ports past the range are skipped", partial: true, rng: "7000..7002", ports: named,
+			wantPorts: []int32{7000, 7001, 7002, 0, 0}, wantSkipped: "p3,p4"},
+		{name: "unnamed skipped port before an allocated one", objs: []client.Object{udpHolder}, partial: true, rng: "7000..7000",
+			ports:     []corev1.ContainerPort{{ContainerPort: 7777, Protocol: corev1.ProtocolUDP}, {ContainerPort: 8888}},
+			wantPorts: []int32{0, 7000}, wantSkipped: "7777-udp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := newTestMutator(t, tt.objs)
+			annotations := map[string]string{AnnotationPolicy: "Dynamic", AnnotationRange: tt.rng}
+			if tt.partial {
+				annotations[AnnotationPartial] = "true"
+			}
+			pod := podWithPorts(annotations, tt.ports...)
+			req, rawPod := admissionRequest(t, pod)
+
+			resp := mutator.Handle(context.Background(), req)
+			if tt.wantDenied {
+				if resp.Allowed {
+					t.Fatal("Handle() expected denied without partial mode, got allowed")
+				}
+				return
+			}
+			if !resp.Allowed {
+				t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+			}
+			if len(resp.Warnings) == 0 {
+				t.Error("Handle() expected a warning about skipped ports")
+			}
+
+			patched := applyPatch(t, rawPod, resp)
+			for i, want := range tt.wantPorts {
+				got := patched.Spec.Containers[0].Ports[i]
+				orig := tt.ports[i]
+				key := allocatedAnnotation(allocator.PortRequest{Name: orig.Name, ContainerPort: orig.ContainerPort, Protocol: got.Protocol})
+				if want == 0 {
+					if got.HostPort != 0 || got.ContainerPort != orig.ContainerPort {
+						t.Errorf("skipped port %d = %d->%d, want it left unassigned", i, got.HostPort, got.ContainerPort)
+					}
+					if _, ok := patched.Annotations[key]; ok {
+						t.Errorf("annotation %s set for a skipped port", key)
+					}
+					continue
+				}
+				if got.HostPort != want {
+					t.Errorf("port %d hostPort = %d, want %d", i, got.HostPort, want)
+				}
+				if val := patched.Annotations[key]; val != strconv.Itoa(int(want)) {
+					t.Errorf("annotation %s = %q, want %d", key, val, want)
+				}
+			}
+			if got := patched.Annotations[AnnotationSkipped]; got != tt.wantSkipped {
+				t.Errorf("annotation %s = %q, want %q", AnnotationSkipped, got, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestPodMutator_Handle_InvalidPortNameKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		portName    string
+		wantAllowed bool
+		wantKey     string
+	}{
+		{"slash", "web/http", false, ""},
+		{"trailing dot", "game.", false, ""},
+		{"too long", strings.Repeat("a", 60), false, ""},
+		{"valid", "game", true, AnnotationAllocatedPrefix + "game"},
+		{"unnamed keyed by containerPort", "", true, AnnotationAllocatedPrefix + "8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := newTestMutator(t, nil)
+			alloc := mutator.allocator
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app-0",
+					Namespace:   "default",
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+				Spec: corev1.PodSpec{
+					NodeName: "node-1",
+					Containers: []corev1.Container{
+						{Ports: []corev1.ContainerPort{{Name: tt.portName, ContainerPort: 8080}}},
+					},
+				},
+			}
+			rawPod, _ := json.Marshal(pod)
+			req := admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Object: runtime.RawExtension{Raw: rawPod},
+				},
+			}
+
+			resp := mutator.Handle(context.Background(), req)
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Handle() allowed = %v, want %v (%s)", resp.Allowed, tt.wantAllowed, resp.Result.Message)
+			}
+			if !tt.wantAllowed {
+				if !strings.Contains(resp.Result.Message, "can't be used in annotation key") {
+					t.Errorf("Handle() message = %q, want an annotation key error", resp.Result.Message)
+				}
+				if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 0 {
+					t.Errorf("node-1/TCP ports = %v, want none held for a denied pod", got)
+				}
+				return
+			}
+			patched := applyPatch(t, rawPod, resp)
+			if _, ok := patched.Annotations[tt.wantKey]; !ok {
+				t.Errorf("annotation %s not set, got %v", tt.wantKey, patched.Annotations)
+			}
+		})
+	}
+}
+
+func TestAllocatedPortEnv(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-2",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 8080},
+						{Name: "voice", ContainerPort: 8081, Protocol: corev1.ProtocolUDP},
+					},
+					Env: []corev1.EnvVar{
+						AllocatedPortEnv("GAME_PORT", "game", corev1.ProtocolTCP),
+						AllocatedPortEnv("VOICE_PORT", "voice", corev1.ProtocolUDP),
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	patched := applyPatch(t, rawPod, resp)
+
+	// Resolve each env var the way the kubelet does and compare with the spec
+	container := patched.Spec.Containers[0]
+	for i, env := range container.Env {
+		fieldPath := env.ValueFrom.FieldRef.FieldPath
+		key, ok := strings.CutPrefix(fieldPath, "metadata.annotations['")
+		if !ok || !strings.HasSuffix(key, "']") {
+			t.Fatalf("%s fieldPath = %q, want a metadata.annotations reference", env.Name, fieldPath)
+		}
+		got := patched.Annotations[strings.TrimSuffix(key, "']")]
+		want := strconv.Itoa(int(container.Ports[i].HostPort))
+		if got != want {
+			t.Errorf("%s resolves to %q, want hostPort %s", env.Name, got, want)
+		}
+	}
+}
+
+func TestPodMutator_Handle_PinnedPort(t *testing.T) {
+	// Another pod already holds 7000
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7000, HostPort: 7000}}},
+			},
+		},
+	}
+
+	newRequest := func(pin string) (admission.Request, []byte) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-0",
+				Namespace: "default",
+				Annotations: map[string]string{
+					AnnotationEnabled:            "true",
+					AnnotationPolicy:             "Dynamic",
+					AnnotationRange:              "7000..7100",
+					AnnotationPinPrefix + "rcon": pin,
+				},
+			},
+			Spec: corev1.PodSpec{
+				NodeName: "node-1",
+				Containers: []corev1.Container{
+					{
+						Ports: []corev1.ContainerPort{
+							{Name: "game", ContainerPort: 8080},
+							{Name: "rcon", ContainerPort: 8081},
+							{Name: "query", ContainerPort: 8082},
+						},
+					},
+				},
+			},
+		}
+		rawPod, _ := json.Marshal(pod)
+		return admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Object: runtime.RawExtension{Raw: rawPod},
+			},
+		}, rawPod
+	}
+
+	mutator := newTestMutator(t, []client.Object{holder})
+
+	req, rawPod := newRequest("7050")
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	patched := applyPatch(t, rawPod, resp)
+	want := map[string]int32{"game": 7001, "rcon": 7050, "query": 7002}
+	for _, p := range patched.Spec.Containers[0].Ports {
+		if p.HostPort != want[p.Name] {
+			t.Errorf("port %s hostPort = %d, want %d", p.Name, p.HostPort, want[p.Name])
+		}
+	}
+
+	// A pin on a port in use is a conflict, not a fallback to Dynamic
+	for _, pin := range []string{"7000", "not-a-port", "0"} {
+		req, _ := newRequest(pin)
+		if resp := mutator.Handle(context.Background(), req); resp.Allowed {
+			t.Errorf("Handle() with pin %q expected denied, got allowed", pin)
+		}
+	}
+}
+
+func TestParseBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		val     string
+		want    []allocator.PortRange
+		wantErr bool
+	}{
+		{"single block", "7000/4", []allocator.PortRange{{Min: 7000, Max: 7015}}, false},
+		{"multiple blocks", "7000/4, 30000/8", []allocator.PortRange{{Min: 7000, Max: 7015}, {Min: 30000, Max: 30255}}, false},
+		{"single port block", "9000/0", []allocator.PortRange{{Min: 9000, Max: 9000}}, false},
+		{"missing size", "7000", nil, true},
+		{"negative size", "7000/-1", nil, true},
+		{"size too large", "7000/17", nil, true},
+		{"non-numeric size", "7000/x", nil, true},
+		{"invalid start", "abc/4", nil, true},
+		{"past max port", "65530/4", nil, true},
+		{"empty", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBlocks(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBlocks(%q) error = %v, wantErr %v", tt.val, err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseBlocks(%q) = %v, want %v", tt.val, got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("parseBlocks(%q)[%d] = %v, want %v", tt.val, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		val     string
+		want    allocator.PortRange
+		wantErr bool
+	}{
+		{"dot-dot form", "7000..7999", allocator.PortRange{Min: 7000, Max: 7999}, false},
+		{"surrounding spaces", " 7000 .. 7999 ", allocator.PortRange{Min: 7000, Max: 7999}, false},
+		{"single port", "9000..9000", allocator.PortRange{Min: 9000, Max: 9000}, false},
+		{"dash form", "7000-7999", allocator.PortRange{}, true},
+		{"missing max", "7000..", allocator.PortRange{}, true},
+		{"missing min", "..7999", allocator.PortRange{}, true},
+		{"non-numeric", "a..b", allocator.PortRange{}, true},
+		{"max below min", "7999..7000", allocator.PortRange{}, true},
+		{"past max port", "65000..70000", allocator.PortRange{}, true},
+		{"triple dot", "7000...7999", allocator.PortRange{}, true},
+		{"empty", "", allocator.PortRange{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRange(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRange(%q) error = %v, wantErr %v", tt.val, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRange(%q) = %v, want %v", tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestMutator returns a PodMutator with its own allocator over a fake
+// client holding objs
+func newTestMutator(t *testing.T, objs []client.Object, opts ...MutatorOption) *PodMutator {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("AddToScheme() error = %v", err)
+	}
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	return NewPodMutator(fakeClient, scheme, allocator.NewAllocator(fakeClient), opts...)
+}
+
+// podWithPorts returns pod app-0 in default on node-1, enabled for
+// allocation with the given annotations, its one container declaring ports
+func podWithPorts(annotations map[string]string, ports ...corev1.ContainerPort) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app-0",
+			Namespace:   "default",
+			Annotations: map[string]string{AnnotationEnabled: "true"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: ports}},
+		},
+	}
+	maps.Copy(pod.Annotations, annotations)
+	return pod
+}
+
+// admissionRequest returns a CREATE admission request for pod, and the raw
+// pod to apply its response's patch to
+func admissionRequest(t *testing.T, pod *corev1.Pod) (admission.Request, []byte) {
+	t.Helper()
+	rawPod, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("failed to marshal pod: %v", err)
+	}
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Namespace: pod.Namespace,
+		Object:    runtime.RawExtension{Raw: rawPod},
+	}}, rawPod
+}
+
+// applyPatch applies the response's JSON patch to the original raw pod
+func applyPatch(t *testing.T, raw []byte, resp admission.Response) *corev1.Pod {
+	t.Helper()
+	patchJSON, err := json.Marshal(resp.Patches)
+	if err != nil {
+		t.Fatalf("failed to marshal patches: %v", err)
+	}
+	patch, err := jsonpatch.DecodePatch(patchJSON)
+	if err != nil {
+		t.Fatalf("failed to decode patch: %v", err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		t.Fatalf("failed to apply patch: %v", err)
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(patched, pod); err != nil {
+		t.Fatalf("failed to unmarshal patched pod: %v", err)
+	}
+	return pod
+}
+
+func TestPodMutator_Handle_PreserveContainerPort(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled:               "true",
+				AnnotationPolicy:                "Index",
+				AnnotationMinPort:               "7000",
+				AnnotationPreserveContainerPort: "true",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "http",
+							ContainerPort: 8080,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	patched := applyPatch(t, rawPod, resp)
+	ports := patched.Spec.Containers[0].Ports
+	if len(ports) != 2 {
+		t.Fatalf("expected 2 ports after mutation, got %d: %+v", len(ports), ports)
+	}
+	if ports[0].Name != "http" || ports[0].HostPort != 7010 || ports[0].ContainerPort != 7010 {
+		t.Errorf("allocated port = %+v, want http with hostPort/containerPort 7010", ports[0])
+	}
+	if ports[1].Name != "http-orig" || ports[1].ContainerPort != 8080 || ports[1].HostPort != 0 {
+		t.Errorf("preserved port = %+v, want http-orig with containerPort 8080", ports[1])
+	}
+}
+
+func TestPodMutator_Handle_NamespaceMetricLabel(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "team-a",
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "team-a",
+			Object:    runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	counter := metrics.WebhookRequestsTotal.WithLabelValues("allowed", "team-a")
+	before := testutil.ToFloat64(counter)
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("WebhookRequestsTotal{result=allowed,namespace=team-a} increased by %v, want 1", got)
+	}
+}
+
+func TestPodMutator_Handle_IndexFromLabel(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			// The name suffix would give index 0
+			Name:      "app-0",
+			Namespace: "default",
+			Labels: map[string]string{
+				"app.kubernetes.io/instance-ordinal": "3",
+			},
+			Annotations: map[string]string{
+				AnnotationEnabled:        "true",
+				AnnotationPolicy:         "Index",
+				AnnotationMinPort:        "7000",
+				AnnotationIndexFromLabel: "app.kubernetes.io/instance-ordinal",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "http",
+							ContainerPort: 8080,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	patched := applyPatch(t, rawPod, resp)
+	if got := patched.Spec.Containers[0].Ports[0].HostPort; got != 7030 {
+		t.Errorf("HostPort = %d, want 7030 (index 3 from label)", got)
+	}
+}
+
+func TestPodIndex_MissingLabel(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "app-2",
+			Annotations: map[string]string{
+				AnnotationIndexFromLabel: "app.kubernetes.io/instance-ordinal",
+			},
+		},
+	}
+
+	if _, err := podIndexFrom(pod, DefaultIndexSources); err == nil {
+		t.Error("podIndexFrom() expected error when the configured label is missing, got nil")
+	}
+}
+
+func TestPodIndexFrom_SourcePriority(t *testing.T) {
+	// Every source is present, each with a different value
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "app-4",
+			Annotations: map[string]string{
+				AnnotationIndexFromLabel: "example.com/slot",
+				AnnotationIndex:          "2",
+			},
+			Labels: map[string]string{
+				"example.com/slot": "1",
+				LabelPodIndex:      "3",
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		sources []IndexSource
+		want    int32
+	}{
+		{"default order", nil, 1},
+		{"pod-index first", []IndexSource{IndexSourcePodIndex, IndexSourceLabel}, 3},
+		{"annotation first", []IndexSource{IndexSourceAnnotation, IndexSourceName}, 2},
+		{"name only", []IndexSource{IndexSourceName}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := podIndexFrom(pod, tt.sources)
+			if err != nil {
+				t.Fatalf("podIndexFrom() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("podIndexFrom() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Absent sources are skipped in order
+	bare := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-7"}}
+	if got, err := podIndexFrom(bare, []IndexSource{IndexSourceAnnotation, IndexSourcePodIndex, IndexSourceName}); err != nil || got != 7 {
+		t.Errorf("podIndexFrom() = %d, %v, want 7 from the name", got, err)
+	}
+}
+
+func TestParseIndexSources(t *testing.T) {
+	got, err := ParseIndexSources("pod-index, annotation,name")
+	if err != nil {
+		t.Fatalf("ParseIndexSources() error = %v", err)
+	}
+	want := []IndexSource{IndexSourcePodIndex, IndexSourceAnnotation, IndexSourceName}
+	if len(got) != len(want) {
+		t.Fatalf("ParseIndexSources() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ParseIndexSources()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	for _, val := range []string{"slot", "name,name", ""} {
+		if _, err := ParseIndexSources(val); err == nil {
+			t.Errorf("ParseIndexSources(%q) expected error, got nil", val)
+		}
+	}
+}
+
+func TestPodMutator_Handle_NodePoolRange(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "gaming-1",
+			Labels: map[string]string{"pool": "gaming"},
+		},
+	}
+
+	poolRanges, err := ParseNodePoolRanges("gaming=30000-30999,general=7000-8000")
+	if err != nil {
+		t.Fatalf("ParseNodePoolRanges() error = %v", err)
+	}
+
+	mutator := newTestMutator(t, []client.Object{node}, WithNodePoolRanges("pool", poolRanges))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "match-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Dynamic",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "gaming-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "game",
+							ContainerPort: 7777,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	patched := applyPatch(t, rawPod, resp)
+	if got := patched.Spec.Containers[0].Ports[0].HostPort; got != 30000 {
+		t.Errorf("HostPort = %d, want 30000 from the gaming pool range", got)
+	}
+}
+
+func TestRegister_CustomPath(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	server := webhook.NewServer(webhook.Options{})
+	Register(server, "/custom-mutate", mutator)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "default",
+		},
+	}
+	rawPod, _ := json.Marshal(pod)
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			UID:    "test-uid",
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+	body, _ := json.Marshal(review)
+
+	post := func(path string) *httptest.ResponseRecorder {
+		httpReq := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		httpReq.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		server.WebhookMux().ServeHTTP(rec, httpReq)
+		return rec
+	}
+
+	rec := post("/custom-mutate")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /custom-mutate status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode admission review: %v", err)
+	}
+	if got.Response == nil || !got.Response.Allowed {
+		t.Errorf("expected allowed admission response, got %+v", got.Response)
+	}
+
+	if rec := post(DefaultWebhookPath); rec.Code != http.StatusNotFound {
+		t.Errorf("POST %s status = %d, want %d", DefaultWebhookPath, rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestPodMutator_Handle_BestEffortExhausted(t *testing.T) {
+	// The whole range [7000, 7000] is taken
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "holder",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 7000, HostPort: 7000},
+					},
+				},
+			},
+		},
+	}
+
+	mutator := newTestMutator(t, []client.Object{holder})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Dynamic",
+				AnnotationMinPort: "7000",
+				AnnotationMaxPort: "7000",
+				AnnotationMode:    ModeBestEffort,
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{
+					Ports: []corev1.ContainerPort{
+						{Name: "game", ContainerPort: 8080},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response in best-effort mode, got denied: %s", resp.Result.Message)
+	}
+	if len(resp.Patches) != 0 {
+		t.Errorf("Handle() expected no mutation, got patches %+v", resp.Patches)
+	}
+	if len(resp.Warnings) == 0 {
+		t.Error("Handle() expected a warning about skipped allocation")
+	}
+
+	// Without best-effort the same pod is denied
+	delete(pod.Annotations, AnnotationMode)
+	rawPod, _ = json.Marshal(pod)
+	req.Object.Raw = rawPod
+	if resp := mutator.Handle(context.Background(), req); resp.Allowed {
+		t.Error("Handle() expected denial on exhaustion without best-effort mode")
+	}
+}
+
+func TestPodMutator_Handle_AllocationHistory(t *testing.T) {
+	// Another pod name's history, which admissions of app-0 must leave alone
+	other := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: HistoryConfigMapName, Namespace: "default"},
+		Data:       map[string]string{"app-9": "v4:7900"},
+	}
+
+	mutator := newTestMutator(t, []client.Object{other}, WithAllocationHistory(2))
+	alloc := mutator.allocator
+	fakeClient := mutator.Client
+
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-0",
+				Namespace: "default",
+				Annotations: map[string]string{
+					AnnotationEnabled: "true",
+					AnnotationPolicy:  "Index",
+					AnnotationMinPort: "7000",
+				},
+			},
+			Spec: corev1.PodSpec{
+				NodeName: "node-1",
+				Containers: []corev1.Container{
+					{
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 8080},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// Each round admits a new incarnation of app-0 with no earlier pod of the
+	// name left, as after a StatefulSet recreate; a dry run records nothing
+	ctx := context.Background()
+	rounds := []struct {
+		dryRun bool
+		want   string
+	}{
+		{want: "v1:7000"},
+		{dryRun: true, want: "v1:7000,v2:7000"},
+		{want: "v1:7000,v2:7000"},
+		{want: "v2:7000,v3:7000"},
+	}
+	for i, round := range rounds {
+		rawPod, _ := json.Marshal(newPod())
+		req := admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: rawPod},
+				DryRun:    &round.dryRun,
+			},
+		}
+
+		resp := mutator.Handle(ctx, req)
+		if !resp.Allowed {
+			t.Fatalf("Handle() #%d expected allowed response, got denied: %s", i+1, resp.Result.Message)
+		}
+
+		patched := applyPatch(t, rawPod, resp)
+		if got := patched.Annotations[AnnotationHistory]; got != round.want {
+			t.Errorf("Handle() #%d history = %q, want %q", i+1, got, round.want)
+		}
+		alloc.ReleasePod(patched)
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := fakeClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: HistoryConfigMapName}, cm); err != nil {
+		t.Fatalf("Get() history ConfigMap error = %v", err)
+	}
+	want := map[string]string{"app-0": "v2:7000,v3:7000", "app-9": "v4:7900"}
+	if !maps.Equal(cm.Data, want) {
+		t.Errorf("history ConfigMap data = %v, want %v", cm.Data, want)
+	}
+}
+
+func TestPodMutator_Handle_MinimalPatch(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Index",
+				AnnotationMinPort: "7000",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Name: "sidecar"},
+				{
+					Name: "app",
+					Ports: []corev1.ContainerPort{
+						{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	got := make([]string, 0, len(resp.Patches))
+	for _, op := range resp.Patches {
+		got = append(got, op.Operation+" "+op.Path)
+	}
+	want := []string{
+		"add /spec/hostNetwork",
+		"replace /spec/containers/1/ports/0/containerPort",
+		"add /spec/containers/1/ports/0/hostPort",
+		"add /metadata/annotations/hostport.io~1allocated-http",
+		"add /metadata/annotations/hostport.io~1allocation-meta",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("patch operations =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, op := range resp.Patches[1:3] {
+		if op.Value != int32(7010) {
+			t.Errorf("%s value = %v, want 7010", op.Path, op.Value)
+		}
+	}
+
+	patched := applyPatch(t, rawPod, resp)
+	if port := patched.Spec.Containers[1].Ports[0]; port.HostPort != 7010 || port.ContainerPort != 7010 {
+		t.Errorf("patched port = %+v, want hostPort/containerPort 7010", port)
+	}
+}
+
+func TestPodMutator_Handle_MergePatch(t *testing.T) {
+	mutator := newTestMutator(t, nil, WithMergePatch())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "game"},
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Index",
+				AnnotationMinPort: "7000",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Name: "sidecar", Image: "envoy"},
+				{
+					Name:  "app",
+					Image: "game-server",
+					Ports: []corev1.ContainerPort{
+						{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+					},
+				},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	if resp.PatchType == nil || *resp.PatchType != PatchTypeMergePatch || len(resp.Patches) != 0 {
+		t.Fatalf("Handle() patch type = %v with %d JSON patch operations, want %s only", resp.PatchType, len(resp.Patches), PatchTypeMergePatch)
+	}
+
+	// Only the mutated fields appear in the patch
+	var patch struct {
+		Metadata map[string]json.RawMessage `json:"metadata"`
+		Spec     map[string]json.RawMessage `json:"spec"`
+	}
+	if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+		t.Fatalf("Unmarshal(patch) error = %v", err)
+	}
+	var keys []string
+	for key := range patch.Metadata {
+		keys = append(keys, "metadata."+key)
+	}
+	for key := range patch.Spec {
+		keys = append(keys, "spec."+key)
+	}
+	slices.Sort(keys)
+	if want := []string{"metadata.annotations", "spec.containers", "spec.hostNetwork"}; !slices.Equal(keys, want) {
+		t.Errorf("patched fields = %v, want %v", keys, want)
+	}
+
+	patchedJSON, err := jsonpatch.MergePatch(rawPod, resp.Patch)
+	if err != nil {
+		t.Fatalf("MergePatch() error = %v", err)
+	}
+	patched := &corev1.Pod{}
+	if err := json.Unmarshal(patchedJSON, patched); err != nil {
+		t.Fatalf("Unmarshal(patched pod) error = %v", err)
+	}
+	if port := patched.Spec.Containers[1].Ports[0]; port.HostPort != 7010 || port.ContainerPort != 7010 {
+		t.Errorf("patched port = %+v, want hostPort/containerPort 7010", port)
+	}
+	if patched.Annotations[AnnotationAllocatedPrefix+"http"] != "7010" || patched.Annotations[AnnotationPolicy] != "Index" {
+		t.Errorf("patched annotations = %v, want the allocation added to the original ones", patched.Annotations)
+	}
+	if patched.Spec.Containers[0].Image != "envoy" || patched.Spec.Containers[1].Image != "game-server" || patched.Labels["app"] != "game" {
+		t.Errorf("patched pod = %+v, want fields other than ports untouched", patched)
+	}
+}
+
+func TestPodMutator_Handle_UtilizationWarning(t *testing.T) {
+	// Another pod already holds 8 of the 10 ports in the range
+	var held []corev1.ContainerPort
+	for p := int32(7000); p < 7008; p++ {
+		held = append(held, corev1.ContainerPort{Name: fmt.Sprintf("p%d", p), ContainerPort: p, HostPort: p})
+	}
+	existing := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: held}},
+		},
+	}
+
+	mutator := newTestMutator(t, []client.Object{existing}, WithUtilizationWarning(90))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Dynamic",
+				AnnotationRange:   "7000..7009",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 9000}}},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	if patched := applyPatch(t, rawPod, resp); patched.Spec.Containers[0].Ports[0].HostPort != 7008 {
+		t.Errorf("hostPort = %d, want 7008", patched.Spec.Containers[0].Ports[0].HostPort)
+	}
+	want := []string{"node-1 TCP range 90% full"}
+	if strings.Join(resp.Warnings, "|") != strings.Join(want, "|") {
+		t.Errorf("warnings = %q, want %q", resp.Warnings, want)
+	}
+}
+
+func TestPodMutator_Handle_DenialDiagnostics(t *testing.T) {
+	// Another pod holds every port of the range
+	var held []corev1.ContainerPort
+	for p := int32(7000); p < 7008; p++ {
+		held = append(held, corev1.ContainerPort{Name: fmt.Sprintf("p%d", p), ContainerPort: p, HostPort: p})
+	}
+	existing := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: held}},
+		},
+	}
+
+	mutator := newTestMutator(t, []client.Object{existing})
+
+	handle := func(diagnostics bool) admission.Response {
+		t.Helper()
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app",
+				Namespace: "default",
+				Annotations: map[string]string{
+					AnnotationEnabled: "true",
+					AnnotationPolicy:  "Dynamic",
+					AnnotationRange:   "7000..7007",
+				},
+			},
+			Spec: corev1.PodSpec{
+				NodeName: "node-1",
+				Containers: []corev1.Container{
+					{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 9000}}},
+				},
+			},
+		}
+		if diagnostics {
+			pod.Annotations[AnnotationDiagnostics] = "true"
+		}
+		rawPod, _ := json.Marshal(pod)
+		resp := mutator.Handle(context.Background(), admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: rawPod}},
+		})
+		if resp.Allowed {
+			t.Fatalf("Handle() expected denied response, got allowed")
+		}
+		return resp
+	}
+
+	if resp := handle(false); resp.Result.Details != nil {
+		t.Errorf("Details without %s = %+v, want nil", AnnotationDiagnostics, resp.Result.Details)
+	}
+
+	resp := handle(true)
+	details := resp.Result.Details
+	if details == nil || details.Name != "app" || len(details.Causes) != 2 {
+		t.Fatalf("Details = %+v, want the reason and the TCP utilization of app", details)
+	}
+	if reason := details.Causes[0]; reason.Type != CauseTypeAllocation || reason.Message != resp.Result.Message {
+		t.Errorf("Causes[0] = %+v, want the denial reason", reason)
+	}
+	want := metav1.StatusCause{Type: CauseTypeNodeUtilization, Message: "node node-1: 8 of 8 TCP ports in [7000, 7007] in use (100%)"}
+	if got := details.Causes[1]; got != want {
+		t.Errorf("Causes[1] = %+v, want %+v", got, want)
+	}
+}
+
+func TestPodMutator_Handle_SharedSidecarPort(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+	alloc := mutator.allocator
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Dynamic",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+				{Name: "proxy", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	if got := alloc.Snapshot()["node-1/TCP"]; len(got) != 1 {
+		t.Fatalf("node-1/TCP allocations = %v, want a single port", got)
+	}
+
+	patched := applyPatch(t, rawPod, resp)
+	hostPort := patched.Spec.Containers[0].Ports[0].HostPort
+	if hostPort == 0 {
+		t.Fatalf("app port not allocated: %+v", patched.Spec.Containers[0].Ports[0])
+	}
+	if sidecar := patched.Spec.Containers[1].Ports[0]; sidecar.HostPort != hostPort || sidecar.ContainerPort != hostPort {
+		t.Errorf("sidecar port = %+v, want hostPort/containerPort %d like the app", sidecar, hostPort)
+	}
+	if got := patched.Annotations[AnnotationAllocatedPrefix+"http"]; got != strconv.Itoa(int(hostPort)) {
+		t.Errorf("%shttp = %q, want %d", AnnotationAllocatedPrefix, got, hostPort)
+	}
+}
+
+func TestPodMutator_Handle_FallbackAnnotation(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	squatter := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "squatter", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7010, HostPort: 7010}}},
+			},
+		},
+	}
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(squatter).Build()
+
+	alloc := allocator.NewAllocator(fakeClient, allocator.WithIndexFallback())
+	mutator := NewPodMutator(fakeClient, scheme, alloc)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Index",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7777}}},
+			},
+		},
+	}
+
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	patched := applyPatch(t, rawPod, resp)
+	if got := patched.Annotations[AnnotationFallback]; got != "game=Dynamic" {
+		t.Errorf("%s = %q, want %q", AnnotationFallback, got, "game=Dynamic")
+	}
+	if got := patched.Spec.Containers[0].Ports[0].HostPort; got == 7010 {
+		t.Errorf("hostPort = %d, want a Dynamic port other than the taken Index port", got)
+	}
+}
+
+func TestPodMutator_Handle_SystemNamespace(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "agent-0",
+			Namespace: "kube-system",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Index",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{
+				{Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+			},
+		},
+	}
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "kube-system",
+			Object:    runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		opts        []MutatorOption
+		wantPatched bool
+	}{
+		{name: "system namespace by default"},
+		{name: "system namespaces cleared", opts: []MutatorOption{WithSystemNamespaces()}, wantPatched: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := newTestMutator(t, nil, tt.opts...)
+
+			resp := mutator.Handle(context.Background(), req)
+			if !resp.Allowed {
+				t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+			}
+			if patched := len(resp.Patches) > 0; patched != tt.wantPatched {
+				t.Errorf("Handle() patched = %v (%d ops), want %v", patched, len(resp.Patches), tt.wantPatched)
+			}
+		})
+	}
+}
+
+func TestPodMutator_Handle_Pools(t *testing.T) {
+	holder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "a", ContainerPort: 30000, HostPort: 30000}}}},
+		},
+	}
+	pools := map[string]allocator.PortRange{
+		"gaming":  {Min: 30000, Max: 30000},
+		"general": {Min: 7000, Max: 7099},
+	}
+
+	mutator := newTestMutator(t, []client.Object{holder}, WithNodePoolRanges("", pools))
+
+	newRequest := func(poolsValue string) ([]byte, admission.Request) {
+		pod := podWithPorts(map[string]string{
+			AnnotationPolicy: "Dynamic",
+			AnnotationPools:  poolsValue,
+		}, corev1.ContainerPort{Name: "game", ContainerPort: 7777})
+		rawPod, _ := json.Marshal(pod)
+		return rawPod, admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: rawPod}}}
+	}
+
+	rawPod, req := newRequest("gaming, general")
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	if got := applyPatch(t, rawPod, resp).Spec.Containers[0].Ports[0].HostPort; got != 7000 {
+		t.Errorf("hostPort = %d, want 7000 from general once gaming is full", got)
+	}
+
+	_, req = newRequest("gaming,missing")
+	if resp := mutator.Handle(context.Background(), req); resp.Allowed {
+		t.Error("Handle() with an unknown pool allowed, want denied")
+	}
+
+	// Pools don't move the range of other policies
+	indexPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-2",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Index",
+				AnnotationRange:   "8000..8099",
+				AnnotationPools:   "gaming,general",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7777}}}},
+		},
+	}
+	rawPod, _ = json.Marshal(indexPod)
+	resp = mutator.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: rawPod}}})
+	if !resp.Allowed {
+		t.Fatalf("Handle() of an Index pod expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	if got := applyPatch(t, rawPod, resp).Spec.Containers[0].Ports[0].HostPort; got != 8020 {
+		t.Errorf("Index hostPort = %d, want 8020 from its own range", got)
+	}
+}
+
+func TestPodMutator_Handle_OverlappingPools(t *testing.T) {
+	pools := map[string]allocator.PortRange{
+		"gaming":  {Min: 7000, Max: 7499},
+		"general": {Min: 7400, Max: 7999},
+		"voice":   {Min: 8000, Max: 8099},
+	}
+
+	mutator := newTestMutator(t, nil, WithNodePoolRanges("", pools))
+
+	tests := []struct {
+		pools       string
+		wantMessage string
+	}{
+		{pools: "gaming,general", wantMessage: `pools "gaming" [7000, 7499] and "general" [7400, 7999] in hostport.io/pools annotation overlap`},
+		{pools: "voice, voice", wantMessage: `pools "voice" [8000, 8099] and "voice" [8000, 8099] in hostport.io/pools annotation overlap`},
+		{pools: "gaming,voice"},
+	}
+	for _, tt := range tests {
+		pod := podWithPorts(map[string]string{
+			AnnotationPolicy: "Dynamic",
+			AnnotationPools:  tt.pools,
+		}, corev1.ContainerPort{Name: "game", ContainerPort: 7777})
+		req, _ := admissionRequest(t, pod)
+		resp := mutator.Handle(context.Background(), req)
+		if tt.wantMessage == "" {
+			if !resp.Allowed {
+				t.Errorf("Handle(pools %q) denied: %s, want allowed", tt.pools, resp.Result.Message)
+			}
+			continue
+		}
+		if resp.Allowed || resp.Result.Message != tt.wantMessage {
+			t.Errorf("Handle(pools %q) allowed = %v, message %q, want denied with %q", tt.pools, resp.Allowed, resp.Result.Message, tt.wantMessage)
+		}
+	}
+}
+
+func TestPodMutator_Handle_DecisionCache(t *testing.T) {
+	// Pods have no UID yet on CREATE; a generateName pod has no name either
+	tests := []struct {
+		name         string
+		meta         metav1.ObjectMeta
+		wantNewRetry bool
+	}{
+		{name: "named pod", meta: metav1.ObjectMeta{Name: "app-0"}},
+		{name: "generateName pod", meta: metav1.ObjectMeta{GenerateName: "app-"}, wantNewRetry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := newTestMutator(t, nil, WithDecisionCache(time.Minute))
+			fakeClient := mutator.Client
+
+			pod := &corev1.Pod{
+				ObjectMeta: tt.meta,
+				Spec: corev1.PodSpec{
+					NodeName:   "node-1",
+					Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7777}}}},
+				},
+			}
+			pod.Namespace = "default"
+			pod.Annotations = map[string]string{
+				AnnotationEnabled: "true",
+				AnnotationPolicy:  "Dynamic",
+			}
+			rawPod, _ := json.Marshal(pod)
+			request := func(uid types.UID) admission.Request {
+				return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{UID: uid, Object: runtime.RawExtension{Raw: rawPod}}}
+			}
+
+			first := mutator.Handle(context.Background(), request("req-1"))
+			if !first.Allowed {
+				t.Fatalf("Handle() expected allowed response, got denied: %s", first.Result.Message)
+			}
+			firstPort := applyPatch(t, rawPod, first).Spec.Containers[0].Ports[0].HostPort
+
+			// Another pod takes the port meanwhile; a fresh allocation would move on
+			holder := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+				Spec: corev1.PodSpec{
+					NodeName:   "node-1",
+					Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "a", ContainerPort: firstPort, HostPort: firstPort}}}},
+				},
+			}
+			if err := fakeClient.Create(context.Background(), holder); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			retry := mutator.Handle(context.Background(), request("req-1"))
+			if !retry.Allowed {
+				t.Fatalf("Handle() retry expected allowed response, got denied: %s", retry.Result.Message)
+			}
+			if got := applyPatch(t, rawPod, retry).Spec.Containers[0].Ports[0].HostPort; got != firstPort {
+				t.Errorf("retry hostPort = %d, want %d as first admitted", got, firstPort)
+			}
+
+			// Another request for a generateName pod is another pod
+			other := mutator.Handle(context.Background(), request("req-2"))
+			if !other.Allowed {
+				t.Fatalf("Handle() of req-2 expected allowed response, got denied: %s", other.Result.Message)
+			}
+			got := applyPatch(t, rawPod, other).Spec.Containers[0].Ports[0].HostPort
+			if newPort := got != firstPort; newPort != tt.wantNewRetry {
+				t.Errorf("req-2 hostPort = %d, first admitted %d; want a fresh allocation = %v", got, firstPort, tt.wantNewRetry)
+			}
+		})
+	}
+}
+
+func TestPodMutator_Handle_DecisionCacheInvalidation(t *testing.T) {
+	newPod := func(containerPort int32) *corev1.Pod {
+		return podWithPorts(map[string]string{
+			AnnotationPolicy: "Dynamic",
+		}, corev1.ContainerPort{Name: "game", ContainerPort: containerPort})
+	}
+	tests := []struct {
+		name string
+		// between runs after the first admission of newPod(7777)
+		between    func(alloc *allocator.Allocator, first *corev1.Pod)
+		dryRun     bool
+		retry      *corev1.Pod
+		wantReplay bool
+	}{
+		{name: "retry", retry: newPod(7777), wantReplay: true},
+		{name: "dry run first", dryRun: true, retry: newPod(7777)},
+		{name: "recreated with another spec", retry: newPod(9999)},
+		{
+			name:    "ports released meanwhile",
+			between: func(alloc *allocator.Allocator, first *corev1.Pod) { alloc.ReleasePod(first) },
+			retry:   newPod(7777),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := newTestMutator(t, nil, WithDecisionCache(time.Minute))
+			alloc := mutator.allocator
+			fakeClient := mutator.Client
+
+			request := func(pod *corev1.Pod, dryRun bool) ([]byte, admission.Request) {
+				rawPod, _ := json.Marshal(pod)
+				return rawPod, admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+					DryRun: ptr.To(dryRun),
+					Object: runtime.RawExtension{Raw: rawPod},
+				}}
+			}
+
+			rawFirst, req := request(newPod(7777), tt.dryRun)
+			first := mutator.Handle(context.Background(), req)
+			if !first.Allowed {
+				t.Fatalf("Handle() expected allowed response, got denied: %s", first.Result.Message)
+			}
+			firstPod := applyPatch(t, rawFirst, first)
+			firstPort := firstPod.Spec.Containers[0].Ports[0].HostPort
+			if tt.between != nil {
+				tt.between(alloc, firstPod)
+			}
+
+			// Another pod takes the port meanwhile; a fresh allocation moves on
+			holder := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "holder", Namespace: "default"},
+				Spec: corev1.PodSpec{
+					NodeName:   "node-1",
+					Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "a", ContainerPort: firstPort, HostPort: firstPort}}}},
+				},
+			}
+			if err := fakeClient.Create(context.Background(), holder); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			rawRetry, req := request(tt.retry, false)
+			retry := mutator.Handle(context.Background(), req)
+			if !retry.Allowed {
+				t.Fatalf("Handle() retry expected allowed response, got denied: %s", retry.Result.Message)
+			}
+			got := applyPatch(t, rawRetry, retry).Spec.Containers[0].Ports[0].HostPort
+			if replayed := got == firstPort; replayed != tt.wantReplay {
+				t.Errorf("retry hostPort = %d, first admitted %d; want replayed = %v", got, firstPort, tt.wantReplay)
+			}
+		})
+	}
+}
+
+func TestPodMutator_Handle_Partition(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	admit := func(name string, annotations map[string]string) admission.Response {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					AnnotationEnabled:   "true",
+					AnnotationPolicy:    "Index",
+					AnnotationPartition: "2",
+				},
+			},
+			Spec: corev1.PodSpec{
+				NodeName:   "node-1",
+				Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7777}}}},
+			},
+		}
+		for k, v := range annotations {
+			pod.Annotations[k] = v
+		}
+		req, _ := admissionRequest(t, pod)
+		resp := mutator.Handle(context.Background(), req)
+		if !resp.Allowed {
+			t.Fatalf("Handle(%s) expected allowed response, got denied: %s", name, resp.Result.Message)
+		}
+		return resp
+	}
+	hostPort := func(resp admission.Response) string {
+		for _, p := range resp.Patches {
+			if p.Path == "/metadata/annotations/hostport.io~1allocated-game" {
+				return fmt.Sprint(p.Value)
+			}
+		}
+		return ""
+	}
+
+	// Pods below the partition keep the band; the rest move up half the range
+	for name, want := range map[string]string{"app-0": "7000", "app-1": "7010", "app-2": "7520", "app-3": "7530"} {
+		if got := hostPort(admit(name, nil)); got != want {
+			t.Errorf("%s hostPort = %s, want %s", name, got, want)
+		}
+	}
+
+	// The offset can be set explicitly
+	if got := hostPort(admit("app-2", map[string]string{AnnotationPartitionOffset: "100"})); got != "7120" {
+		t.Errorf("app-2 hostPort with offset 100 = %s, want 7120", got)
+	}
+}
+
+func TestPodMutator_Handle_StaticExpected(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+
+	handle := func(expected string) admission.Response {
+		pod := podWithPorts(map[string]string{
+			AnnotationPolicy:                "Static",
+			AnnotationStaticPrefix + "game": expected,
+		}, corev1.ContainerPort{Name: "game", ContainerPort: 7777, HostPort: 7500})
+		req, _ := admissionRequest(t, pod)
+		return mutator.Handle(context.Background(), req)
+	}
+
+	if resp := handle("7500"); !resp.Allowed {
+		t.Errorf("Handle() with matching annotation denied: %s", resp.Result.Message)
+	}
+
+	resp := handle("7600")
+	if resp.Allowed {
+		t.Fatal("Handle() with mismatching annotation allowed, want denied")
+	}
+	if want := `hostPort 7500 of port "game" doesn't match 7600 declared in annotation hostport.io/static-game`; resp.Result.Message != want {
+		t.Errorf("Handle() message = %q, want %q", resp.Result.Message, want)
+	}
+}
+
+func TestPodMutator_Handle_SecondaryAnnotationPrefix(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+
+	// Previous incarnation of app-0, admitted before the prefix migration
+	oldPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"legacy.example.com/allocated-game": "7005",
+			},
+		},
+		Spec: corev1.PodSpec{NodeName: "node-1"},
+	}
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(oldPod).Build()
+	alloc := allocator.NewAllocator(fakeClient, allocator.WithSecondaryAnnotationPrefix("legacy.example.com/"))
+	mutator := NewPodMutator(fakeClient, scheme, alloc)
+
+	pod := podWithPorts(map[string]string{
+		AnnotationPolicy: "Dynamic",
+	}, corev1.ContainerPort{Name: "game", ContainerPort: 7777})
+	req, rawPod := admissionRequest(t, pod)
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	mutated := applyPatch(t, rawPod, resp)
+	if got := mutated.Spec.Containers[0].Ports[0].HostPort; got != 7005 {
+		t.Errorf("hostPort = %d, want 7005 recovered from the old prefix", got)
+	}
+	if got := mutated.Annotations[AnnotationAllocatedPrefix+"game"]; got != "7005" {
+		t.Errorf("allocated annotation = %q, want 7005 under the current prefix", got)
+	}
+}
+
+func TestPodMutator_Handle_CandidateNodes(t *testing.T) {
+	holder := func(name, node string, ports ...int32) *corev1.Pod {
+		var specPorts []corev1.ContainerPort
+		for _, p := range ports {
+			specPorts = append(specPorts, corev1.ContainerPort{Name: fmt.Sprintf("p%d", p), ContainerPort: p, HostPort: p})
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: node, Containers: []corev1.Container{{Ports: specPorts}}},
+		}
+	}
+
+	mutator := newTestMutator(t, []client.Object{holder("busy", "node-a", 7000, 7001, 7002), holder("quiet", "node-b", 7000)})
+	if err := mutator.allocator.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled:        "true",
+				AnnotationPolicy:         "Dynamic",
+				AnnotationCandidateNodes: "node-a, node-b",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7777}}}},
+		},
+	}
+	req, rawPod := admissionRequest(t, pod)
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+
+	mutated := applyPatch(t, rawPod, resp)
+	if got := mutated.Annotations[allocator.AnnotationPlacedNode]; got != "node-b" {
+		t.Errorf("placed node = %q, want the less used node-b", got)
+	}
+	if got := mutated.Spec.Containers[0].Ports[0].HostPort; got != 7001 {
+		t.Errorf("hostPort = %d, want 7001, the first port free on node-b", got)
+	}
+	terms := mutated.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) != 1 || len(terms[0].MatchFields) != 1 || terms[0].MatchFields[0].Values[0] != "node-b" {
+		t.Errorf("node affinity terms = %+v, want the pod pinned to node-b", terms)
+	}
+}
+
+func TestPodMutator_Handle_AssumedNode(t *testing.T) {
+	tests := []struct {
+		name        string
+		nodeName    string
+		annotations map[string]string
+		want        string
+	}{
+		{name: "pending pod", want: "pending"},
+		{name: "placed on a candidate", annotations: map[string]string{AnnotationCandidateNodes: "node-b"}, want: "node-b"},
+		{name: "bound pod", nodeName: "node-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := newTestMutator(t, nil)
+
+			annotations := map[string]string{AnnotationEnabled: "true", AnnotationPolicy: "Dynamic"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-0", Namespace: "default", Annotations: annotations},
+				Spec: corev1.PodSpec{
+					NodeName:   tt.nodeName,
+					Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7777}}}},
+				},
+			}
+			req, rawPod := admissionRequest(t, pod)
+			resp := mutator.Handle(context.Background(), req)
+			if !resp.Allowed {
+				t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+			}
+
+			mutated := applyPatch(t, rawPod, resp)
+			got, ok := mutated.Annotations[allocator.AnnotationAssumedNode]
+			if tt.want == "" && ok {
+				t.Errorf("%s = %q on a bound pod, want it unset", allocator.AnnotationAssumedNode, got)
+			}
+			if got != tt.want {
+				t.Errorf("%s = %q, want %q", allocator.AnnotationAssumedNode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMutation(t *testing.T) {
+	original := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "app",
+				Ports: []corev1.ContainerPort{
+					{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolTCP},
+					{Name: "voice", ContainerPort: 7778, Protocol: corev1.ProtocolUDP},
+				},
+			}},
+		},
+	}
+	m := &PodMutator{}
+
+	pod := original.DeepCopy()
+	m.applyToSpec(pod, allocator.PortRequest{Name: "game", ContainerPort: 7777, HostPort: 20000, Protocol: corev1.ProtocolTCP})
+	m.applyToSpec(pod, allocator.PortRequest{Name: "voice", ContainerPort: 7778, HostPort: 20001, Protocol: corev1.ProtocolUDP})
+	if err := verifyMutation(original, pod, nil); err != nil {
+		t.Errorf("verifyMutation() error = %v, want nil", err)
+	}
+
+	// An allocation carrying the wrong name never reaches the voice port
+	pod = original.DeepCopy()
+	m.applyToSpec(pod, allocator.PortRequest{Name: "game", ContainerPort: 7777, HostPort: 20000, Protocol: corev1.ProtocolTCP})
+	m.applyToSpec(pod, allocator.PortRequest{Name: "voip", ContainerPort: 7778, HostPort: 20001, Protocol: corev1.ProtocolUDP})
+	err := verifyMutation(original, pod, nil)
+	if err == nil || !strings.Contains(err.Error(), `"voice"`) {
+		t.Errorf("verifyMutation() error = %v, want the unassigned voice port reported", err)
+	}
+
+	// Unless partial allocation skipped it on purpose
+	if err := verifyMutation(original, pod, []string{allocator.AllocationKey("voice", corev1.ProtocolUDP)}); err != nil {
+		t.Errorf("verifyMutation() with voice skipped error = %v, want nil", err)
+	}
+
+	// Two ports given the same hostPort
+	pod = original.DeepCopy()
+	pod.Spec.Containers[0].Ports[1].Protocol = corev1.ProtocolTCP
+	m.applyToSpec(pod, allocator.PortRequest{Name: "game", ContainerPort: 7777, HostPort: 20000, Protocol: corev1.ProtocolTCP})
+	m.applyToSpec(pod, allocator.PortRequest{Name: "voice", ContainerPort: 7778, HostPort: 20000, Protocol: corev1.ProtocolTCP})
+	if err := verifyMutation(original, pod, nil); err == nil {
+		t.Error("verifyMutation() with a duplicate hostPort expected error, got nil")
+	}
+}
+
+func TestPodMutator_Handle_DualStack(t *testing.T) {
+	mutator := newTestMutator(t, nil)
+	fakeClient := mutator.Client
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-0",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationEnabled:   "true",
+				AnnotationPolicy:    "Dynamic",
+				AnnotationDualStack: "true",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{
+				Name:  "app",
+				Image: "game-server",
+				Ports: []corev1.ContainerPort{{Name: "game", ContainerPort: 7777, Protocol: corev1.ProtocolUDP}},
+			}},
+		},
+	}
+	rawPod, _ := json.Marshal(pod)
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Object: runtime.RawExtension{Raw: rawPod},
+		},
+	}
+
+	resp := mutator.Handle(context.Background(), req)
+	if !resp.Allowed {
+		t.Fatalf("Handle() expected allowed response, got denied: %s", resp.Result.Message)
+	}
+	patched := applyPatch(t, rawPod, resp)
+	ports := patched.Spec.Containers[0].Ports
+	if len(ports) != 2 {
+		t.Fatalf("patched ports = %+v, want the port and its IPv6 declaration", ports)
+	}
+	if ports[1].HostIP != "::" || ports[1].HostPort != ports[0].HostPort || ports[1].Protocol != corev1.ProtocolUDP {
+		t.Errorf("IPv6 declaration = %+v, want hostIP :: for %d/UDP", ports[1], ports[0].HostPort)
+	}
+
+	// A fresh allocator rebuilding from the pod list keeps both holds
+	if err := fakeClient.Create(context.Background(), patched); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	restarted := allocator.NewAllocator(fakeClient)
+	if err := restarted.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	snapshot := restarted.Snapshot()
+	if !slices.Contains(snapshot["node-1/UDP"], ports[0].HostPort) || !slices.Contains(snapshot["node-1/UDP6"], ports[0].HostPort) {
+		t.Errorf("Snapshot() after Warmup = %v, want %d held in UDP and UDP6", snapshot, ports[0].HostPort)
+	}
+}
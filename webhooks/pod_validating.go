@@ -0,0 +1,144 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+// DefaultValidatingWebhookPath is where the validating webhook is served
+const DefaultValidatingWebhookPath = "/validate-pods"
+
+// PodValidator denies operator-managed pods with a hostPort chosen by the pod
+// author outside the allowed ranges: every hostPort of Static and Passthrough
+// pods, and in pods of the other policies, ports pinned with
+// hostport.io/pin-<name> and hostPorts preset in the spec. Those ports are
+// chosen by the pod author rather than the allocator, so without it they can
+// land anywhere.
+type PodValidator struct {
+	decoder *admission.Decoder
+	// allowed are the ranges hostPorts chosen by the pod author must fall in
+	allowed []allocator.PortRange
+}
+
+// NewPodValidator returns a PodValidator accepting hostPorts in any of the
+// allowed ranges
+func NewPodValidator(scheme *runtime.Scheme, allowed ...allocator.PortRange) *PodValidator {
+	return &PodValidator{
+		decoder: admission.NewDecoder(scheme),
+		allowed: allowed,
+	}
+}
+
+func (v *PodValidator) Handle(_ context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := v.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if pod.Annotations[AnnotationEnabled] != "true" {
+		return admission.Allowed("hostPort allocation not enabled")
+	}
+	policy := allocator.PolicyIndex
+	if val, ok := pod.Annotations[AnnotationPolicy]; ok {
+		policy = allocator.PortPolicy(val)
+	}
+
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.HostPort == 0 || v.isAllowed(p.HostPort) {
+				continue
+			}
+			how, chosen := authorChosen(pod, policy, p)
+			if !chosen {
+				continue
+			}
+			return admission.Denied(fmt.Sprintf("%s hostPort %d of container %s port %q is outside the allowed ranges %v",
+				how, p.HostPort, c.Name, p.Name, v.allowed))
+		}
+	}
+	return admission.Allowed("")
+}
+
+// authorChosen reports whether a spec port's hostPort was chosen by the pod
+// author rather than the allocator, and how: by the pod's Static or
+// Passthrough policy, pinned, or preset in the spec. Validation runs after
+// mutation, so the ports the allocator filled in are told apart by their
+// hostport.io/allocated-<name> annotations.
+func authorChosen(pod *corev1.Pod, policy allocator.PortPolicy, p corev1.ContainerPort) (string, bool) {
+	if _, ok := pod.Annotations[AnnotationPinPrefix+p.Name]; ok && p.Name != "" {
+		return "pinned", true
+	}
+	if policy == allocator.PolicyStatic || policy == allocator.PolicyPassthrough {
+		return string(policy), true
+	}
+	hostPort := strconv.Itoa(int(p.HostPort))
+	if p.Name != "" {
+		key := allocatedAnnotation(allocator.PortRequest{Name: p.Name, Protocol: p.Protocol})
+		return "preset", pod.Annotations[key] != hostPort
+	}
+	// Unnamed ports are keyed by an original containerPort host networking
+	// may have rewritten, and the IPv6 declarations of dual-stack ports are
+	// unnamed copies, so any allocation of the same hostPort matches
+	for key, val := range pod.Annotations {
+		if strings.HasPrefix(key, AnnotationAllocatedPrefix) && val == hostPort {
+			return "", false
+		}
+	}
+	return "preset", true
+}
+
+// isAllowed reports whether port is in one of the allowed ranges
+func (v *PodValidator) isAllowed(port int32) bool {
+	for _, r := range v.allowed {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePortRanges parses comma-separated inclusive "min-max" ranges, e.g.
+// "7000-8000,30000-30999". A single port stands for a range of one.
+func ParsePortRanges(val string) ([]allocator.PortRange, error) {
+	var ranges []allocator.PortRange
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		minStr, maxStr, isRange := strings.Cut(entry, "-")
+		minPort, err := strconv.Atoi(minStr)
+		if err != nil || minPort < 1 || minPort > 65535 {
+			return nil, fmt.Errorf("range %q has invalid min port", entry)
+		}
+		maxPort := minPort
+		if isRange {
+			maxPort, err = strconv.Atoi(maxStr)
+			if err != nil || maxPort < minPort || maxPort > 65535 {
+				return nil, fmt.Errorf("range %q has invalid max port", entry)
+			}
+		}
+		ranges = append(ranges, allocator.PortRange{Min: int32(minPort), Max: int32(maxPort)})
+	}
+	return ranges, nil
+}
+
+// RegisterValidator serves the validator on the webhook server at path
+func RegisterValidator(server webhook.Server, path string, validator *PodValidator) {
+	if path == "" {
+		path = DefaultValidatingWebhookPath
+	}
+	server.Register(path, &webhook.Admission{
+		Handler: validator,
+	})
+}
@@ -0,0 +1,100 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/SkynetNext/hostport-operator/internal/allocator"
+)
+
+func TestPodValidator_Handle(t *testing.T) {
+	scheme := runtime.NewScheme()
+	corev1.AddToScheme(scheme)
+	validator := NewPodValidator(scheme, allocator.PortRange{Min: 7000, Max: 8000}, allocator.PortRange{Min: 30000, Max: 30999})
+
+	tests := []struct {
+		name        string
+		policy      string
+		annotations map[string]string
+		port        corev1.ContainerPort
+		wantAllowed bool
+	}{
+		{name: "static in first range", policy: "Static", port: corev1.ContainerPort{Name: "game", HostPort: 7500}, wantAllowed: true},
+		{name: "passthrough in second range", policy: "Passthrough", port: corev1.ContainerPort{Name: "game", HostPort: 30080}, wantAllowed: true},
+		{name: "static out of range", policy: "Static", port: corev1.ContainerPort{Name: "game", HostPort: 9000}, wantAllowed: false},
+		{name: "passthrough out of range", policy: "Passthrough", port: corev1.ContainerPort{Name: "game", HostPort: 80}, wantAllowed: false},
+		{name: "dynamic allocation is not checked", policy: "Dynamic",
+			annotations: map[string]string{AnnotationAllocatedPrefix + "game": "9000"},
+			port:        corev1.ContainerPort{Name: "game", HostPort: 9000}, wantAllowed: true},
+		{name: "unnamed dynamic allocation is not checked", policy: "Dynamic",
+			annotations: map[string]string{AnnotationAllocatedPrefix + "7777": "9000"},
+			port:        corev1.ContainerPort{HostPort: 9000}, wantAllowed: true},
+		{name: "dynamic preset out of range", policy: "Dynamic", port: corev1.ContainerPort{Name: "game", HostPort: 9000}, wantAllowed: false},
+		{name: "index preset out of range", port: corev1.ContainerPort{Name: "game", HostPort: 9000}, wantAllowed: false},
+		{name: "daemonset preset in range", policy: "DaemonSet", port: corev1.ContainerPort{Name: "game", HostPort: 7100}, wantAllowed: true},
+		{name: "pinned out of range", policy: "Dynamic",
+			annotations: map[string]string{AnnotationPinPrefix + "game": "9000", AnnotationAllocatedPrefix + "game": "9000"},
+			port:        corev1.ContainerPort{Name: "game", HostPort: 9000}, wantAllowed: false},
+		{name: "allocation under another name is a preset", policy: "Dynamic",
+			annotations: map[string]string{AnnotationAllocatedPrefix + "voice": "9000"},
+			port:        corev1.ContainerPort{Name: "game", HostPort: 9000}, wantAllowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{AnnotationEnabled: "true"}
+			if tt.policy != "" {
+				annotations[AnnotationPolicy] = tt.policy
+			}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			port := tt.port
+			port.ContainerPort = port.HostPort
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app-0",
+					Namespace:   "default",
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "app",
+						Ports: []corev1.ContainerPort{port},
+					}},
+				},
+			}
+			rawPod, _ := json.Marshal(pod)
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: rawPod}}}
+
+			resp := validator.Handle(context.Background(), req)
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Handle() allowed = %v, want %v (%s)", resp.Allowed, tt.wantAllowed, resp.Result.Message)
+			}
+			if !tt.wantAllowed && !strings.Contains(resp.Result.Message, "outside the allowed ranges [[7000, 8000] [30000, 30999]]") {
+				t.Errorf("Handle() message = %q, want it to name the allowed ranges", resp.Result.Message)
+			}
+		})
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := ParsePortRanges("7000-8000, 30080")
+	if err != nil {
+		t.Fatalf("ParsePortRanges() error = %v", err)
+	}
+	want := []allocator.PortRange{{Min: 7000, Max: 8000}, {Min: 30080, Max: 30080}}
+	if len(ranges) != len(want) || ranges[0] != want[0] || ranges[1] != want[1] {
+		t.Errorf("ParsePortRanges() = %v, want %v", ranges, want)
+	}
+	if _, err := ParsePortRanges("8000-7000"); err == nil {
+		t.Error("ParsePortRanges(8000-7000) error = nil, want an error")
+	}
+}